@@ -0,0 +1,171 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+// ErrSecretExpired is returned when a client authenticates with a secret past its SecretExpiresAt
+var ErrSecretExpired = fosite.ErrInvalidClient.WithDebug("The client secret has expired")
+
+func (c *clientData) primaryExpired(now time.Time) bool {
+	return c.SecretExpiresAt > 0 && now.Unix() >= int64(c.SecretExpiresAt)
+}
+
+func (c *clientData) secondaryValid(now time.Time) bool {
+	return c.SecondarySecret != "" && (c.SecondarySecretExpiresAt.IsZero() || now.Before(c.SecondarySecretExpiresAt))
+}
+
+// compareSecrets accepts the primary secret unless it expired, or the secondary secret until it expires. A secret
+// hashed with outdated parameters is rehashed once it is accepted.
+func (d *DatastoreManager) compareSecrets(ctx context.Context, cd *clientData, secret []byte) error {
+	now := time.Now()
+
+	err := d.hasher.Compare(ctx, []byte(cd.Secret), secret)
+	if err == nil {
+		if cd.primaryExpired(now) {
+			return errors.WithStack(ErrSecretExpired)
+		}
+		d.upgradeSecret(ctx, cd.ID, false, cd.Secret, secret)
+		return nil
+	}
+
+	if cd.secondaryValid(now) {
+		if err := d.hasher.Compare(ctx, []byte(cd.SecondarySecret), secret); err == nil {
+			d.upgradeSecret(ctx, cd.ID, true, cd.SecondarySecret, secret)
+			return nil
+		}
+	}
+
+	return errors.WithStack(err)
+}
+
+// upgradeSecret rehashes the secret if its hash is stale. The client already authenticated, so a failed upgrade is
+// logged and left to be retried on its next authentication rather than rejecting it.
+func (d *DatastoreManager) upgradeSecret(ctx context.Context, id string, secondary bool, hash string, secret []byte) {
+	if id == "" || d.client == nil || !NeedsRehash(d.hasher, []byte(hash)) {
+		return
+	}
+	if err := d.rehashSecret(ctx, id, secondary, hash, secret); err != nil && d.L != nil {
+		d.L.WithError(err).WithField("client_id", id).Warnf("Could not upgrade the stale secret hash")
+	}
+}
+
+type secretCheckKey struct{}
+
+// secretCheck is the outcome of authenticating a client by its ID with DatastoreManager.Authenticate
+type secretCheck struct {
+	err    error
+	secret []byte
+	// hashes are the hashes of the secrets of the client, fosite compares the secret with one of them
+	hashes [][]byte
+}
+
+// authenticateFromRequest authenticates the client of r, the same way fosite reads its credentials, and returns ctx
+// with the outcome for the SecretHasher. Requests without a client secret are left to fosite.
+func (d *DatastoreManager) authenticateFromRequest(ctx context.Context, r *http.Request) context.Context {
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		return ctx
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	id, err := url.QueryUnescape(id)
+	if err != nil {
+		return ctx
+	}
+	if secret, err = url.QueryUnescape(secret); err != nil || id == "" || secret == "" {
+		return ctx
+	}
+
+	check := &secretCheck{secret: []byte(secret)}
+	cd, err := d.getClientData(ctx, id)
+	if err == nil {
+		err = d.compareSecrets(ctx, cd, check.secret)
+		check.hashes = [][]byte{[]byte(cd.Secret), []byte(cd.SecondarySecret)}
+	}
+	check.err = err
+	return context.WithValue(ctx, secretCheckKey{}, check)
+}
+
+// NewSecretAuthenticator returns provider authenticating clients with their secret through manager, so the expiry and
+// rotations of client secrets are enforced by the token and revocation endpoints. provider must be composed with a
+// SecretHasher.
+func NewSecretAuthenticator(provider fosite.OAuth2Provider, manager *DatastoreManager) fosite.OAuth2Provider {
+	return &secretAuthenticator{OAuth2Provider: provider, manager: manager}
+}
+
+type secretAuthenticator struct {
+	fosite.OAuth2Provider
+	manager *DatastoreManager
+}
+
+// NewAccessRequest is implemented for the fosite.OAuth2Provider interface
+func (a *secretAuthenticator) NewAccessRequest(ctx context.Context, r *http.Request, session fosite.Session) (fosite.AccessRequester, error) {
+	return a.OAuth2Provider.NewAccessRequest(a.manager.authenticateFromRequest(ctx, r), r, session)
+}
+
+// NewRevocationRequest is implemented for the fosite.OAuth2Provider interface
+func (a *secretAuthenticator) NewRevocationRequest(ctx context.Context, r *http.Request) error {
+	return a.OAuth2Provider.NewRevocationRequest(a.manager.authenticateFromRequest(ctx, r), r)
+}
+
+// NewIntrospectionRequest is implemented for the fosite.OAuth2Provider interface
+func (a *secretAuthenticator) NewIntrospectionRequest(ctx context.Context, r *http.Request, session fosite.Session) (fosite.IntrospectionResponder, error) {
+	return a.OAuth2Provider.NewIntrospectionRequest(a.manager.authenticateFromRequest(ctx, r), r, session)
+}
+
+// SecretHasher is the fosite.Hasher of a provider returned by NewSecretAuthenticator. When the client of the request
+// was authenticated by the provider, Compare returns its outcome instead of comparing the secret with the hash of its
+// primary secret only. Otherwise it compares them with the hasher it wraps.
+type SecretHasher struct {
+	fosite.Hasher
+}
+
+// NewSecretHasher returns a SecretHasher wrapping hasher
+func NewSecretHasher(hasher fosite.Hasher) *SecretHasher {
+	return &SecretHasher{Hasher: hasher}
+}
+
+// Compare is implemented for the fosite.Hasher interface
+func (h *SecretHasher) Compare(ctx context.Context, hash, data []byte) error {
+	check, ok := ctx.Value(secretCheckKey{}).(*secretCheck)
+	if !ok {
+		return h.Hasher.Compare(ctx, hash, data)
+	}
+	if check.err != nil {
+		return check.err
+	}
+
+	// fosite may hold a client cached before a rotation, it still compares the secret with one of the client's hashes
+	if subtle.ConstantTimeCompare(check.secret, data) == 1 {
+		for _, hashed := range check.hashes {
+			if len(hashed) > 0 && subtle.ConstantTimeCompare(hashed, hash) == 1 {
+				return nil
+			}
+		}
+	}
+	return h.Hasher.Compare(ctx, hash, data)
+}
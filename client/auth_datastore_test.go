@@ -0,0 +1,216 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/storage"
+	"github.com/ory/hydra/client"
+	"github.com/pkg/errors"
+)
+
+// tokenStore stores tokens in memory and looks clients up with the manager
+type tokenStore struct {
+	*storage.MemoryStore
+	manager *DatastoreManager
+}
+
+func (s *tokenStore) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	return s.manager.GetClient(ctx, id)
+}
+
+// newTestProvider returns a provider issuing tokens with the client credentials grant, wired the same way as Hydra's
+func newTestProvider(m *DatastoreManager) fosite.OAuth2Provider {
+	config := &compose.Config{AccessTokenLifespan: time.Hour}
+	provider := compose.Compose(
+		config,
+		&tokenStore{MemoryStore: storage.NewMemoryStore(), manager: m},
+		&compose.CommonStrategy{CoreStrategy: compose.NewOAuth2HMACStrategy(config, []byte("some-super-cool-secret-that-nobody-knows"), nil)},
+		NewSecretHasher(m.hasher),
+		compose.OAuth2ClientCredentialsGrantFactory,
+	)
+	return NewSecretAuthenticator(provider, m)
+}
+
+// requestToken requests a token from the token endpoint of provider and returns the response status
+func requestToken(t *testing.T, provider fosite.OAuth2Provider, id, secret string) int {
+	r := httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(id, secret)
+	w := httptest.NewRecorder()
+
+	ctx := r.Context()
+	ar, err := provider.NewAccessRequest(ctx, r, new(fosite.DefaultSession))
+	if err != nil {
+		provider.WriteAccessError(w, ar, err)
+		return w.Code
+	}
+	response, err := provider.NewAccessResponse(ctx, ar)
+	if err != nil {
+		provider.WriteAccessError(w, ar, err)
+		return w.Code
+	}
+	provider.WriteAccessResponse(w, ar, response)
+	return w.Code
+}
+
+func TestCompareSecrets(t *testing.T) {
+	ctx := context.Background()
+	m := &DatastoreManager{hasher: &fosite.BCrypt{WorkFactor: 4}}
+
+	hash := func(secret string) string {
+		h, err := m.hasher.Hash(ctx, []byte(secret))
+		if err != nil {
+			t.Fatalf("could not hash secret: %v", err)
+		}
+		return string(h)
+	}
+	primary, secondary := hash("primary"), hash("secondary")
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		data   clientData
+		secret string
+		want   error
+	}{
+		{"primary", clientData{Secret: primary}, "primary", nil},
+		{"wrong", clientData{Secret: primary}, "wrong", fosite.ErrInvalidClient},
+		{"primaryNotExpired", clientData{Secret: primary, SecretExpiresAt: int(now.Add(time.Hour).Unix())}, "primary", nil},
+		{"primaryExpired", clientData{Secret: primary, SecretExpiresAt: int(now.Add(-time.Hour).Unix())}, "primary", ErrSecretExpired},
+		{"secondary", clientData{Secret: primary, SecondarySecret: secondary}, "secondary", nil},
+		{"secondaryExpired", clientData{Secret: primary, SecondarySecret: secondary, SecondarySecretExpiresAt: now.Add(-time.Hour)}, "secondary", fosite.ErrInvalidClient},
+		{"secondaryAfterPrimaryExpired", clientData{Secret: primary, SecretExpiresAt: int(now.Add(-time.Hour).Unix()), SecondarySecret: secondary}, "secondary", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.compareSecrets(ctx, &tt.data, []byte(tt.secret))
+			if tt.want == nil && err != nil {
+				t.Errorf("compareSecrets() = %v, want nil", err)
+			} else if tt.want == fosite.ErrInvalidClient && err == nil {
+				t.Errorf("compareSecrets() = nil, want an error")
+			} else if tt.want == ErrSecretExpired && errors.Cause(err) != ErrSecretExpired {
+				t.Errorf("compareSecrets() = %v, want ErrSecretExpired", err)
+			}
+		})
+	}
+}
+
+func TestSecretHasher(t *testing.T) {
+	ctx := context.Background()
+	bcrypt := &fosite.BCrypt{WorkFactor: 4}
+	hasher := NewSecretHasher(bcrypt)
+	primary, err := bcrypt.Hash(ctx, []byte("primary"))
+	if err != nil {
+		t.Fatalf("could not hash secret: %v", err)
+	}
+	secondary, err := bcrypt.Hash(ctx, []byte("secondary"))
+	if err != nil {
+		t.Fatalf("could not hash secret: %v", err)
+	}
+
+	if err := hasher.Compare(ctx, primary, []byte("primary")); err != nil {
+		t.Errorf("expected secrets to be compared as is without an authentication, got %v", err)
+	}
+
+	// The secondary secret is accepted once the client authenticated with it
+	authenticated := context.WithValue(ctx, secretCheckKey{}, &secretCheck{secret: []byte("secondary"), hashes: [][]byte{primary, secondary}})
+	if err := hasher.Compare(authenticated, primary, []byte("secondary")); err != nil {
+		t.Errorf("expected the authenticated secret to be accepted, got %v", err)
+	}
+	if err := hasher.Compare(authenticated, primary, []byte("other")); err == nil {
+		t.Error("expected another secret to be compared with the hash")
+	}
+	if err := hasher.Compare(authenticated, []byte("another client"), []byte("secondary")); err == nil {
+		t.Error("expected the secret to be compared with the hash of another client")
+	}
+
+	// An expired secret is rejected even though it matches the hash
+	expired := context.WithValue(ctx, secretCheckKey{}, &secretCheck{err: ErrSecretExpired, secret: []byte("primary"), hashes: [][]byte{primary}})
+	if err := hasher.Compare(expired, primary, []byte("primary")); errors.Cause(err) != ErrSecretExpired {
+		t.Errorf("expected ErrSecretExpired, got %v", err)
+	}
+}
+
+func TestSecretExpiry(t *testing.T) {
+	m, ok := clientManagers["datastore"].(*DatastoreManager)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	ctx := context.Background()
+	em := NewDatastoreManager(m.client, "client-expiry-test", m.hasher)
+	now := time.Now()
+	clients := map[string]time.Duration{
+		"expiry-soon":    time.Hour,
+		"expiry-later":   72 * time.Hour,
+		"expiry-expired": -time.Hour,
+	}
+	for id, in := range clients {
+		c := &client.Client{ClientID: id, Secret: "secret", SecretExpiresAt: int(now.Add(in).Unix()), GrantTypes: []string{"client_credentials"}}
+		if err := em.CreateClient(ctx, c); err != nil {
+			t.Fatalf("could not create client: %v", err)
+		}
+		defer em.DeleteClient(ctx, id)
+	}
+
+	if _, err := em.Authenticate(ctx, "expiry-expired", []byte("secret")); errors.Cause(err) != ErrSecretExpired {
+		t.Errorf("expected ErrSecretExpired, got %v", err)
+	}
+	if _, err := em.Authenticate(ctx, "expiry-soon", []byte("secret")); err != nil {
+		t.Errorf("expected a secret not expired yet to authenticate, got %v", err)
+	}
+
+	// The token endpoint enforces the expiry too
+	provider := newTestProvider(em)
+	if code := requestToken(t, provider, "expiry-expired", "secret"); code != http.StatusUnauthorized {
+		t.Errorf("expected the token endpoint to reject an expired secret, got status %d", code)
+	}
+	if code := requestToken(t, provider, "expiry-soon", "secret"); code != http.StatusOK {
+		t.Errorf("expected the token endpoint to accept a secret not expired yet, got status %d", code)
+	}
+
+	expiring, err := em.FindExpiringSecrets(ctx, now.Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("could not find expiring secrets: %v", err)
+	}
+	if len(expiring) != 1 || expiring[0].ClientID != "expiry-soon" {
+		t.Errorf("expected only expiry-soon to be expiring, got %+v", expiring)
+	}
+
+	var notified []string
+	watcher := NewSecretExpiryWatcher(em, 96*time.Hour, nil)
+	watcher.Subscribe(func(_ context.Context, c *client.Client, _ time.Time) {
+		notified = append(notified, c.ClientID)
+	})
+	for i := 0; i < 2; i++ {
+		if err := watcher.Check(ctx); err != nil {
+			t.Fatalf("could not check expiring secrets: %v", err)
+		}
+	}
+	if len(notified) != 2 || notified[0] != "expiry-soon" || notified[1] != "expiry-later" {
+		t.Errorf("expected each expiring client to be notified once, got %v", notified)
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/client"
+	"github.com/ory/hydra/pkg"
+	"github.com/ory/x/sqlcon"
+	"github.com/pkg/errors"
+)
+
+var (
+	// TypeCheck
+	_ client.Manager = (*CachingManager)(nil)
+
+	// ErrCacheMiss is returned by a CacheBackend when it does not hold a key
+	ErrCacheMiss = errors.New("cache miss")
+)
+
+// CacheBackend is a cache shared by several replicas, its semantics are the ones of the Redis GET, SET with an expiry
+// and DEL commands.
+type CacheBackend interface {
+	// Get returns the value of key, or ErrCacheMiss if it does not hold one
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set sets the value of key, it expires after ttl
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes keys, missing keys are ignored
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// CacheOptions configures a CachingManager
+type CacheOptions struct {
+	// Size is the maximum number of lookups held in process, defaults to 1000
+	Size int
+	// TTL is how long a client is cached, defaults to a minute
+	TTL time.Duration
+	// NegativeTTL is how long an unknown client ID is cached, defaults to TTL
+	NegativeTTL time.Duration
+	// Backend is shared by the replicas so that they stay coherent. When it is set, lookups are only held in process
+	// for LocalTTL, so that the changes made through other replicas are observed within LocalTTL.
+	Backend CacheBackend
+	// LocalTTL is how long lookups are held in process when a Backend is set, they are not if it is zero
+	LocalTTL time.Duration
+	// Prefix is prepended to the keys of the Backend, defaults to hydra:client:
+	Prefix string
+}
+
+// CachingManager is a client.Manager caching the client lookups of another client.Manager. Clients are invalidated
+// when they are created, updated or deleted through it, and when their secret changes if it wraps a DatastoreManager.
+type CachingManager struct {
+	client.Manager
+
+	opts  CacheOptions
+	local *lruCache
+}
+
+// NewCachingManager returns a CachingManager caching the client lookups of m
+func NewCachingManager(m client.Manager, opts CacheOptions) *CachingManager {
+	if opts.Size <= 0 {
+		opts.Size = 1000
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = time.Minute
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = opts.TTL
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "hydra:client:"
+	}
+
+	c := &CachingManager{Manager: m, opts: opts, local: newLRUCache(opts.Size)}
+	if d, ok := AsDatastoreManager(m); ok {
+		d.OnChange(c.Invalidate)
+	}
+	return c
+}
+
+// Unwrap returns the client.Manager whose lookups are cached
+func (c *CachingManager) Unwrap() client.Manager {
+	return c.Manager
+}
+
+// cacheEntry is a cached lookup, a nil Client caches an unknown client ID
+type cacheEntry struct {
+	Client *client.Client `json:"c,omitempty"`
+}
+
+// lookup kinds, the GetClient of a wrapped manager may return a different client than its GetConcreteClient
+const (
+	concreteLookup = "concrete:"
+	fositeLookup   = "fosite:"
+)
+
+func isNotFound(err error) bool {
+	switch errors.Cause(err) {
+	case sqlcon.ErrNoRows, pkg.ErrNotFound, fosite.ErrNotFound:
+		return true
+	}
+	return false
+}
+
+func (c *CachingManager) localTTL(e *cacheEntry) time.Duration {
+	if c.opts.Backend != nil {
+		return c.opts.LocalTTL
+	}
+	if e.Client == nil {
+		return c.opts.NegativeTTL
+	}
+	return c.opts.TTL
+}
+
+func (c *CachingManager) get(ctx context.Context, kind, id string) (*cacheEntry, bool) {
+	if e, ok := c.local.get(kind + id); ok {
+		return e, true
+	}
+	if c.opts.Backend == nil {
+		return nil, false
+	}
+
+	value, err := c.opts.Backend.Get(ctx, c.opts.Prefix+kind+id)
+	if err != nil {
+		return nil, false
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(value, &e); err != nil {
+		return nil, false
+	}
+	if ttl := c.localTTL(&e); ttl > 0 {
+		c.local.set(kind+id, &e, ttl)
+	}
+	return &e, true
+}
+
+func (c *CachingManager) set(ctx context.Context, kind, id string, e *cacheEntry) {
+	if ttl := c.localTTL(e); ttl > 0 {
+		c.local.set(kind+id, e, ttl)
+	}
+	if c.opts.Backend == nil {
+		return
+	}
+
+	ttl := c.opts.TTL
+	if e.Client == nil {
+		ttl = c.opts.NegativeTTL
+	}
+	if value, err := json.Marshal(e); err == nil {
+		// The lookup succeeded, failing to cache it is not worth failing it
+		_ = c.opts.Backend.Set(ctx, c.opts.Prefix+kind+id, value, ttl)
+	}
+}
+
+// cached returns the cached lookup of id, ok is false if there is none
+func (c *CachingManager) cached(ctx context.Context, kind, id string) (cl *client.Client, ok bool, err error) {
+	e, ok := c.get(ctx, kind, id)
+	if !ok {
+		return nil, false, nil
+	}
+	if e.Client == nil {
+		return nil, true, errors.WithStack(sqlcon.ErrNoRows)
+	}
+	// Callers such as Hydra's client handler change the client they are given
+	cp := *e.Client
+	return &cp, true, nil
+}
+
+// store caches the result of looking id up, errors other than the client not being found are not cached
+func (c *CachingManager) store(ctx context.Context, kind, id string, cl *client.Client, err error) {
+	if isNotFound(err) {
+		c.set(ctx, kind, id, &cacheEntry{})
+	} else if err == nil {
+		cp := *cl
+		c.set(ctx, kind, id, &cacheEntry{Client: &cp})
+	}
+}
+
+// Invalidate removes the client from the cache
+func (c *CachingManager) Invalidate(ctx context.Context, id string) {
+	c.local.delete(concreteLookup+id, fositeLookup+id)
+	if c.opts.Backend != nil {
+		_ = c.opts.Backend.Delete(ctx, c.opts.Prefix+concreteLookup+id, c.opts.Prefix+fositeLookup+id)
+	}
+}
+
+// GetConcreteClient returns the cached client, looking it up if needed
+func (c *CachingManager) GetConcreteClient(ctx context.Context, id string) (*client.Client, error) {
+	if cl, ok, err := c.cached(ctx, concreteLookup, id); ok {
+		return cl, err
+	}
+
+	cl, err := c.Manager.GetConcreteClient(ctx, id)
+	c.store(ctx, concreteLookup, id, cl, err)
+	return cl, err
+}
+
+// GetClient returns the cached client, looking it up if needed. Clients of another type than *client.Client are not
+// cached.
+func (c *CachingManager) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	if cl, ok, err := c.cached(ctx, fositeLookup, id); ok {
+		if err != nil {
+			return nil, err
+		}
+		return cl, nil
+	}
+
+	fc, err := c.Manager.GetClient(ctx, id)
+	if err != nil {
+		c.store(ctx, fositeLookup, id, nil, err)
+		return nil, err
+	}
+	if cl, ok := fc.(*client.Client); ok {
+		c.store(ctx, fositeLookup, id, cl, nil)
+	}
+	return fc, nil
+}
+
+// CreateClient creates the client and forgets it was unknown
+func (c *CachingManager) CreateClient(ctx context.Context, cl *client.Client) error {
+	if err := c.Manager.CreateClient(ctx, cl); err != nil {
+		return err
+	}
+	c.Invalidate(ctx, cl.GetID())
+	return nil
+}
+
+// UpdateClient updates the client and invalidates it
+func (c *CachingManager) UpdateClient(ctx context.Context, cl *client.Client) error {
+	defer c.Invalidate(ctx, cl.GetID())
+	return c.Manager.UpdateClient(ctx, cl)
+}
+
+// DeleteClient deletes the client and invalidates it
+func (c *CachingManager) DeleteClient(ctx context.Context, id string) error {
+	defer c.Invalidate(ctx, id)
+	return c.Manager.DeleteClient(ctx, id)
+}
+
+// AsDatastoreManager returns the DatastoreManager m is, or the one it caches the lookups of
+func AsDatastoreManager(m client.Manager) (*DatastoreManager, bool) {
+	for {
+		switch v := m.(type) {
+		case *DatastoreManager:
+			return v, true
+		case interface{ Unwrap() client.Manager }:
+			m = v.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// lruCache is a bounded cache of lookups evicting the least recently used ones first
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruItem struct {
+	key       string
+	entry     *cacheEntry
+	expiresAt time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (l *lruCache) get(key string) (*cacheEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*lruItem)
+	if time.Now().After(item.expiresAt) {
+		l.order.Remove(el)
+		delete(l.entries, key)
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return item.entry, true
+}
+
+func (l *lruCache) set(key string, entry *cacheEntry, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	item := &lruItem{key: key, entry: entry, expiresAt: time.Now().Add(ttl)}
+	if el, ok := l.entries[key]; ok {
+		el.Value = item
+		l.order.MoveToFront(el)
+		return
+	}
+
+	l.entries[key] = l.order.PushFront(item)
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruItem).key)
+	}
+}
+
+func (l *lruCache) delete(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		if el, ok := l.entries[key]; ok {
+			l.order.Remove(el)
+			delete(l.entries, key)
+		}
+	}
+}
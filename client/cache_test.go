@@ -0,0 +1,182 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/client"
+	"github.com/ory/x/sqlcon"
+	"github.com/pkg/errors"
+)
+
+// countingManager counts the lookups reaching the client.Manager it wraps
+type countingManager struct {
+	client.Manager
+	lookups int
+}
+
+func (m *countingManager) GetConcreteClient(ctx context.Context, id string) (*client.Client, error) {
+	m.lookups++
+	return m.Manager.GetConcreteClient(ctx, id)
+}
+
+func (m *countingManager) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	m.lookups++
+	return m.Manager.GetClient(ctx, id)
+}
+
+// memoryBackend is a CacheBackend ignoring expiries
+type memoryBackend struct {
+	sync.Mutex
+	values map[string][]byte
+}
+
+func (b *memoryBackend) Get(_ context.Context, key string) ([]byte, error) {
+	b.Lock()
+	defer b.Unlock()
+	value, ok := b.values[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return value, nil
+}
+
+func (b *memoryBackend) Set(_ context.Context, key string, value []byte, _ time.Duration) error {
+	b.Lock()
+	defer b.Unlock()
+	b.values[key] = value
+	return nil
+}
+
+func (b *memoryBackend) Delete(_ context.Context, keys ...string) error {
+	b.Lock()
+	defer b.Unlock()
+	for _, key := range keys {
+		delete(b.values, key)
+	}
+	return nil
+}
+
+func TestCachingManager(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingManager{Manager: client.NewMemoryManager(&fosite.BCrypt{WorkFactor: 4})}
+	m := NewCachingManager(inner, CacheOptions{Size: 2, TTL: time.Minute})
+
+	if err := m.CreateClient(ctx, &client.Client{ClientID: "cached", Name: "before"}); err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		c, err := m.GetConcreteClient(ctx, "cached")
+		if err != nil || c.Name != "before" {
+			t.Fatalf("unexpected lookup %+v: %v", c, err)
+		}
+		c.Name = "changed by the caller"
+	}
+	if inner.lookups != 1 {
+		t.Errorf("expected a single lookup to reach the manager, got %d", inner.lookups)
+	}
+
+	if _, err := m.GetClient(ctx, "cached"); err != nil {
+		t.Fatalf("could not get client: %v", err)
+	}
+	if inner.lookups != 2 {
+		t.Errorf("expected GetClient to be cached separately, got %d lookups", inner.lookups)
+	}
+
+	if err := m.UpdateClient(ctx, &client.Client{ClientID: "cached", Name: "after"}); err != nil {
+		t.Fatalf("could not update client: %v", err)
+	}
+	if c, _ := m.GetConcreteClient(ctx, "cached"); c == nil || c.Name != "after" {
+		t.Errorf("expected the update to invalidate the client, got %+v", c)
+	}
+
+	// Unknown clients are cached until they are created
+	inner.lookups = 0
+	for i := 0; i < 2; i++ {
+		if _, err := m.GetConcreteClient(ctx, "unknown"); errors.Cause(err) != sqlcon.ErrNoRows {
+			t.Fatalf("expected sqlcon.ErrNoRows, got %v", err)
+		}
+	}
+	if inner.lookups != 1 {
+		t.Errorf("expected the unknown client to be cached, got %d lookups", inner.lookups)
+	}
+	if err := m.CreateClient(ctx, &client.Client{ClientID: "unknown"}); err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	if _, err := m.GetConcreteClient(ctx, "unknown"); err != nil {
+		t.Errorf("expected the created client to be found, got %v", err)
+	}
+
+	if err := m.DeleteClient(ctx, "cached"); err != nil {
+		t.Fatalf("could not delete client: %v", err)
+	}
+	if _, err := m.GetConcreteClient(ctx, "cached"); err == nil {
+		t.Errorf("expected the deleted client to be invalidated")
+	}
+}
+
+func TestCachingManagerBackend(t *testing.T) {
+	ctx := context.Background()
+	backend := &memoryBackend{values: make(map[string][]byte)}
+	inner := &countingManager{Manager: client.NewMemoryManager(&fosite.BCrypt{WorkFactor: 4})}
+	replica1 := NewCachingManager(inner, CacheOptions{Backend: backend})
+	replica2 := NewCachingManager(inner, CacheOptions{Backend: backend})
+
+	if err := replica1.CreateClient(ctx, &client.Client{ClientID: "shared", Name: "before"}); err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	if _, err := replica1.GetConcreteClient(ctx, "shared"); err != nil {
+		t.Fatalf("could not get client: %v", err)
+	}
+	if c, err := replica2.GetConcreteClient(ctx, "shared"); err != nil || c.Name != "before" || inner.lookups != 1 {
+		t.Errorf("expected the second replica to use the shared cache, got %+v after %d lookups", c, inner.lookups)
+	}
+
+	if err := replica1.UpdateClient(ctx, &client.Client{ClientID: "shared", Name: "after"}); err != nil {
+		t.Fatalf("could not update client: %v", err)
+	}
+	if c, _ := replica2.GetConcreteClient(ctx, "shared"); c == nil || c.Name != "after" {
+		t.Errorf("expected the second replica to observe the update, got %+v", c)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	l := newLRUCache(2)
+	for i := 0; i < 3; i++ {
+		l.set(fmt.Sprintf("key-%d", i), &cacheEntry{}, time.Minute)
+		if i == 1 {
+			// key-0 becomes the most recently used, so key-1 is evicted next
+			l.get("key-0")
+		}
+	}
+
+	for key, want := range map[string]bool{"key-0": true, "key-1": false, "key-2": true} {
+		if _, ok := l.get(key); ok != want {
+			t.Errorf("expected %s to be cached: %v", key, want)
+		}
+	}
+
+	l.set("expired", &cacheEntry{}, -time.Second)
+	if _, ok := l.get("expired"); ok {
+		t.Errorf("expected an expired entry to be a miss")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/hydra/client"
+	"github.com/sirupsen/logrus"
+
+	"github.com/someone1/hydra-gcp/dscon"
+)
+
+// FindExpiringSecrets returns the clients whose secret has not expired yet but will by before, soonest first
+func (d *DatastoreManager) FindExpiringSecrets(ctx context.Context, before time.Time) ([]client.Client, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "FindExpiringSecrets", hydraClientKind)
+	defer span.End()
+
+	query := datastore.NewQuery(hydraClientKind).Namespace(d.namespace).
+		Filter("csea >", int(time.Now().Unix())).
+		Filter("csea <=", int(before.Unix())).
+		Order("csea")
+
+	var items []clientData
+	if _, err := d.client.GetAll(ctx, query, &items); err != nil {
+		return nil, dscon.HandleError(err)
+	}
+
+	clients := make([]client.Client, 0, len(items))
+	for i := range items {
+		c, err := items[i].toClient()
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, *c)
+	}
+	dscon.SetEntityCount(span, len(clients))
+	return clients, nil
+}
+
+// SecretExpiryHook is notified of a client whose secret expires at expiresAt
+type SecretExpiryHook func(ctx context.Context, c *client.Client, expiresAt time.Time)
+
+// SecretExpiryWatcher notifies its hooks once of every client secret about to expire
+type SecretExpiryWatcher struct {
+	manager  *DatastoreManager
+	notice   time.Duration
+	l        logrus.FieldLogger
+	mu       sync.Mutex
+	hooks    []SecretExpiryHook
+	notified map[string]int
+}
+
+// NewSecretExpiryWatcher returns a SecretExpiryWatcher notifying of secrets expiring within notice
+func NewSecretExpiryWatcher(manager *DatastoreManager, notice time.Duration, l logrus.FieldLogger) *SecretExpiryWatcher {
+	return &SecretExpiryWatcher{
+		manager:  manager,
+		notice:   notice,
+		l:        l,
+		notified: make(map[string]int),
+	}
+}
+
+// Subscribe adds hook to the hooks notified of expiring secrets
+func (w *SecretExpiryWatcher) Subscribe(hook SecretExpiryHook) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.hooks = append(w.hooks, hook)
+}
+
+// Check notifies the hooks of the secrets expiring within the notice that they were not notified of yet
+func (w *SecretExpiryWatcher) Check(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	clients, err := w.manager.FindExpiringSecrets(ctx, time.Now().Add(w.notice))
+	if err != nil {
+		return err
+	}
+
+	notified := make(map[string]int, len(clients))
+	for i := range clients {
+		c := &clients[i]
+		notified[c.ClientID] = c.SecretExpiresAt
+		if w.notified[c.ClientID] == c.SecretExpiresAt {
+			continue
+		}
+
+		for _, hook := range w.hooks {
+			hook(ctx, c, time.Unix(int64(c.SecretExpiresAt), 0).UTC())
+		}
+	}
+	// Only remember what is still expiring, so a client renewed to a later expiry is notified again
+	w.notified = notified
+	return nil
+}
+
+// Start checks for expiring secrets every interval until ctx is done
+func (w *SecretExpiryWatcher) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Check(ctx); err != nil {
+			w.l.WithError(err).Errorf("Could not check for expiring client secrets")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/herodot"
+	"github.com/ory/hydra/client"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+
+	"github.com/someone1/hydra-gcp/dscon"
+)
+
+// ErrInvalidCursor is returned when a cursor could not be decoded
+var ErrInvalidCursor = &herodot.DefaultError{
+	StatusField: http.StatusText(http.StatusBadRequest),
+	ErrorField:  "The pagination cursor is invalid",
+	CodeField:   http.StatusBadRequest,
+}
+
+// ListOptions selects a page of clients
+type ListOptions struct {
+	// Limit is the maximum number of clients to return
+	Limit int
+	// Cursor is the opaque cursor returned with the previous page, the first page is returned if empty
+	Cursor string
+	// Owner only returns the clients of this owner if set
+	Owner string
+}
+
+// ClientFilter selects a page of the clients matching every field set
+type ClientFilter struct {
+	// Limit is the maximum number of clients to return
+	Limit int
+	// Cursor is the opaque cursor returned with the previous page, the first page is returned if empty
+	Cursor string
+
+	// Owner matches the clients of this owner
+	Owner string
+	// GrantType matches the clients allowed to use this grant type, e.g. client_credentials
+	GrantType string
+	// RedirectHost matches the clients with a redirect URI on this host
+	RedirectHost string
+	// NamePrefix matches the clients whose name starts with this prefix, the clients are then ordered by name
+	NamePrefix string
+}
+
+// ListClients returns a page of clients ordered by their ID along with the cursor of the next page. Unlike GetClients,
+// the cost of fetching a page does not grow with its position. The returned cursor is empty on the last page.
+func (d *DatastoreManager) ListClients(ctx context.Context, opts ListOptions) ([]client.Client, string, error) {
+	return d.FindClients(ctx, ClientFilter{Limit: opts.Limit, Cursor: opts.Cursor, Owner: opts.Owner})
+}
+
+// FindClients returns a page of the clients matching filter along with the cursor of the next page. Clients are ordered
+// by their ID, or by their name when filtering by NamePrefix. The returned cursor is empty on the last page. Clients
+// stored before version 4 of the schema are only matched by GrantType and RedirectHost once migrated, see
+// MigrateClients.
+func (d *DatastoreManager) FindClients(ctx context.Context, filter ClientFilter) ([]client.Client, string, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "FindClients", hydraClientKind)
+	defer span.End()
+
+	if filter.Limit <= 0 {
+		return nil, "", errors.Errorf("expected a positive limit, got %d", filter.Limit)
+	}
+
+	query := d.newClientQuery()
+	if filter.Owner != "" {
+		query = query.Filter("owner =", filter.Owner)
+	}
+	if filter.GrantType != "" {
+		query = query.Filter("gt =", filter.GrantType)
+	}
+	if filter.RedirectHost != "" {
+		query = query.Filter("rhost =", strings.ToLower(filter.RedirectHost))
+	}
+	if filter.NamePrefix != "" {
+		query = query.Filter("cn >=", filter.NamePrefix).Filter("cn <", filter.NamePrefix+"\ufffd").Order("cn")
+	}
+	query = query.Order("__key__")
+
+	if filter.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", errors.WithStack(ErrInvalidCursor)
+		}
+		query = query.Start(cursor)
+	}
+	// Fetch one more client to know if there is a next page
+	query = query.Limit(filter.Limit + 1)
+
+	clients := make([]client.Client, 0, filter.Limit)
+	var next string
+	var more bool
+
+	it := d.client.Run(ctx, query)
+	for {
+		var cd clientData
+		_, err := it.Next(&cd)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, "", dscon.HandleError(err)
+		}
+
+		if len(clients) == filter.Limit {
+			// The cursor was taken after the last client of the page
+			more = true
+			break
+		}
+
+		c, err := cd.toClient()
+		if err != nil {
+			return nil, "", errors.WithStack(err)
+		}
+		clients = append(clients, *c)
+
+		if len(clients) == filter.Limit {
+			cursor, err := it.Cursor()
+			if err != nil {
+				return nil, "", errors.WithStack(err)
+			}
+			next = cursor.String()
+		}
+	}
+
+	if !more {
+		next = ""
+	}
+	dscon.SetEntityCount(span, len(clients))
+	return clients, next, nil
+}
+
+// migrateTxSize is the number of clients migrated per transaction, each client is its own entity group and a
+// transaction is limited to 25.
+const migrateTxSize = 25
+
+// MigrateClients saves every client stored with an older version of the schema with the current one and returns how
+// many were migrated. Clients are otherwise only migrated when they are fetched by their ID. Clients are read and
+// written in transactions so concurrent changes, e.g. a secret rotation, are not overwritten.
+func (d *DatastoreManager) MigrateClients(ctx context.Context) (int, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "MigrateClients", hydraClientKind)
+	defer span.End()
+
+	var migrated int
+	query := d.newClientQuery().KeysOnly()
+
+	keys, err := d.client.GetAll(ctx, query, nil)
+	if err != nil {
+		return 0, dscon.HandleError(err)
+	}
+
+	for _, chunk := range dscon.ChunkKeys(keys, migrateTxSize) {
+		var updated int
+		_, err := dscon.RunInTransaction(ctx, d.client, func(tx *datastore.Transaction) error {
+			updated = 0
+			datas := make([]clientData, len(chunk))
+			var merr datastore.MultiError
+			if err := tx.GetMulti(chunk, datas); err != nil {
+				var ok bool
+				if merr, ok = err.(datastore.MultiError); !ok {
+					return err
+				}
+			}
+
+			var mutations []*datastore.Mutation
+			for idx := range datas {
+				if merr != nil && merr[idx] != nil {
+					// Deleted since the keys were listed
+					if merr[idx] == datastore.ErrNoSuchEntity {
+						continue
+					}
+					return merr[idx]
+				}
+				if datas[idx].update {
+					mutations = append(mutations, datastore.NewUpdate(chunk[idx], &datas[idx]))
+				}
+			}
+			if len(mutations) == 0 {
+				return nil
+			}
+
+			updated = len(mutations)
+			_, err := tx.Mutate(mutations...)
+			return err
+		})
+		if err != nil {
+			return migrated, dscon.HandleError(err)
+		}
+		migrated += updated
+	}
+
+	dscon.SetEntityCount(span, migrated)
+	return migrated, nil
+}
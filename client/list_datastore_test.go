@@ -0,0 +1,236 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/fosite"
+	"github.com/ory/herodot"
+	"github.com/ory/hydra/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func newListTestManager(t *testing.T, namespace string) *DatastoreManager {
+	t.Helper()
+	m, ok := clientManagers["datastore"].(*DatastoreManager)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	ctx := context.Background()
+	lm := NewDatastoreManager(m.client, namespace, &fosite.BCrypt{WorkFactor: 4})
+	for i := 0; i < 5; i++ {
+		owner := "alice"
+		if i%2 == 1 {
+			owner = "bob"
+		}
+		c := &client.Client{
+			ClientID:     fmt.Sprintf("list-client-%d", i),
+			Name:         fmt.Sprintf("%s app %d", owner, i),
+			Secret:       "secret",
+			Owner:        owner,
+			GrantTypes:   []string{"authorization_code"},
+			RedirectURIs: []string{fmt.Sprintf("https://%s.example.com/cb", owner)},
+		}
+		if i < 2 {
+			c.GrantTypes = append(c.GrantTypes, "client_credentials")
+		}
+		if err := lm.CreateClient(ctx, c); err != nil {
+			t.Fatalf("could not create client: %v", err)
+		}
+	}
+	return lm
+}
+
+func cleanupListTestManager(m *DatastoreManager) {
+	for i := 0; i < 5; i++ {
+		m.DeleteClient(context.Background(), fmt.Sprintf("list-client-%d", i))
+	}
+}
+
+func TestListClients(t *testing.T) {
+	ctx := context.Background()
+	m := newListTestManager(t, "client-list-test")
+	defer cleanupListTestManager(m)
+
+	var ids []string
+	var cursor string
+	for page := 0; ; page++ {
+		clients, next, err := m.ListClients(ctx, ListOptions{Limit: 2, Cursor: cursor})
+		if err != nil {
+			t.Fatalf("could not list clients: %v", err)
+		}
+		for _, c := range clients {
+			ids = append(ids, c.ClientID)
+		}
+		if next == "" {
+			if page != 2 {
+				t.Errorf("expected 3 pages, got %d", page+1)
+			}
+			break
+		}
+		cursor = next
+	}
+	if strings.Join(ids, ",") != "list-client-0,list-client-1,list-client-2,list-client-3,list-client-4" {
+		t.Errorf("unexpected clients listed: %v", ids)
+	}
+
+	clients, next, err := m.ListClients(ctx, ListOptions{Limit: 5, Owner: "bob"})
+	if err != nil {
+		t.Fatalf("could not list clients: %v", err)
+	}
+	if len(clients) != 2 || next != "" {
+		t.Errorf("expected the 2 clients of bob on a single page, got %d and cursor %q", len(clients), next)
+	}
+
+	if _, _, err := m.ListClients(ctx, ListOptions{Limit: 2, Cursor: "invalid"}); errors.Cause(err) != ErrInvalidCursor {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestFindClients(t *testing.T) {
+	ctx := context.Background()
+	m := newListTestManager(t, "client-find-test")
+	defer cleanupListTestManager(m)
+
+	tests := []struct {
+		name   string
+		filter ClientFilter
+		want   []string
+	}{
+		{"owner", ClientFilter{Owner: "bob"}, []string{"list-client-1", "list-client-3"}},
+		{"grantType", ClientFilter{GrantType: "client_credentials"}, []string{"list-client-0", "list-client-1"}},
+		{"redirectHost", ClientFilter{RedirectHost: "ALICE.example.com"}, []string{"list-client-0", "list-client-2", "list-client-4"}},
+		{"ownerAndGrantType", ClientFilter{Owner: "alice", GrantType: "client_credentials"}, []string{"list-client-0"}},
+		{"namePrefix", ClientFilter{NamePrefix: "bob app"}, []string{"list-client-1", "list-client-3"}},
+		{"none", ClientFilter{Owner: "carol"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filter.Limit = 10
+			clients, next, err := m.FindClients(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("could not find clients: %v", err)
+			}
+			var ids []string
+			for _, c := range clients {
+				ids = append(ids, c.ClientID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") || next != "" {
+				t.Errorf("FindClients() = %v with cursor %q, want %v", ids, next, tt.want)
+			}
+		})
+	}
+}
+
+func TestListHandler(t *testing.T) {
+	m := newListTestManager(t, "client-list-handler-test")
+	defer cleanupListTestManager(m)
+
+	handler := NewListHandler(m, herodot.NewJSONWriter(logrus.New()))
+	get := func(target string) ([]client.Client, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		handler.List(w, httptest.NewRequest(http.MethodGet, target, nil), nil)
+		var clients []client.Client
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&clients); err != nil {
+				t.Fatalf("could not decode clients: %v", err)
+			}
+		}
+		return clients, w
+	}
+
+	clients, w := get("/clients?limit=3&owner=alice")
+	if len(clients) != 3 || w.Header().Get("Link") != "" {
+		t.Errorf("expected the 3 clients of alice without a next page, got %d and %q", len(clients), w.Header().Get("Link"))
+	}
+	for _, c := range clients {
+		if c.Secret != "" {
+			t.Errorf("expected the secret of %s to be left out", c.ClientID)
+		}
+	}
+
+	if clients, _ = get("/clients?grant_type=client_credentials&redirect_host=bob.example.com"); len(clients) != 1 {
+		t.Errorf("expected 1 client to match the filters, got %d", len(clients))
+	}
+
+	clients, w = get("/clients?limit=4")
+	link := w.Header().Get("Link")
+	if len(clients) != 4 || !strings.HasPrefix(link, "</clients?") || !strings.HasSuffix(link, `>; rel="next"`) {
+		t.Fatalf("expected 4 clients and a next page, got %d and %q", len(clients), link)
+	}
+
+	clients, w = get(strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`))
+	if len(clients) != 1 || clients[0].ClientID != "list-client-4" || w.Header().Get("Link") != "" {
+		t.Errorf("expected the last client on the next page, got %+v", clients)
+	}
+
+	if clients, _ = get("/clients?limit=2&offset=4"); len(clients) != 1 {
+		t.Errorf("expected offset pagination to keep working, got %d clients", len(clients))
+	}
+
+	if _, w = get("/clients?cursor=invalid"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid cursor, got %d", w.Code)
+	}
+}
+
+func TestMigrateClients(t *testing.T) {
+	ctx := context.Background()
+	m := newListTestManager(t, "client-migrate-test")
+	defer cleanupListTestManager(m)
+
+	// A client stored with pipe-joined redirect URIs and grant types by version 3 of the schema
+	key := m.createClientKey("legacy-client")
+	legacy := datastore.PropertyList{
+		{Name: "cn", Value: "legacy"},
+		{Name: "ruris", Value: "https://a.example.com/cb|https://b.example.com/cb", NoIndex: true},
+		{Name: "gt", Value: "authorization_code|refresh_token"},
+		{Name: "v", Value: int64(3)},
+	}
+	if _, err := m.client.Put(ctx, key, &legacy); err != nil {
+		t.Fatalf("could not store the legacy client: %v", err)
+	}
+	defer m.DeleteClient(ctx, "legacy-client")
+
+	migrated, err := m.MigrateClients(ctx)
+	if err != nil {
+		t.Fatalf("could not migrate clients: %v", err)
+	}
+	if migrated != 1 {
+		t.Errorf("expected the legacy client to be migrated, got %d", migrated)
+	}
+
+	var stored clientData
+	if err := m.client.Get(ctx, key, &stored); err != nil {
+		t.Fatalf("could not get the migrated client: %v", err)
+	}
+	if stored.update || len(stored.RedirectURIs) != 2 || len(stored.GrantTypes) != 2 {
+		t.Errorf("expected the client to be stored with the current schema, got %+v", stored)
+	}
+
+	if migrated, err := m.MigrateClients(ctx); err != nil || migrated != 0 {
+		t.Errorf("expected nothing left to migrate, got %d and %v", migrated, err)
+	}
+}
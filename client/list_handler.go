@@ -0,0 +1,112 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ory/herodot"
+	"github.com/ory/hydra/client"
+	"github.com/ory/x/pagination"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 500
+)
+
+// listFilterParams are the query parameters filtering the clients, see ClientFilter
+var listFilterParams = []string{"owner", "grant_type", "redirect_host", "name"}
+
+// ListHandler serves the admin client listing using cursors instead of offsets
+type ListHandler struct {
+	Manager *DatastoreManager
+	H       herodot.Writer
+}
+
+// NewListHandler returns a ListHandler listing the clients of manager
+func NewListHandler(manager *DatastoreManager, h herodot.Writer) *ListHandler {
+	return &ListHandler{Manager: manager, H: h}
+}
+
+// SetRoutes registers the client listing on r, requests to any other route are served by the router's NotFound handler
+func (h *ListHandler) SetRoutes(r *httprouter.Router) {
+	r.GET(client.ClientsHandlerPath, h.List)
+}
+
+// List serves a page of clients. The page is selected with the `limit` and `cursor` query parameters, the clients may be
+// filtered with the `owner`, `grant_type`, `redirect_host` and `name` (prefix) query parameters. The next page is
+// linked in the Link header. Requests using the `offset` query parameter are served as Hydra does.
+func (h *ListHandler) List(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	limit, offset := pagination.Parse(r, defaultListLimit, 0, maxListLimit)
+
+	var clients []client.Client
+	if query.Get("offset") != "" {
+		c, err := h.Manager.GetClients(r.Context(), limit, offset)
+		if err != nil {
+			h.H.WriteError(w, r, err)
+			return
+		}
+		for _, cc := range c {
+			clients = append(clients, cc)
+		}
+	} else {
+		if limit == 0 {
+			limit = defaultListLimit
+		}
+
+		filter := ClientFilter{
+			Limit:        limit,
+			Cursor:       query.Get("cursor"),
+			Owner:        query.Get("owner"),
+			GrantType:    query.Get("grant_type"),
+			RedirectHost: query.Get("redirect_host"),
+			NamePrefix:   query.Get("name"),
+		}
+
+		var next string
+		var err error
+		clients, next, err = h.Manager.FindClients(r.Context(), filter)
+		if err != nil {
+			h.H.WriteError(w, r, err)
+			return
+		}
+
+		if next != "" {
+			nextQuery := url.Values{}
+			for _, param := range listFilterParams {
+				if value := query.Get(param); value != "" {
+					nextQuery.Set(param, value)
+				}
+			}
+			nextQuery.Set("limit", fmt.Sprintf("%d", limit))
+			nextQuery.Set("cursor", next)
+			w.Header().Add("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, client.ClientsHandlerPath, nextQuery.Encode()))
+		}
+	}
+
+	if clients == nil {
+		clients = []client.Client{}
+	}
+	for k := range clients {
+		clients[k].Secret = ""
+	}
+
+	h.H.Write(w, r, clients)
+}
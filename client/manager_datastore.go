@@ -21,13 +21,17 @@ package client
 
 import (
 	"context"
+	"net/url"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/ory/fosite"
+	"github.com/ory/go-convenience/stringslice"
 	"github.com/ory/go-convenience/stringsx"
 	"github.com/ory/hydra/client"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/json"
 
@@ -41,7 +45,10 @@ var (
 
 const (
 	hydraClientKind    = "HydraClient"
-	hydraClientVersion = 3
+	hydraClientVersion = 4
+
+	// ClientKind is the Datastore kind of clients, the kind of the changes reported to OnChange
+	ClientKind = hydraClientKind
 )
 
 type clientData struct {
@@ -49,8 +56,9 @@ type clientData struct {
 	ID                            string         `datastore:"-"`
 	Name                          string         `datastore:"cn"`
 	Secret                        string         `datastore:"cs"`
-	RedirectURIs                  string         `datastore:"ruris"`
-	GrantTypes                    string         `datastore:"gt"`
+	RedirectURIs                  []string       `datastore:"ruris,noindex"`
+	RedirectHosts                 []string       `datastore:"rhost"`
+	GrantTypes                    []string       `datastore:"gt"`
 	ResponseTypes                 string         `datastore:"rt"`
 	Scope                         string         `datastore:"scp"`
 	Owner                         string         `datastore:"owner"`
@@ -69,6 +77,8 @@ type clientData struct {
 	RequestObjectSigningAlgorithm string         `datastore:"rosa"`
 	UserinfoSignedResponseAlg     string         `datastore:"usra"`
 	AllowedCORSOrigins            string         `datastore:"acorso"`
+	SecondarySecret               string         `datastore:"css,noindex"`
+	SecondarySecretExpiresAt      time.Time      `datastore:"cssea,noindex"`
 
 	Version int `datastore:"v"`
 	update  bool
@@ -112,6 +122,12 @@ func (c *clientData) Load(ps []datastore.Property) error {
 			c.TokenEndpointAuthMethod = "none"
 		}
 		fallthrough
+	case 3:
+		// Pipe-joined strings are stored as multi-valued properties from version 4 on so they can be queried
+		c.RedirectURIs = splitLegacy(c.RedirectURIs)
+		c.GrantTypes = splitLegacy(c.GrantTypes)
+		c.RedirectHosts = redirectHosts(c.RedirectURIs)
+		fallthrough
 	case -1:
 		// This is here to complete saving the entity should we need to udpate it
 		if c.Version == -1 {
@@ -137,6 +153,11 @@ type DatastoreManager struct {
 	client    *datastore.Client
 	context   context.Context
 	namespace string
+	tracer    dscon.Tracer
+	// L logs the failures that do not fail the operation, e.g. an upgrade of a stale secret hash
+	L logrus.FieldLogger
+	// onChange are called with the ID of every client created, changed or deleted
+	onChange []func(ctx context.Context, id string)
 }
 
 // NewDatastoreManager initializes a new DatastoreManager with the given client
@@ -145,9 +166,48 @@ func NewDatastoreManager(client *datastore.Client, namespace string, h fosite.Ha
 		hasher:    h,
 		client:    client,
 		namespace: namespace,
+		tracer:    dscon.NewTracer("client", namespace),
+		L:         logrus.New(),
+	}
+}
+
+// EnableTracing starts a span for every operation of the manager from now on
+func (d *DatastoreManager) EnableTracing() {
+	d.tracer.Enabled = true
+}
+
+// OnChange registers f to be called with the ID of every client created, changed or deleted through the manager,
+// including secret rotations and rehashes. It must be called before the manager is used.
+func (d *DatastoreManager) OnChange(f func(ctx context.Context, id string)) {
+	d.onChange = append(d.onChange, f)
+}
+
+func (d *DatastoreManager) changed(ctx context.Context, id string) {
+	for _, f := range d.onChange {
+		f(ctx, id)
 	}
 }
 
+// splitLegacy splits the pipe-joined string a multi-valued property was stored as before version 4
+func splitLegacy(values []string) []string {
+	return stringsx.Splitx(strings.Join(values, "|"), "|")
+}
+
+// redirectHosts returns the distinct hosts of the given redirect URIs, lower cased
+func redirectHosts(uris []string) []string {
+	hosts := []string{}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		if host := strings.ToLower(u.Hostname()); !stringslice.Has(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
 func (d *DatastoreManager) createClientKey(id string) *datastore.Key {
 	key := datastore.NameKey(hydraClientKind, id, nil)
 	key.Namespace = d.namespace
@@ -172,8 +232,9 @@ func clientDataFromClient(d *client.Client) (*clientData, error) {
 		ID:                            d.GetID(),
 		Name:                          d.Name,
 		Secret:                        d.Secret,
-		RedirectURIs:                  strings.Join(d.RedirectURIs, "|"),
-		GrantTypes:                    strings.Join(d.GrantTypes, "|"),
+		RedirectURIs:                  d.RedirectURIs,
+		RedirectHosts:                 redirectHosts(d.RedirectURIs),
+		GrantTypes:                    d.GrantTypes,
 		ResponseTypes:                 strings.Join(d.ResponseTypes, "|"),
 		Scope:                         d.Scope,
 		Owner:                         d.Owner,
@@ -200,8 +261,8 @@ func (c *clientData) toClient() (*client.Client, error) {
 		ClientID:                      c.ID,
 		Name:                          c.Name,
 		Secret:                        c.Secret,
-		RedirectURIs:                  stringsx.Splitx(c.RedirectURIs, "|"),
-		GrantTypes:                    stringsx.Splitx(c.GrantTypes, "|"),
+		RedirectURIs:                  append([]string{}, c.RedirectURIs...),
+		GrantTypes:                    append([]string{}, c.GrantTypes...),
 		ResponseTypes:                 stringsx.Splitx(c.ResponseTypes, "|"),
 		Scope:                         c.Scope,
 		Owner:                         c.Owner,
@@ -231,7 +292,7 @@ func (c *clientData) toClient() (*client.Client, error) {
 	return cli, nil
 }
 
-func (d *DatastoreManager) GetConcreteClient(ctx context.Context, id string) (*client.Client, error) {
+func (d *DatastoreManager) getClientData(ctx context.Context, id string) (*clientData, error) {
 	var cd clientData
 	key := d.createClientKey(id)
 
@@ -247,57 +308,98 @@ func (d *DatastoreManager) GetConcreteClient(ctx context.Context, id string) (*c
 		cd.update = false
 	}
 
+	return &cd, nil
+}
+
+func (d *DatastoreManager) GetConcreteClient(ctx context.Context, id string) (*client.Client, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "GetConcreteClient", hydraClientKind)
+	defer span.End()
+
+	cd, err := d.getClientData(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
 	return cd.toClient()
 }
 
 func (d *DatastoreManager) GetClient(ctx context.Context, id string) (fosite.Client, error) {
-	return d.GetConcreteClient(ctx, id)
-}
+	ctx, span := d.tracer.StartSpan(ctx, "GetClient", hydraClientKind)
+	defer span.End()
 
-func (d *DatastoreManager) UpdateClient(ctx context.Context, c *client.Client) error {
-	o, err := d.GetConcreteClient(ctx, c.GetID())
+	cd, err := d.getClientData(ctx, id)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, err
 	}
 
-	if c.Secret == "" {
-		c.Secret = string(o.GetHashedSecret())
-	} else {
+	return cd.toClient()
+}
+
+func (d *DatastoreManager) UpdateClient(ctx context.Context, c *client.Client) error {
+	ctx, span := d.tracer.StartSpan(ctx, "UpdateClient", hydraClientKind)
+	defer span.End()
+
+	var hashed string
+	if c.Secret != "" {
 		h, err := d.hasher.Hash(ctx, []byte(c.Secret))
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		c.Secret = string(h)
+		hashed = string(h)
 	}
 
-	s, err := clientDataFromClient(c)
-	if err != nil {
-		return errors.WithStack(err)
-	}
+	key := d.createClientKey(c.GetID())
+	// The client is read and written in a transaction so a concurrent secret rotation is not overwritten
+	_, err := dscon.RunInTransaction(ctx, d.client, func(tx *datastore.Transaction) error {
+		var o clientData
+		if err := tx.Get(key, &o); err != nil {
+			return err
+		}
 
-	key := d.createClientKey(s.ID)
-	mutation := datastore.NewUpdate(key, s)
+		c.Secret = hashed
+		if c.Secret == "" {
+			c.Secret = o.Secret
+		}
 
-	if _, err := d.client.Mutate(ctx, mutation); err != nil {
+		s, err := clientDataFromClient(c)
+		if err != nil {
+			return err
+		}
+		// A secret rotation in progress is kept
+		s.SecondarySecret, s.SecondarySecretExpiresAt = o.SecondarySecret, o.SecondarySecretExpiresAt
+
+		_, err = tx.Mutate(datastore.NewUpdate(key, s))
+		return err
+	})
+	if err != nil {
 		return dscon.HandleError(err)
 	}
+	d.changed(ctx, c.GetID())
 	return nil
 }
 
+// Authenticate will accept either the primary secret of the client unless it expired, or while a rotation is in
+// progress, its secondary secret until it expires.
 func (d *DatastoreManager) Authenticate(ctx context.Context, id string, secret []byte) (*client.Client, error) {
-	c, err := d.GetConcreteClient(ctx, id)
+	ctx, span := d.tracer.StartSpan(ctx, "Authenticate", hydraClientKind)
+	defer span.End()
+
+	cd, err := d.getClientData(ctx, id)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	if err := d.hasher.Compare(ctx, c.GetHashedSecret(), secret); err != nil {
-		return nil, errors.WithStack(err)
+	if err := d.compareSecrets(ctx, cd, secret); err != nil {
+		return nil, err
 	}
 
-	return c, nil
+	return cd.toClient()
 }
 
 func (d *DatastoreManager) CreateClient(ctx context.Context, c *client.Client) error {
+	ctx, span := d.tracer.StartSpan(ctx, "CreateClient", hydraClientKind)
+	defer span.End()
+
 	h, err := d.hasher.Hash(ctx, []byte(c.Secret))
 	if err != nil {
 		return errors.WithStack(err)
@@ -314,19 +416,39 @@ func (d *DatastoreManager) CreateClient(ctx context.Context, c *client.Client) e
 	if _, err := d.client.Mutate(ctx, mutation); err != nil {
 		return dscon.HandleError(err)
 	}
+	d.changed(ctx, data.ID)
 	return nil
 }
 
 func (d *DatastoreManager) DeleteClient(ctx context.Context, id string) error {
+	ctx, span := d.tracer.StartSpan(ctx, "DeleteClient", hydraClientKind)
+	defer span.End()
+
 	key := d.createClientKey(id)
 	if err := d.client.Delete(ctx, key); err != nil {
 		return dscon.HandleError(err)
 	}
+	d.changed(ctx, id)
+
+	// Remove the secret rotation events recorded for the client
+	query := datastore.NewQuery(hydraClientSecretEventKind).Namespace(d.namespace).Ancestor(key).KeysOnly()
+	keys, err := d.client.GetAll(ctx, query, nil)
+	if err != nil {
+		return dscon.HandleError(err)
+	}
+	for _, chunk := range dscon.ChunkKeys(keys, dscon.MaxBatchSize) {
+		if err := d.client.DeleteMulti(ctx, chunk); err != nil {
+			return dscon.HandleError(err)
+		}
+	}
 	return nil
 }
 
 // This follows the implementation from the master branch
 func (d *DatastoreManager) GetClients(ctx context.Context, limit, offset int) (map[string]client.Client, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "GetClients", hydraClientKind)
+	defer span.End()
+
 	datas := make([]clientData, 0)
 	clients := make(map[string]client.Client)
 
@@ -346,5 +468,6 @@ func (d *DatastoreManager) GetClients(ctx context.Context, limit, offset int) (m
 
 		clients[k.ID] = *c
 	}
+	dscon.SetEntityCount(span, len(clients))
 	return clients, nil
 }
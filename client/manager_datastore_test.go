@@ -16,6 +16,7 @@ package client
 
 import (
 	"context"
+	"reflect"
 	"testing"
 
 	"github.com/ory/hydra/client"
@@ -64,3 +65,59 @@ func TestClientDataLoad(t *testing.T) {
 		t.Error("could not get datastore connection")
 	}
 }
+
+type mockClientDataV3 struct {
+	Name         string `datastore:"cn"`
+	RedirectURIs string `datastore:"ruris"`
+	GrantTypes   string `datastore:"gt"`
+	Version      int    `datastore:"v"`
+}
+
+func TestClientDataLoadMultiValued(t *testing.T) {
+	t.Parallel()
+	if m, ok := clientManagers["datastore"].(*DatastoreManager); ok {
+		key := m.createClientKey("client-upgrade-v3-test")
+		mock := mockClientDataV3{
+			Name:         "upgrade",
+			RedirectURIs: "https://a.example.com/cb|https://A.example.com/other|com.example.app:/cb",
+			GrantTypes:   "authorization_code|refresh_token",
+			Version:      3,
+		}
+		if _, err := m.client.Put(context.Background(), key, &mock); err != nil {
+			t.Errorf("could not store dummy data - %v", err)
+			return
+		}
+		defer m.client.Delete(context.Background(), key)
+
+		if c, err := m.GetConcreteClient(context.Background(), key.Name); err != nil {
+			t.Errorf("error getting data - %v", err)
+			return
+		} else if len(c.RedirectURIs) != 3 || len(c.GrantTypes) != 2 {
+			t.Errorf("client data was not upgraded succesfully: %+v", c)
+			return
+		}
+
+		var d clientData
+		if err := m.client.Get(context.Background(), key, &d); err != nil {
+			t.Errorf("cloud not get client data - %v", err)
+		} else if d.Version != hydraClientVersion || len(d.RedirectHosts) != 1 || d.RedirectHosts[0] != "a.example.com" {
+			t.Errorf("data not upgraded correctly: %+v", d)
+		}
+	} else {
+		t.Error("could not get datastore connection")
+	}
+}
+
+func TestRedirectHosts(t *testing.T) {
+	got := redirectHosts([]string{"https://a.example.com/cb", "https://A.example.com:8443/cb", "com.example.app:/cb", "http://b.example.com", "%"})
+	if want := []string{"a.example.com", "b.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("redirectHosts() = %v, want %v", got, want)
+	}
+
+	if got := splitLegacy([]string{"a|b"}); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("splitLegacy() = %v", got)
+	}
+	if got := splitLegacy([]string{""}); len(got) != 0 {
+		t.Errorf("splitLegacy() = %v, want no values", got)
+	}
+}
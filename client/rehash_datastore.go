@@ -0,0 +1,84 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/fosite"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/someone1/hydra-gcp/dscon"
+)
+
+// RehashChecker is implemented by hashers able to tell whether a hash was made with other parameters or another
+// algorithm than the ones they currently hash with.
+type RehashChecker interface {
+	NeedsRehash(hash []byte) bool
+}
+
+// NeedsRehash reports whether hash should be replaced with a new hash made by hasher. Hashers implementing
+// RehashChecker decide for themselves, a fosite.BCrypt hasher wants bcrypt hashes of its work factor and other hashers
+// never ask for a rehash.
+func NeedsRehash(hasher fosite.Hasher, hash []byte) bool {
+	switch h := hasher.(type) {
+	case RehashChecker:
+		return h.NeedsRehash(hash)
+	case *fosite.BCrypt:
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost != h.WorkFactor
+	}
+	return false
+}
+
+// rehashSecret replaces the stale hash of a secret that was just compared successfully. The client is only updated
+// if it still holds hash, so a concurrent upgrade or secret change is never overwritten.
+func (d *DatastoreManager) rehashSecret(ctx context.Context, id string, secondary bool, hash string, secret []byte) error {
+	h, err := d.hasher.Hash(ctx, secret)
+	if err != nil {
+		return err
+	}
+
+	key := d.createClientKey(id)
+	var updated bool
+	_, err = dscon.RunInTransaction(ctx, d.client, func(tx *datastore.Transaction) error {
+		updated = false
+		var cd clientData
+		if err := tx.Get(key, &cd); err != nil {
+			return err
+		}
+
+		current := &cd.Secret
+		if secondary {
+			current = &cd.SecondarySecret
+		}
+		if *current != hash {
+			return nil
+		}
+		*current = string(h)
+
+		_, err := tx.Put(key, &cd)
+		updated = err == nil
+		return err
+	})
+	if err != nil {
+		return dscon.HandleError(err)
+	}
+	if updated {
+		d.changed(ctx, id)
+	}
+	return nil
+}
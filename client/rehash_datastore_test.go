@@ -0,0 +1,150 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type plaintextHasher struct{}
+
+func (plaintextHasher) Hash(_ context.Context, data []byte) ([]byte, error) { return data, nil }
+func (plaintextHasher) Compare(_ context.Context, hash, data []byte) error {
+	if string(hash) != string(data) {
+		return fosite.ErrNotFound
+	}
+	return nil
+}
+
+// failingHasher compares like a plaintextHasher but cannot hash, and always asks for a rehash
+type failingHasher struct {
+	plaintextHasher
+}
+
+func (failingHasher) Hash(_ context.Context, _ []byte) ([]byte, error) {
+	return nil, errors.New("hasher unavailable")
+}
+func (failingHasher) NeedsRehash(_ []byte) bool { return true }
+
+func TestUpgradeSecretFailure(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	m := &DatastoreManager{hasher: failingHasher{}, client: &datastore.Client{}, L: logger}
+
+	// The client still authenticates, the failed upgrade is logged
+	if err := m.compareSecrets(context.Background(), &clientData{ID: "client-1", Secret: "secret"}, []byte("secret")); err != nil {
+		t.Fatalf("expected the client to authenticate, got %v", err)
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil || entry.Level != logrus.WarnLevel {
+		t.Fatalf("expected a warning to be logged, got %+v", entry)
+	}
+	if entry.Data["client_id"] != "client-1" || entry.Data[logrus.ErrorKey] == nil {
+		t.Errorf("expected the client ID and the error to be logged, got %v", entry.Data)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), 4)
+	if err != nil {
+		t.Fatalf("could not hash secret: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		hasher fosite.Hasher
+		hash   []byte
+		want   bool
+	}{
+		{"sameCost", &fosite.BCrypt{WorkFactor: 4}, hash, false},
+		{"otherCost", &fosite.BCrypt{WorkFactor: 5}, hash, true},
+		{"otherAlgorithm", &fosite.BCrypt{WorkFactor: 4}, []byte("$argon2id$v=19$m=65536,t=1,p=2$c2FsdA$aGFzaA"), true},
+		{"unknownHasher", plaintextHasher{}, hash, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NeedsRehash(tt.hasher, tt.hash); got != tt.want {
+				t.Errorf("NeedsRehash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretRehash(t *testing.T) {
+	m, ok := clientManagers["datastore"].(*DatastoreManager)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	ctx := context.Background()
+	id := "client-rehash-test"
+	old := NewDatastoreManager(m.client, "client-rehash-test", &fosite.BCrypt{WorkFactor: 4})
+	if err := old.CreateClient(ctx, &client.Client{ClientID: id, Secret: "secret"}); err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	defer old.DeleteClient(ctx, id)
+
+	cost := func() int {
+		cd, err := old.getClientData(ctx, id)
+		if err != nil {
+			t.Fatalf("could not get client: %v", err)
+		}
+		c, err := bcrypt.Cost([]byte(cd.Secret))
+		if err != nil {
+			t.Fatalf("could not read cost: %v", err)
+		}
+		return c
+	}
+
+	upgraded := NewDatastoreManager(m.client, "client-rehash-test", &fosite.BCrypt{WorkFactor: 5})
+	if _, err := upgraded.Authenticate(ctx, id, []byte("wrong")); err == nil {
+		t.Fatalf("expected a wrong secret to be rejected")
+	}
+	if got := cost(); got != 4 {
+		t.Errorf("expected a failed authentication to keep the hash, got cost %d", got)
+	}
+
+	if _, err := upgraded.Authenticate(ctx, id, []byte("secret")); err != nil {
+		t.Fatalf("could not authenticate: %v", err)
+	}
+	if got := cost(); got != 5 {
+		t.Errorf("expected the hash to be upgraded to cost 5, got %d", got)
+	}
+	if _, err := upgraded.Authenticate(ctx, id, []byte("secret")); err != nil {
+		t.Errorf("expected the upgraded hash to authenticate, got %v", err)
+	}
+
+	// A stale compare must not overwrite a secret changed in the meantime
+	cd, err := upgraded.getClientData(ctx, id)
+	if err != nil {
+		t.Fatalf("could not get client: %v", err)
+	}
+	if err := upgraded.rehashSecret(ctx, id, false, "outdated", []byte("other")); err != nil {
+		t.Fatalf("could not rehash secret: %v", err)
+	}
+	if current, _ := upgraded.getClientData(ctx, id); current.Secret != cd.Secret {
+		t.Errorf("expected the conditional update to leave the changed secret alone")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/herodot"
+	"github.com/pkg/errors"
+
+	"github.com/someone1/hydra-gcp/dscon"
+)
+
+const (
+	hydraClientSecretEventKind = "HydraClientSecretEvent"
+
+	// SecretRotationStarted is recorded when a secondary secret is added to a client
+	SecretRotationStarted = "rotation_started"
+	// SecretPromoted is recorded when the secondary secret of a client becomes its primary secret
+	SecretPromoted = "secret_promoted"
+	// SecretRetired is recorded when the secondary secret of a client is removed
+	SecretRetired = "secret_retired"
+)
+
+// ErrNoSecondarySecret is returned when promoting or retiring the secondary secret of a client without one
+var ErrNoSecondarySecret = &herodot.DefaultError{
+	StatusField: http.StatusText(http.StatusConflict),
+	ErrorField:  "The client has no secondary secret",
+	CodeField:   http.StatusConflict,
+}
+
+// SecretEvent records a step of a client secret rotation
+type SecretEvent struct {
+	Type string    `datastore:"t" json:"type"`
+	Time time.Time `datastore:"at" json:"time"`
+	// SecondaryExpiresAt is when the secondary secret expires after this event, zero if it does not
+	SecondaryExpiresAt time.Time `datastore:"exp,noindex" json:"secondary_expires_at,omitempty"`
+}
+
+// StartSecretRotation adds secret as the secondary secret of the client, it is accepted alongside the primary secret
+// until expiresAt, or until it is promoted or retired if expiresAt is zero.
+func (d *DatastoreManager) StartSecretRotation(ctx context.Context, id string, secret []byte, expiresAt time.Time) error {
+	ctx, span := d.tracer.StartSpan(ctx, "StartSecretRotation", hydraClientKind)
+	defer span.End()
+
+	h, err := d.hasher.Hash(ctx, secret)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return d.updateSecrets(ctx, id, SecretRotationStarted, func(cd *clientData) error {
+		cd.SecondarySecret, cd.SecondarySecretExpiresAt = string(h), expiresAt
+		return nil
+	})
+}
+
+// PromoteSecret makes the secondary secret of the client its primary secret. The previous primary secret becomes the
+// secondary secret and is accepted until expiresAt, or until it is retired if expiresAt is zero, but never past its
+// own SecretExpiresAt. The promoted secret does not expire until a SecretExpiresAt is set with UpdateClient.
+func (d *DatastoreManager) PromoteSecret(ctx context.Context, id string, expiresAt time.Time) error {
+	ctx, span := d.tracer.StartSpan(ctx, "PromoteSecret", hydraClientKind)
+	defer span.End()
+
+	return d.updateSecrets(ctx, id, SecretPromoted, func(cd *clientData) error {
+		if !cd.secondaryValid(time.Now()) {
+			return errors.WithStack(ErrNoSecondarySecret)
+		}
+		cd.promote(expiresAt)
+		return nil
+	})
+}
+
+// promote swaps the primary and secondary secrets, the expiry of the primary secret moves with it so the demoted secret
+// is accepted until expiresAt or its own expiry, whichever comes first.
+func (c *clientData) promote(expiresAt time.Time) {
+	if c.SecretExpiresAt > 0 {
+		if primary := time.Unix(int64(c.SecretExpiresAt), 0).UTC(); expiresAt.IsZero() || primary.Before(expiresAt) {
+			expiresAt = primary
+		}
+	}
+	c.Secret, c.SecondarySecret = c.SecondarySecret, c.Secret
+	c.SecretExpiresAt, c.SecondarySecretExpiresAt = 0, expiresAt
+}
+
+// RetireSecret removes the secondary secret of the client
+func (d *DatastoreManager) RetireSecret(ctx context.Context, id string) error {
+	ctx, span := d.tracer.StartSpan(ctx, "RetireSecret", hydraClientKind)
+	defer span.End()
+
+	return d.updateSecrets(ctx, id, SecretRetired, func(cd *clientData) error {
+		if cd.SecondarySecret == "" {
+			return errors.WithStack(ErrNoSecondarySecret)
+		}
+		cd.SecondarySecret, cd.SecondarySecretExpiresAt = "", time.Time{}
+		return nil
+	})
+}
+
+// updateSecrets applies update to the client and records the event in a single transaction
+func (d *DatastoreManager) updateSecrets(ctx context.Context, id, event string, update func(cd *clientData) error) error {
+	key := d.createClientKey(id)
+	_, err := dscon.RunInTransaction(ctx, d.client, func(tx *datastore.Transaction) error {
+		var cd clientData
+		if err := tx.Get(key, &cd); err != nil {
+			return err
+		}
+
+		if err := update(&cd); err != nil {
+			return err
+		}
+
+		eventKey := datastore.IncompleteKey(hydraClientSecretEventKind, key)
+		eventKey.Namespace = d.namespace
+		record := &SecretEvent{Type: event, Time: time.Now().UTC(), SecondaryExpiresAt: cd.SecondarySecretExpiresAt}
+
+		_, err := tx.Mutate(datastore.NewUpdate(key, &cd), datastore.NewInsert(eventKey, record))
+		return err
+	})
+	if cause := errors.Cause(err); cause == ErrNoSecondarySecret {
+		return err
+	}
+	if err != nil {
+		return dscon.HandleError(err)
+	}
+	d.changed(ctx, id)
+	return nil
+}
+
+// SecretEvents returns the secret rotation events recorded for the client, oldest first
+func (d *DatastoreManager) SecretEvents(ctx context.Context, id string) ([]SecretEvent, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "SecretEvents", hydraClientSecretEventKind)
+	defer span.End()
+
+	query := datastore.NewQuery(hydraClientSecretEventKind).Namespace(d.namespace).Ancestor(d.createClientKey(id))
+
+	events := make([]SecretEvent, 0)
+	if _, err := d.client.GetAll(ctx, query, &events); err != nil {
+		return nil, dscon.HandleError(err)
+	}
+
+	// Sorted here rather than in the query to avoid requiring a composite index
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	dscon.SetEntityCount(span, len(events))
+	return events, nil
+}
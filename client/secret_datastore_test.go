@@ -0,0 +1,185 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ory/hydra/client"
+	"github.com/pkg/errors"
+)
+
+func TestSecondarySecretValid(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		data clientData
+		want bool
+	}{
+		{"none", clientData{}, false},
+		{"noExpiry", clientData{SecondarySecret: "hash"}, true},
+		{"notExpired", clientData{SecondarySecret: "hash", SecondarySecretExpiresAt: now.Add(time.Minute)}, true},
+		{"expired", clientData{SecondarySecret: "hash", SecondarySecretExpiresAt: now.Add(-time.Minute)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.data.secondaryValid(now); got != tt.want {
+				t.Errorf("secondaryValid() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromoteSecretExpiry(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name          string
+		expiresAt     int
+		promoteUntil  time.Time
+		wantSecondary time.Time
+	}{
+		{"noExpiry", 0, time.Time{}, time.Time{}},
+		{"promoteExpiry", 0, now.Add(time.Hour), now.Add(time.Hour)},
+		{"primaryExpiry", int(now.Add(time.Hour).Unix()), time.Time{}, now.Add(time.Hour)},
+		{"primaryExpiresFirst", int(now.Add(time.Hour).Unix()), now.Add(2 * time.Hour), now.Add(time.Hour)},
+		{"promoteExpiresFirst", int(now.Add(2 * time.Hour).Unix()), now.Add(time.Hour), now.Add(time.Hour)},
+		{"primaryExpired", int(now.Add(-time.Hour).Unix()), time.Time{}, now.Add(-time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cd := &clientData{Secret: "old", SecretExpiresAt: tt.expiresAt, SecondarySecret: "new"}
+			cd.promote(tt.promoteUntil)
+			if cd.Secret != "new" || cd.SecondarySecret != "old" {
+				t.Errorf("expected the secrets to be swapped, got %q and %q", cd.Secret, cd.SecondarySecret)
+			}
+			if cd.SecretExpiresAt != 0 || cd.primaryExpired(now) {
+				t.Errorf("expected the promoted secret not to expire, got %d", cd.SecretExpiresAt)
+			}
+			if !cd.SecondarySecretExpiresAt.Equal(tt.wantSecondary) {
+				t.Errorf("expected the demoted secret to expire at %v, got %v", tt.wantSecondary, cd.SecondarySecretExpiresAt)
+			}
+		})
+	}
+}
+
+func TestSecretRotation(t *testing.T) {
+	m, ok := clientManagers["datastore"].(*DatastoreManager)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	ctx := context.Background()
+	id := "client-secret-rotation-test"
+	grantTypes := []string{"client_credentials"}
+	if err := m.CreateClient(ctx, &client.Client{ClientID: id, Secret: "old-secret", GrantTypes: grantTypes}); err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	defer m.DeleteClient(ctx, id)
+
+	// Secrets must be accepted by the token endpoint as well as by Authenticate
+	provider := newTestProvider(m)
+	authenticates := func(secret string) bool {
+		_, err := m.Authenticate(ctx, id, []byte(secret))
+		code := requestToken(t, provider, id, secret)
+		if (err == nil) != (code == http.StatusOK) {
+			t.Errorf("expected Authenticate and the token endpoint to agree on %s, got %v and status %d", secret, err, code)
+		}
+		return err == nil
+	}
+
+	if err := m.PromoteSecret(ctx, id, time.Time{}); errors.Cause(err) != ErrNoSecondarySecret {
+		t.Errorf("expected ErrNoSecondarySecret, got %v", err)
+	}
+
+	if err := m.StartSecretRotation(ctx, id, []byte("new-secret"), time.Time{}); err != nil {
+		t.Fatalf("could not start rotation: %v", err)
+	}
+	if !authenticates("old-secret") || !authenticates("new-secret") {
+		t.Errorf("expected both secrets to authenticate during the rotation")
+	}
+
+	// Updating the client must not end the rotation
+	if err := m.UpdateClient(ctx, &client.Client{ClientID: id, Name: "rotated", GrantTypes: grantTypes}); err != nil {
+		t.Fatalf("could not update client: %v", err)
+	}
+	if !authenticates("new-secret") {
+		t.Errorf("expected the secondary secret to survive a client update")
+	}
+
+	if err := m.PromoteSecret(ctx, id, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("could not promote secret: %v", err)
+	}
+	if c, err := m.Authenticate(ctx, id, []byte("new-secret")); err != nil || c.Name != "rotated" {
+		t.Errorf("expected the promoted secret to authenticate, got %v", err)
+	}
+	if !authenticates("old-secret") {
+		t.Errorf("expected the previous secret to authenticate until it expires")
+	}
+
+	if err := m.RetireSecret(ctx, id); err != nil {
+		t.Fatalf("could not retire secret: %v", err)
+	}
+	if authenticates("old-secret") || !authenticates("new-secret") {
+		t.Errorf("expected only the promoted secret to authenticate once the previous one is retired")
+	}
+
+	if err := m.StartSecretRotation(ctx, id, []byte("expired-secret"), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("could not start rotation: %v", err)
+	}
+	if authenticates("expired-secret") {
+		t.Errorf("expected an expired secondary secret to be rejected")
+	}
+
+	// The expiry of a secret follows it when it is promoted
+	if err := m.UpdateClient(ctx, &client.Client{ClientID: id, Name: "rotated", GrantTypes: grantTypes, SecretExpiresAt: int(time.Now().Add(-time.Minute).Unix())}); err != nil {
+		t.Fatalf("could not update client: %v", err)
+	}
+	if err := m.StartSecretRotation(ctx, id, []byte("newer-secret"), time.Time{}); err != nil {
+		t.Fatalf("could not start rotation: %v", err)
+	}
+	if err := m.PromoteSecret(ctx, id, time.Time{}); err != nil {
+		t.Fatalf("could not promote secret: %v", err)
+	}
+	if !authenticates("newer-secret") {
+		t.Errorf("expected the promoted secret not to inherit the expiry of the previous one")
+	}
+	if authenticates("new-secret") {
+		t.Errorf("expected an expired secret to be rejected as the secondary secret")
+	}
+
+	events, err := m.SecretEvents(ctx, id)
+	if err != nil {
+		t.Fatalf("could not get events: %v", err)
+	}
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	want := []string{SecretRotationStarted, SecretPromoted, SecretRetired, SecretRotationStarted, SecretRotationStarted, SecretPromoted}
+	if len(types) != len(want) {
+		t.Fatalf("expected events %v, got %v", want, types)
+	}
+	for idx := range want {
+		if types[idx] != want[idx] {
+			t.Errorf("expected events %v, got %v", want, types)
+			break
+		}
+	}
+}
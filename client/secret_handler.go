@@ -0,0 +1,150 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ory/herodot"
+	"github.com/ory/hydra/client"
+	"github.com/ory/x/randx"
+	"github.com/pkg/errors"
+)
+
+// secretRunes are the runes generated secrets are made of, the same Hydra uses
+var secretRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890_-.~")
+
+// SecretHandler serves the admin API rotating client secrets
+type SecretHandler struct {
+	Manager *DatastoreManager
+	H       herodot.Writer
+}
+
+// NewSecretHandler returns a SecretHandler rotating the secrets of the clients of manager
+func NewSecretHandler(manager *DatastoreManager, h herodot.Writer) *SecretHandler {
+	return &SecretHandler{Manager: manager, H: h}
+}
+
+// SetRoutes registers the secret rotation routes on r
+func (h *SecretHandler) SetRoutes(r *httprouter.Router) {
+	r.POST(client.ClientsHandlerPath+"/:id/secret/rotate", h.Rotate)
+	r.POST(client.ClientsHandlerPath+"/:id/secret/promote", h.Promote)
+	r.DELETE(client.ClientsHandlerPath+"/:id/secret/secondary", h.Retire)
+	r.GET(client.ClientsHandlerPath+"/:id/secret/events", h.Events)
+}
+
+// secretRotationRequest is the body of the rotate and promote requests
+type secretRotationRequest struct {
+	// Secret is the new secret when starting a rotation, one is generated if empty
+	Secret string `json:"client_secret"`
+	// ExpiresIn is the number of seconds the secondary secret is accepted for, it does not expire if zero
+	ExpiresIn int `json:"expires_in"`
+}
+
+// secretRotationResponse is returned when starting a rotation
+type secretRotationResponse struct {
+	ClientID  string    `json:"client_id"`
+	Secret    string    `json:"client_secret"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+func (h *SecretHandler) decodeRequest(r *http.Request) (*secretRotationRequest, time.Time, error) {
+	var req secretRotationRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, time.Time{}, errors.WithStack(&herodot.DefaultError{
+				StatusField: http.StatusText(http.StatusBadRequest),
+				ErrorField:  "The request body could not be decoded",
+				ReasonField: err.Error(),
+				CodeField:   http.StatusBadRequest,
+			})
+		}
+	}
+
+	var expiresAt time.Time
+	if req.ExpiresIn > 0 {
+		expiresAt = time.Now().UTC().Add(time.Duration(req.ExpiresIn) * time.Second)
+	}
+	return &req, expiresAt, nil
+}
+
+// Rotate adds a secondary secret to the client, generating one unless given, and returns it
+func (h *SecretHandler) Rotate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	req, expiresAt, err := h.decodeRequest(r)
+	if err != nil {
+		h.H.WriteError(w, r, err)
+		return
+	}
+
+	if req.Secret == "" {
+		secret, err := randx.RuneSequence(12, secretRunes)
+		if err != nil {
+			h.H.WriteError(w, r, errors.WithStack(err))
+			return
+		}
+		req.Secret = string(secret)
+	}
+
+	if err := h.Manager.StartSecretRotation(r.Context(), ps.ByName("id"), []byte(req.Secret), expiresAt); err != nil {
+		h.H.WriteError(w, r, err)
+		return
+	}
+
+	h.H.WriteCreated(w, r, client.ClientsHandlerPath+"/"+ps.ByName("id"), &secretRotationResponse{
+		ClientID:  ps.ByName("id"),
+		Secret:    req.Secret,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// Promote makes the secondary secret of the client its primary secret, the previous one is accepted until expires_in
+func (h *SecretHandler) Promote(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	_, expiresAt, err := h.decodeRequest(r)
+	if err != nil {
+		h.H.WriteError(w, r, err)
+		return
+	}
+
+	if err := h.Manager.PromoteSecret(r.Context(), ps.ByName("id"), expiresAt); err != nil {
+		h.H.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Retire removes the secondary secret of the client
+func (h *SecretHandler) Retire(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := h.Manager.RetireSecret(r.Context(), ps.ByName("id")); err != nil {
+		h.H.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Events lists the secret rotation events of the client
+func (h *SecretHandler) Events(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	events, err := h.Manager.SecretEvents(r.Context(), ps.ByName("id"))
+	if err != nil {
+		h.H.WriteError(w, r, err)
+		return
+	}
+
+	h.H.Write(w, r, events)
+}
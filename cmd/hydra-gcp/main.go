@@ -0,0 +1,87 @@
+// Command hydra-gcp runs maintenance tasks against the Datastore backend of hydra-gcp.
+//
+// Usage:
+//
+//	OLD_SYSTEM_SECRET=old-secret... NEW_SYSTEM_SECRET=new-secret... hydra-gcp migrate secret datastore://<projectid>?namespace=
+//
+// migrate secret encrypts every JSON Web Key again with the new system secret, as `hydra migrate secret` does for SQL
+// databases. It may be run again after an error, it resumes after the last key set rotated. The database URL is read
+// from the DATABASE_URL environment variable with -e.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ory/hydra/jwk"
+	"github.com/ory/hydra/pkg"
+	"github.com/sirupsen/logrus"
+
+	dconfig "github.com/someone1/hydra-gcp/config"
+	djwk "github.com/someone1/hydra-gcp/jwk"
+)
+
+const usage = `Usage: hydra-gcp migrate secret [-e] <database-url>
+
+Rotates the system secret the JSON Web Keys stored in Datastore are encrypted with. The secrets are read from the
+OLD_SYSTEM_SECRET and NEW_SYSTEM_SECRET environment variables.
+
+`
+
+func main() {
+	flags := flag.NewFlagSet("hydra-gcp", flag.ExitOnError)
+	fromEnv := flags.Bool("e", false, "If set, reads the database URL from the environment variable DATABASE_URL.")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	if len(os.Args) < 3 || os.Args[1] != "migrate" || os.Args[2] != "secret" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	flags.Parse(os.Args[3:])
+
+	dburl := flags.Arg(0)
+	if *fromEnv {
+		dburl = os.Getenv("DATABASE_URL")
+	}
+	if dburl == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := migrateSecret(context.Background(), dburl, os.Getenv("OLD_SYSTEM_SECRET"), os.Getenv("NEW_SYSTEM_SECRET")); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to rotate JSON Web Keys: %s\nRun the command again to resume the rotation.\n", err)
+		os.Exit(1)
+	}
+}
+
+func migrateSecret(ctx context.Context, dburl, oldSecret, newSecret string) error {
+	if len(oldSecret) < 16 {
+		return fmt.Errorf("value of environment variable OLD_SYSTEM_SECRET has to be at least 16 characters long but got: %d", len(oldSecret))
+	}
+	if len(newSecret) < 16 {
+		return fmt.Errorf("value of environment variable NEW_SYSTEM_SECRET has to be at least 16 characters long but got: %d", len(newSecret))
+	}
+
+	connection := &dconfig.DatastoreConnection{}
+	if err := connection.Init(dburl, logrus.New()); err != nil {
+		return err
+	}
+
+	// Hydra derives the cipher of its key manager from the system secret the same way
+	manager := connection.NewJWKManager(&jwk.AEAD{Key: pkg.HashStringSecret(oldSecret)}).(*djwk.DatastoreManager)
+
+	fmt.Println("Rotating encryption keys for JSON Web Key storage...")
+	stats, err := manager.RotateKeysWithStats(ctx, &jwk.AEAD{Key: pkg.HashStringSecret(newSecret)})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rotated %d keys of %d key sets, %d keys were already rotated.\n", stats.Rotated, stats.Sets, stats.Skipped)
+	fmt.Println("You may now run Hydra with the new system secret.")
+	return nil
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/datastore"
@@ -32,25 +33,52 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	dclient "github.com/someone1/hydra-gcp/client"
 	dconsent "github.com/someone1/hydra-gcp/consent"
+	"github.com/someone1/hydra-gcp/envelope"
+	"github.com/someone1/hydra-gcp/invalidation"
 	djwk "github.com/someone1/hydra-gcp/jwk"
 	"github.com/someone1/hydra-gcp/oauth2"
 )
 
 const (
-	datastoreScheme = "datastore"
+	datastoreScheme    = "datastore"
+	healthCheckKind    = "HydraHealthCheck"
+	namespaceKind      = "__namespace__"
+	defaultPingTimeout = 5 * time.Second
 )
 
-// Datastore URLs should be in the format of datastore://<projectid>?namespace=&credentialsFile=
+var (
+	// ErrDatastoreUnreachable is returned by Ping when Datastore could not be reached before the ping timeout
+	ErrDatastoreUnreachable = errors.New("datastore is unreachable")
+	// ErrDatastorePermissionDenied is returned by Ping when the configured credentials are not allowed to query Datastore
+	ErrDatastorePermissionDenied = errors.New("permission denied while querying datastore")
+	// ErrDatastoreNamespaceMissing is returned by Ping when the configured namespace does not exist in Datastore and
+	// requireNamespace is set
+	ErrDatastoreNamespaceMissing = errors.New("datastore namespace does not exist")
+)
+
+// Datastore URLs should be in the format of datastore://<projectid>?namespace=&credentialsFile=&pingTimeout=&requireNamespace=&flushConcurrency=&tracing=&refreshTokenReuseWindow=
 // Just using datastore:// will be sufficient if running on GCP wiith an DATASTORE_PROJECT_ID env var set
 
 // DatastoreConnection enables the use of Google's Datastore as a backend.
 type DatastoreConnection struct {
-	client *datastore.Client
-	url    *url.URL
-	l      logrus.FieldLogger
+	client           *datastore.Client
+	url              *url.URL
+	l                logrus.FieldLogger
+	pingTimeout      time.Duration
+	requireNamespace bool
+	flushConcurrency int
+	reuseWindow      time.Duration
+	tracing          bool
+	clientCache      *dclient.CacheOptions
+	bus              *invalidation.Bus
+	encrypter        *envelope.Encrypter
+	formRedactor     *oauth2.FormRedactor
+	kmsCipher        *djwk.KMSCipher
 }
 
 // Namespace will return the configured namespace for this backend, if any.
@@ -61,6 +89,36 @@ func (d *DatastoreConnection) Namespace() string {
 func (d *DatastoreConnection) Init(urlStr string, l logrus.FieldLogger, _ ...config.ConnectorOptions) error {
 	ctx := context.Background()
 
+	if err := d.parseURL(urlStr, l); err != nil {
+		return err
+	}
+
+	var opts []option.ClientOption
+	urlOpts := d.url.Query()
+	emulated := os.Getenv("DATASTORE_EMULATOR_HOST")
+	if urlOpts.Get("credentialsFile") != "" && emulated == "" {
+		opts = append(opts, option.WithCredentialsFile(urlOpts.Get("credentialsFile")))
+	}
+
+	var err error
+	if d.client, err = datastore.NewClient(ctx, d.url.Host, opts...); err != nil {
+		return errors.Wrap(err, "Could not Connect to Datastore")
+	}
+	return nil
+}
+
+// NewDatastoreConnection returns a DatastoreConnection using an existing client, e.g. to share one client between
+// several Hydra instances using different namespaces. urlStr is parsed for the same options as Init, its project ID and
+// credentialsFile are ignored in favor of the client's.
+func NewDatastoreConnection(client *datastore.Client, urlStr string, l logrus.FieldLogger) (*DatastoreConnection, error) {
+	d := &DatastoreConnection{client: client}
+	if err := d.parseURL(urlStr, l); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DatastoreConnection) parseURL(urlStr string, l logrus.FieldLogger) error {
 	URL, err := url.Parse(urlStr)
 	if err != nil {
 		return err
@@ -69,42 +127,195 @@ func (d *DatastoreConnection) Init(urlStr string, l logrus.FieldLogger, _ ...con
 	d.url = URL
 	d.l = l
 
-	var opts []option.ClientOption
 	if d.url.Scheme != datastoreScheme {
 		return errors.New("incorrect scheme provided in URL")
 	}
 	urlOpts := d.url.Query()
-	emulated := os.Getenv("DATASTORE_EMULATOR_HOST")
-	if urlOpts.Get("credentialsFile") != "" && emulated == "" {
-		opts = append(opts, option.WithCredentialsFile(urlOpts.Get("credentialsFile")))
+	d.pingTimeout = defaultPingTimeout
+	if timeout := urlOpts.Get("pingTimeout"); timeout != "" {
+		if d.pingTimeout, err = time.ParseDuration(timeout); err != nil {
+			return errors.Wrap(err, "Could not parse pingTimeout")
+		}
 	}
 
-	if d.client, err = datastore.NewClient(ctx, d.url.Host, opts...); err != nil {
-		return errors.Wrap(err, "Could not Connect to Datastore")
+	if require := urlOpts.Get("requireNamespace"); require != "" {
+		if d.requireNamespace, err = strconv.ParseBool(require); err != nil {
+			return errors.Wrap(err, "Could not parse requireNamespace")
+		}
+	}
+
+	d.flushConcurrency = 1
+	if concurrency := urlOpts.Get("flushConcurrency"); concurrency != "" {
+		if d.flushConcurrency, err = strconv.Atoi(concurrency); err != nil {
+			return errors.Wrap(err, "Could not parse flushConcurrency")
+		}
 	}
+
+	d.reuseWindow = oauth2.DefaultRefreshTokenReuseWindow
+	if window := urlOpts.Get("refreshTokenReuseWindow"); window != "" {
+		if d.reuseWindow, err = time.ParseDuration(window); err != nil {
+			return errors.Wrap(err, "Could not parse refreshTokenReuseWindow")
+		}
+	}
+
+	if tracing := urlOpts.Get("tracing"); tracing != "" {
+		if d.tracing, err = strconv.ParseBool(tracing); err != nil {
+			return errors.Wrap(err, "Could not parse tracing")
+		}
+	}
+
 	return nil
 }
 
+// EnableTracing makes the managers created from now on start a span for each of their operations
+func (d *DatastoreConnection) EnableTracing() {
+	d.tracing = true
+}
+
+// EnableInvalidation makes the client, consent and JWK managers created from now on publish the changes they make to
+// bus, and the client caches subscribe to it.
+func (d *DatastoreConnection) EnableInvalidation(bus *invalidation.Bus) {
+	d.bus = bus
+}
+
+// publish returns a function publishing the changes of entities of kind to the bus
+func (d *DatastoreConnection) publish(kind string) func(ctx context.Context, id string) {
+	return func(ctx context.Context, id string) {
+		d.bus.Publish(ctx, kind, d.Namespace(), id)
+	}
+}
+
 func (d *DatastoreConnection) NewConsentManager(clientManager client.Manager, fs pkg.FositeStorer) consent.Manager {
-	return dconsent.NewDatastoreManager(d.client, d.Namespace(), clientManager, fs)
+	m := dconsent.NewDatastoreManager(d.client, d.Namespace(), clientManager, fs)
+	if d.tracing {
+		m.EnableTracing()
+	}
+	if d.bus != nil {
+		m.OnChange(func(ctx context.Context, kind, id string) {
+			d.bus.Publish(ctx, kind, d.Namespace(), id)
+		})
+	}
+	return m
+}
+
+// EnableEncryption makes the OAuth2 managers created from now on seal the sessions and forms they store with
+// encrypter
+func (d *DatastoreConnection) EnableEncryption(encrypter *envelope.Encrypter) {
+	d.encrypter = encrypter
+}
+
+// SetFormRedactor makes the OAuth2 managers created from now on redact the request forms they store with redactor
+// instead of oauth2.NewFormRedactor
+func (d *DatastoreConnection) SetFormRedactor(redactor *oauth2.FormRedactor) {
+	d.formRedactor = redactor
 }
 
 func (d *DatastoreConnection) NewOAuth2Manager(clientManager client.Manager, accessTokenLifespan time.Duration, _ string) pkg.FositeStorer {
-	return oauth2.NewFositeDatastoreStore(clientManager, d.client, d.Namespace(), d.l, accessTokenLifespan)
+	store := oauth2.NewFositeDatastoreStore(clientManager, d.client, d.Namespace(), d.l, accessTokenLifespan)
+	store.FlushConcurrency = d.flushConcurrency
+	store.RefreshTokenReuseWindow = d.reuseWindow
+	store.Encrypter = d.encrypter
+	if d.formRedactor != nil {
+		store.FormRedactor = d.formRedactor
+	}
+	if d.tracing {
+		store.EnableTracing()
+	}
+	return store
+}
+
+// EnableClientCache makes the client managers created from now on cache their client lookups
+func (d *DatastoreConnection) EnableClientCache(opts dclient.CacheOptions) {
+	d.clientCache = &opts
 }
 
 func (d *DatastoreConnection) NewClientManager(hasher fosite.Hasher) client.Manager {
-	return dclient.NewDatastoreManager(d.client, d.Namespace(), hasher)
+	m := dclient.NewDatastoreManager(d.client, d.Namespace(), hasher)
+	if d.l != nil {
+		m.L = d.l
+	}
+	if d.tracing {
+		m.EnableTracing()
+	}
+	if d.bus != nil {
+		m.OnChange(d.publish(dclient.ClientKind))
+	}
+	if d.clientCache == nil {
+		return m
+	}
+
+	cache := dclient.NewCachingManager(m, *d.clientCache)
+	if d.bus != nil {
+		d.bus.Subscribe(dclient.ClientKind, d.Namespace(), func(ctx context.Context, e invalidation.Event) {
+			cache.Invalidate(ctx, e.ID)
+		})
+	}
+	return cache
+}
+
+// EnableKMSKeyEncryption makes the JWK managers created from now on encrypt the keys they add with cipher instead of
+// the cipher derived from the system secret
+func (d *DatastoreConnection) EnableKMSKeyEncryption(cipher *djwk.KMSCipher) {
+	d.kmsCipher = cipher
 }
 
 func (d *DatastoreConnection) NewJWKManager(cipher *jwk.AEAD) jwk.Manager {
-	return djwk.NewDatastoreManager(d.client, d.Namespace(), cipher)
+	m := djwk.NewDatastoreManager(d.client, d.Namespace(), cipher)
+	m.KMSCipher = d.kmsCipher
+	if d.tracing {
+		m.EnableTracing()
+	}
+	if d.bus != nil {
+		m.OnChange(d.publish(djwk.KeyKind))
+	}
+	return m
 }
 
 func (d *DatastoreConnection) Prefixes() []string {
 	return []string{datastoreScheme}
 }
 
+// Ping will run a keys-only query against a sentinel kind in the configured namespace. With requireNamespace=true in the
+// URL it also verifies the namespace exists, Datastore only lists a namespace once an entity was written to it, so
+// a new namespace is healthy by default. The returned error will have a cause of ErrDatastoreUnreachable,
+// ErrDatastorePermissionDenied, or ErrDatastoreNamespaceMissing when the failure could be identified.
 func (d *DatastoreConnection) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.pingTimeout)
+	defer cancel()
+
+	query := datastore.NewQuery(healthCheckKind).Namespace(d.Namespace()).KeysOnly().Limit(1)
+	if _, err := d.client.GetAll(ctx, query, nil); err != nil {
+		return handlePingError(err)
+	}
+
+	// The default namespace always exists
+	if d.Namespace() == "" || !d.requireNamespace {
+		return nil
+	}
+
+	key := datastore.NameKey(namespaceKind, d.Namespace(), nil)
+	query = datastore.NewQuery(namespaceKind).Filter("__key__ =", key).KeysOnly()
+	keys, err := d.client.GetAll(ctx, query, nil)
+	if err != nil {
+		return handlePingError(err)
+	} else if len(keys) == 0 {
+		return errors.Wrap(ErrDatastoreNamespaceMissing, d.Namespace())
+	}
+
 	return nil
 }
+
+func handlePingError(err error) error {
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return errors.Wrap(ErrDatastoreUnreachable, err.Error())
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return errors.Wrap(ErrDatastoreUnreachable, err.Error())
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return errors.Wrap(ErrDatastorePermissionDenied, err.Error())
+	}
+
+	return errors.WithStack(err)
+}
@@ -20,8 +20,15 @@ import (
 	"context"
 	"net/url"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/someone1/hydra-gcp/oauth2"
 )
 
 func mustParseURL(t *testing.T, urlStr string) *url.URL {
@@ -36,14 +43,20 @@ func mustParseURL(t *testing.T, urlStr string) *url.URL {
 
 func TestNewDatastoreConnection(t *testing.T) {
 	validURL := mustParseURL(t, "datastore://project?namespace=namespace")
+	timeoutURL := mustParseURL(t, "datastore://project?namespace=namespace&pingTimeout=1s")
+	badTimeoutURL := mustParseURL(t, "datastore://project?pingTimeout=soon")
+	concurrencyURL := mustParseURL(t, "datastore://project?namespace=namespace&flushConcurrency=4")
+	badConcurrencyURL := mustParseURL(t, "datastore://project?flushConcurrency=many")
 	type args struct {
 		ctx context.Context
 		URL *url.URL
 		l   logrus.FieldLogger
 	}
 	type fields struct {
-		namespace string
-		ctx       context.Context
+		namespace        string
+		ctx              context.Context
+		pingTimeout      time.Duration
+		flushConcurrency int
 	}
 	tests := []struct {
 		name    string
@@ -61,6 +74,8 @@ func TestNewDatastoreConnection(t *testing.T) {
 			fields{
 				"",
 				nil,
+				0,
+				0,
 			},
 			true,
 		},
@@ -74,9 +89,71 @@ func TestNewDatastoreConnection(t *testing.T) {
 			fields{
 				"namespace",
 				context.Background(),
+				defaultPingTimeout,
+				1,
+			},
+			false,
+		},
+		{
+			"pingTimeout",
+			args{
+				context.Background(),
+				timeoutURL,
+				nil,
+			},
+			fields{
+				"namespace",
+				context.Background(),
+				time.Second,
+				1,
+			},
+			false,
+		},
+		{
+			"invalidPingTimeout",
+			args{
+				context.Background(),
+				badTimeoutURL,
+				nil,
+			},
+			fields{
+				"",
+				nil,
+				0,
+				0,
+			},
+			true,
+		},
+		{
+			"flushConcurrency",
+			args{
+				context.Background(),
+				concurrencyURL,
+				nil,
+			},
+			fields{
+				"namespace",
+				context.Background(),
+				defaultPingTimeout,
+				4,
 			},
 			false,
 		},
+		{
+			"invalidFlushConcurrency",
+			args{
+				context.Background(),
+				badConcurrencyURL,
+				nil,
+			},
+			fields{
+				"",
+				nil,
+				0,
+				0,
+			},
+			true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -100,6 +177,14 @@ func TestNewDatastoreConnection(t *testing.T) {
 					t.Errorf("DatastoreConnection.url = %s, want %s", want, tt.args.URL)
 					return
 				}
+				if want := con.pingTimeout; want != tt.fields.pingTimeout {
+					t.Errorf("DatastoreConnection.pingTimeout = %s, want %s", want, tt.fields.pingTimeout)
+					return
+				}
+				if want := con.flushConcurrency; want != tt.fields.flushConcurrency {
+					t.Errorf("DatastoreConnection.flushConcurrency = %d, want %d", want, tt.fields.flushConcurrency)
+					return
+				}
 				if want := con.client; want == nil {
 					t.Errorf("DatastoreConnection.Client() = nil, want *datastore.Client")
 					return
@@ -108,3 +193,95 @@ func TestNewDatastoreConnection(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlePingError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"deadline", context.DeadlineExceeded, ErrDatastoreUnreachable},
+		{"unavailable", status.Error(codes.Unavailable, "unavailable"), ErrDatastoreUnreachable},
+		{"grpcDeadline", status.Error(codes.DeadlineExceeded, "deadline"), ErrDatastoreUnreachable},
+		{"permissionDenied", status.Error(codes.PermissionDenied, "denied"), ErrDatastorePermissionDenied},
+		{"unauthenticated", status.Error(codes.Unauthenticated, "revoked"), ErrDatastorePermissionDenied},
+		{"other", status.Error(codes.Internal, "internal"), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handlePingError(tt.err)
+			if err == nil {
+				t.Fatalf("handlePingError() returned nil")
+			}
+			if tt.want == nil {
+				if cause := errors.Cause(err); cause != tt.err {
+					t.Errorf("handlePingError() cause = %v, want %v", cause, tt.err)
+				}
+				return
+			}
+			if cause := errors.Cause(err); cause != tt.want {
+				t.Errorf("handlePingError() cause = %v, want %v", cause, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewDatastoreConnectionWithClient(t *testing.T) {
+	client, err := datastore.NewClient(context.Background(), "project")
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+
+	con, err := NewDatastoreConnection(client, "datastore://?namespace=tenant&flushConcurrency=2", nil)
+	if err != nil {
+		t.Fatalf("NewDatastoreConnection() error = %v", err)
+	}
+	if con.client != client {
+		t.Errorf("expected the given client to be used")
+	}
+	if con.Namespace() != "tenant" || con.flushConcurrency != 2 || con.pingTimeout != defaultPingTimeout {
+		t.Errorf("unexpected connection options %+v", con)
+	}
+
+	if _, err := NewDatastoreConnection(client, "mysql://tenant", nil); err == nil {
+		t.Errorf("expected an error for an incorrect scheme")
+	}
+	if _, err := NewDatastoreConnection(client, "datastore://?pingTimeout=soon", nil); err == nil {
+		t.Errorf("expected an error for an invalid pingTimeout")
+	}
+	if _, err := NewDatastoreConnection(client, "datastore://?requireNamespace=maybe", nil); err == nil {
+		t.Errorf("expected an error for an invalid requireNamespace flag")
+	}
+	if con.requireNamespace {
+		t.Errorf("expected the namespace not to be required by default")
+	}
+	if con, err := NewDatastoreConnection(client, "datastore://?namespace=tenant&requireNamespace=true", nil); err != nil || !con.requireNamespace {
+		t.Errorf("expected the namespace to be required, got %v", err)
+	}
+	if _, err := NewDatastoreConnection(client, "datastore://?tracing=maybe", nil); err == nil {
+		t.Errorf("expected an error for an invalid tracing flag")
+	}
+	if _, err := NewDatastoreConnection(client, "datastore://?refreshTokenReuseWindow=forever", nil); err == nil {
+		t.Errorf("expected an error for an invalid refreshTokenReuseWindow")
+	}
+	if con.reuseWindow != oauth2.DefaultRefreshTokenReuseWindow {
+		t.Errorf("expected the default refresh token reuse window, got %v", con.reuseWindow)
+	}
+
+	con, err = NewDatastoreConnection(client, "datastore://?refreshTokenReuseWindow=0s", nil)
+	if err != nil {
+		t.Fatalf("NewDatastoreConnection() error = %v", err)
+	}
+	if con.reuseWindow != 0 {
+		t.Errorf("expected refresh token reuse detection to be disabled, got %v", con.reuseWindow)
+	}
+
+	con, err = NewDatastoreConnection(client, "datastore://?tracing=true", nil)
+	if err != nil {
+		t.Fatalf("NewDatastoreConnection() error = %v", err)
+	}
+	if !con.tracing {
+		t.Errorf("expected tracing to be enabled")
+	}
+}
@@ -45,6 +45,9 @@ type DatastoreManager struct {
 	namespace string
 	manager   client.Manager
 	store     pkg.FositeStorer
+	tracer    dscon.Tracer
+	// onChange are called with the kind and ID of every session created, changed or deleted
+	onChange []func(ctx context.Context, kind, id string)
 }
 
 func (d *DatastoreManager) createKeyForKind(id, kind string) *datastore.Key {
@@ -88,14 +91,42 @@ func NewDatastoreManager(client *datastore.Client, namespace string, c client.Ma
 		namespace: namespace,
 		manager:   c,
 		store:     store,
+		tracer:    dscon.NewTracer("consent", namespace),
+	}
+}
+
+// EnableTracing starts a span for every operation of the manager from now on
+func (d *DatastoreManager) EnableTracing() {
+	d.tracer.Enabled = true
+}
+
+// OnChange registers f to be called with the kind and ID of every authentication or consent session created, handled,
+// revoked or deleted through the manager, see AuthenticationSessionKind, ObfuscatedAuthenticationSessionKind and
+// ConsentSessionKind. Sessions removed by FlushInactiveRequests are not reported, they had already expired. It must be
+// called before the manager is used.
+func (d *DatastoreManager) OnChange(f func(ctx context.Context, kind, id string)) {
+	d.onChange = append(d.onChange, f)
+}
+
+func (d *DatastoreManager) changed(ctx context.Context, keys ...*datastore.Key) {
+	for _, key := range keys {
+		for _, f := range d.onChange {
+			f(ctx, key.Kind, key.Name)
+		}
 	}
 }
 
 func (d *DatastoreManager) RevokeUserConsentSession(ctx context.Context, user string) error {
+	ctx, span := d.tracer.StartSpan(ctx, "RevokeUserConsentSession", hydraConsentRequestKind)
+	defer span.End()
+
 	return d.revokeConsentSession(ctx, user, "")
 }
 
 func (d *DatastoreManager) RevokeUserClientConsentSession(ctx context.Context, user, client string) error {
+	ctx, span := d.tracer.StartSpan(ctx, "RevokeUserClientConsentSession", hydraConsentRequestKind)
+	defer span.End()
+
 	return d.revokeConsentSession(ctx, user, client)
 }
 
@@ -158,10 +189,19 @@ func (d *DatastoreManager) revokeConsentSession(ctx context.Context, user, clien
 	if err != nil {
 		return dscon.HandleError(err)
 	}
+
+	for _, key := range toDelete {
+		if key.Kind == hydraConsentRequestHandledKind {
+			d.changed(ctx, key)
+		}
+	}
 	return nil
 }
 
 func (d *DatastoreManager) RevokeUserAuthenticationSession(ctx context.Context, subject string) error {
+	ctx, span := d.tracer.StartSpan(ctx, "RevokeUserAuthenticationSession", hydraConsentAunthenticationSessionKind)
+	defer span.End()
+
 	query := d.newQueryForKind(hydraConsentAunthenticationSessionKind).Filter("sub=", subject).KeysOnly()
 	keys, err := d.client.GetAll(ctx, query, nil)
 	if err != nil {
@@ -174,20 +214,30 @@ func (d *DatastoreManager) RevokeUserAuthenticationSession(ctx context.Context,
 	if err != nil {
 		return dscon.HandleError(err)
 	}
+
+	d.changed(ctx, keys...)
 	return nil
 }
 
 func (d *DatastoreManager) CreateForcedObfuscatedAuthenticationSession(ctx context.Context, s *consent.ForcedObfuscatedAuthenticationSession) error {
+	ctx, span := d.tracer.StartSpan(ctx, "CreateForcedObfuscatedAuthenticationSession", hydraConsentObfuscatedAuthenticationSessionKind)
+	defer span.End()
+
 	key := d.createObfuscatedAuthSessionKey(s.ClientID, s.Subject)
 	mutation := datastore.NewUpsert(key, s)
 	_, err := d.client.Mutate(ctx, mutation)
 	if err != nil {
 		return dscon.HandleError(err)
 	}
+
+	d.changed(ctx, key)
 	return nil
 }
 
 func (d *DatastoreManager) GetForcedObfuscatedAuthenticationSession(ctx context.Context, client, obfuscated string) (*consent.ForcedObfuscatedAuthenticationSession, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "GetForcedObfuscatedAuthenticationSession", hydraConsentObfuscatedAuthenticationSessionKind)
+	defer span.End()
+
 	var o []consent.ForcedObfuscatedAuthenticationSession
 	query := d.newQueryForKind(hydraConsentObfuscatedAuthenticationSessionKind).Filter("ClientID=", client).Filter("SubjectObfuscated=", obfuscated)
 	_, err := d.client.GetAll(ctx, query, &o)
@@ -203,6 +253,9 @@ func (d *DatastoreManager) GetForcedObfuscatedAuthenticationSession(ctx context.
 }
 
 func (d *DatastoreManager) CreateConsentRequest(ctx context.Context, c *consent.ConsentRequest) error {
+	ctx, span := d.tracer.StartSpan(ctx, "CreateConsentRequest", hydraConsentRequestKind)
+	defer span.End()
+
 	data, err := consentDataFromRequest(c)
 	if err != nil {
 		return err
@@ -218,6 +271,9 @@ func (d *DatastoreManager) CreateConsentRequest(ctx context.Context, c *consent.
 }
 
 func (d *DatastoreManager) GetConsentRequest(ctx context.Context, challenge string) (*consent.ConsentRequest, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "GetConsentRequest", hydraConsentRequestKind)
+	defer span.End()
+
 	var c consentRequestData
 	var h handledConsentRequestData
 	key := d.createConsentReqKey(challenge)
@@ -256,6 +312,9 @@ func (d *DatastoreManager) GetConsentRequest(ctx context.Context, challenge stri
 }
 
 func (d *DatastoreManager) CreateAuthenticationRequest(ctx context.Context, c *consent.AuthenticationRequest) error {
+	ctx, span := d.tracer.StartSpan(ctx, "CreateAuthenticationRequest", hydraConsentAunthenticationRequestKind)
+	defer span.End()
+
 	data, err := authenticationDataFromRequest(c)
 	if err != nil {
 		return err
@@ -271,6 +330,9 @@ func (d *DatastoreManager) CreateAuthenticationRequest(ctx context.Context, c *c
 }
 
 func (d *DatastoreManager) GetAuthenticationRequest(ctx context.Context, challenge string) (*consent.AuthenticationRequest, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "GetAuthenticationRequest", hydraConsentAunthenticationRequestKind)
+	defer span.End()
+
 	var c consentRequestData
 	var h handledAuthenticationConsentRequestData
 	key := d.createConsentAuthReqKey(challenge)
@@ -309,6 +371,9 @@ func (d *DatastoreManager) GetAuthenticationRequest(ctx context.Context, challen
 }
 
 func (d *DatastoreManager) HandleConsentRequest(ctx context.Context, challenge string, r *consent.HandledConsentRequest) (*consent.ConsentRequest, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "HandleConsentRequest", hydraConsentRequestHandledKind)
+	defer span.End()
+
 	data, err := handledConsentRequest(r)
 	if err != nil {
 		return nil, err
@@ -320,10 +385,15 @@ func (d *DatastoreManager) HandleConsentRequest(ctx context.Context, challenge s
 	if _, err := d.client.Mutate(ctx, mutation); err != nil {
 		return nil, dscon.HandleError(err)
 	}
+
+	d.changed(ctx, key)
 	return d.GetConsentRequest(ctx, challenge)
 }
 
 func (d *DatastoreManager) VerifyAndInvalidateConsentRequest(ctx context.Context, verifier string) (*consent.HandledConsentRequest, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "VerifyAndInvalidateConsentRequest", hydraConsentRequestKind)
+	defer span.End()
+
 	var consentRequest consentRequestData
 	var queryResults []consentRequestData
 	var handledRequest handledConsentRequestData
@@ -362,6 +432,9 @@ func (d *DatastoreManager) VerifyAndInvalidateConsentRequest(ctx context.Context
 }
 
 func (d *DatastoreManager) HandleAuthenticationRequest(ctx context.Context, challenge string, r *consent.HandledAuthenticationRequest) (*consent.AuthenticationRequest, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "HandleAuthenticationRequest", hydraConsentAunthenticationRequestHandledKind)
+	defer span.End()
+
 	data, err := handledAuthenticationRequest(r)
 	if err != nil {
 		return nil, err
@@ -378,6 +451,9 @@ func (d *DatastoreManager) HandleAuthenticationRequest(ctx context.Context, chal
 }
 
 func (d *DatastoreManager) VerifyAndInvalidateAuthenticationRequest(ctx context.Context, verifier string) (*consent.HandledAuthenticationRequest, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "VerifyAndInvalidateAuthenticationRequest", hydraConsentAunthenticationRequestKind)
+	defer span.End()
+
 	var authReqData consentRequestData
 	var queryResults []consentRequestData
 	var handledAuthReqData handledAuthenticationConsentRequestData
@@ -416,6 +492,9 @@ func (d *DatastoreManager) VerifyAndInvalidateAuthenticationRequest(ctx context.
 }
 
 func (d *DatastoreManager) GetAuthenticationSession(ctx context.Context, id string) (*consent.AuthenticationSession, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "GetAuthenticationSession", hydraConsentAunthenticationSessionKind)
+	defer span.End()
+
 	var a authenticationSession
 
 	key := d.createAuthSessionKey(id)
@@ -427,6 +506,9 @@ func (d *DatastoreManager) GetAuthenticationSession(ctx context.Context, id stri
 }
 
 func (d *DatastoreManager) CreateAuthenticationSession(ctx context.Context, a *consent.AuthenticationSession) error {
+	ctx, span := d.tracer.StartSpan(ctx, "CreateAuthenticationSession", hydraConsentAunthenticationSessionKind)
+	defer span.End()
+
 	data := fromAuthenticationSession(a)
 
 	key := d.createAuthSessionKey(data.ID)
@@ -436,10 +518,14 @@ func (d *DatastoreManager) CreateAuthenticationSession(ctx context.Context, a *c
 		return dscon.HandleError(err)
 	}
 
+	d.changed(ctx, key)
 	return nil
 }
 
 func (d *DatastoreManager) DeleteAuthenticationSession(ctx context.Context, id string) error {
+	ctx, span := d.tracer.StartSpan(ctx, "DeleteAuthenticationSession", hydraConsentAunthenticationSessionKind)
+	defer span.End()
+
 	key := d.createAuthSessionKey(id)
 	mutation := datastore.NewDelete(key)
 
@@ -447,10 +533,14 @@ func (d *DatastoreManager) DeleteAuthenticationSession(ctx context.Context, id s
 		return dscon.HandleError(err)
 	}
 
+	d.changed(ctx, key)
 	return nil
 }
 
 func (d *DatastoreManager) FindPreviouslyGrantedConsentRequests(ctx context.Context, client string, subject string) ([]consent.HandledConsentRequest, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "FindPreviouslyGrantedConsentRequests", hydraConsentRequestHandledKind)
+	defer span.End()
+
 	var a []handledConsentRequestData
 	var consentReqs []consentRequestData
 
@@ -471,6 +561,7 @@ func (d *DatastoreManager) FindPreviouslyGrantedConsentRequests(ctx context.Cont
 		return nil, dscon.HandleError(err)
 	}
 
+	dscon.SetEntityCount(span, len(handledReqs))
 	for _, handledReq := range handledReqs {
 		if handledReq.Remember && handledReq.Error == "{}" {
 			a = append(a, handledReq)
@@ -481,6 +572,9 @@ func (d *DatastoreManager) FindPreviouslyGrantedConsentRequests(ctx context.Cont
 }
 
 func (d *DatastoreManager) FindPreviouslyGrantedConsentRequestsByUser(ctx context.Context, subject string, limit, offset int) ([]consent.HandledConsentRequest, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "FindPreviouslyGrantedConsentRequestsByUser", hydraConsentRequestHandledKind)
+	defer span.End()
+
 	var a []handledConsentRequestData
 	var consentReqs []consentRequestData
 
@@ -501,6 +595,7 @@ func (d *DatastoreManager) FindPreviouslyGrantedConsentRequestsByUser(ctx contex
 		return nil, dscon.HandleError(err)
 	}
 
+	dscon.SetEntityCount(span, len(handledReqs))
 	for _, handledReq := range handledReqs {
 		if handledReq.Remember && handledReq.Error == "{}" {
 			a = append(a, handledReq)
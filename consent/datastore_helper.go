@@ -45,6 +45,16 @@ const (
 	consentAuthenticationVersion                    = 1
 )
 
+// Kinds of the sessions whose changes are reported to OnChange
+const (
+	// AuthenticationSessionKind is the kind of authentication sessions, identified by their ID
+	AuthenticationSessionKind = hydraConsentAunthenticationSessionKind
+	// ObfuscatedAuthenticationSessionKind is the kind of forced obfuscated authentication sessions
+	ObfuscatedAuthenticationSessionKind = hydraConsentObfuscatedAuthenticationSessionKind
+	// ConsentSessionKind is the kind of handled consent requests, identified by their challenge
+	ConsentSessionKind = hydraConsentRequestHandledKind
+)
+
 func toDateHack(t time.Time) *time.Time {
 	if t.IsZero() {
 		return nil
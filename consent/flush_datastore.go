@@ -0,0 +1,349 @@
+/*
+ * Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consent
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+
+	"github.com/someone1/hydra-gcp/dscon"
+)
+
+const (
+	// flushTxSize is the number of requests checked per transaction, each request touches two entity groups and
+	// a transaction is limited to 25.
+	flushTxSize      = 10
+	defaultFlushPage = 100
+)
+
+// FlushOptions configures DatastoreManager.FlushInactiveRequests. Zero values disable the matching part of the flush.
+type FlushOptions struct {
+	// UnhandledNotAfter removes consent and login requests requested before this time that were never handled.
+	UnhandledNotAfter time.Time
+	// HandledRetention removes consent and login requests, along with their handled counterparts, that were used
+	// and requested longer than this ago. Remembered requests are kept until their remember period ends.
+	HandledRetention time.Duration
+	// SessionLifespan removes login sessions authenticated longer than this ago once every login request that
+	// remembered the session has expired.
+	SessionLifespan time.Duration
+	// PageSize is the number of entities read per query, defaults to 100.
+	PageSize int
+}
+
+// FlushStats reports the number of entities removed by DatastoreManager.FlushInactiveRequests
+type FlushStats struct {
+	ConsentRequests        int
+	AuthenticationRequests int
+	HandledConsent         int
+	HandledAuthentication  int
+	Sessions               int
+}
+
+// FlushInactiveRequests removes consent and login requests, and login sessions, that are no longer needed. It is
+// safe to run while serving traffic: unhandled requests are only removed after confirming, in a transaction, that
+// they were not handled in the meantime.
+func (d *DatastoreManager) FlushInactiveRequests(ctx context.Context, opts FlushOptions) (FlushStats, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "FlushInactiveRequests", "")
+	defer span.End()
+
+	var stats FlushStats
+	var err error
+
+	pageSize := opts.PageSize
+	if pageSize <= 0 || pageSize > dscon.MaxBatchSize/2 {
+		pageSize = defaultFlushPage
+	}
+
+	if !opts.UnhandledNotAfter.IsZero() {
+		if stats.ConsentRequests, err = d.flushUnhandled(ctx, hydraConsentRequestKind, hydraConsentRequestHandledKind, opts.UnhandledNotAfter, pageSize); err != nil {
+			return stats, err
+		}
+		if stats.AuthenticationRequests, err = d.flushUnhandled(ctx, hydraConsentAunthenticationRequestKind, hydraConsentAunthenticationRequestHandledKind, opts.UnhandledNotAfter, pageSize); err != nil {
+			return stats, err
+		}
+	}
+
+	if opts.HandledRetention > 0 {
+		notAfter := time.Now().Add(-opts.HandledRetention)
+		if stats.HandledConsent, err = d.flushHandled(ctx, hydraConsentRequestHandledKind, hydraConsentRequestKind, notAfter, pageSize); err != nil {
+			return stats, err
+		}
+		if stats.HandledAuthentication, err = d.flushHandled(ctx, hydraConsentAunthenticationRequestHandledKind, hydraConsentAunthenticationRequestKind, notAfter, pageSize); err != nil {
+			return stats, err
+		}
+	}
+
+	if opts.SessionLifespan > 0 {
+		if stats.Sessions, err = d.flushSessions(ctx, time.Now().Add(-opts.SessionLifespan), pageSize); err != nil {
+			return stats, err
+		}
+	}
+
+	dscon.SetEntityCount(span, stats.ConsentRequests+stats.AuthenticationRequests+stats.HandledConsent+
+		stats.HandledAuthentication+stats.Sessions)
+	return stats, nil
+}
+
+// pageKeys runs q from cursor and returns its keys along with the cursor after the last one
+func (d *DatastoreManager) pageKeys(ctx context.Context, q *datastore.Query, cursor *datastore.Cursor) ([]*datastore.Key, *datastore.Cursor, error) {
+	if cursor != nil {
+		q = q.Start(*cursor)
+	}
+
+	var keys []*datastore.Key
+	it := d.client.Run(ctx, q.KeysOnly())
+	for {
+		key, err := it.Next(nil)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, nil, dscon.HandleError(err)
+		}
+		keys = append(keys, key)
+	}
+
+	next, err := it.Cursor()
+	if err != nil {
+		return nil, nil, dscon.HandleError(err)
+	}
+	return keys, &next, nil
+}
+
+// flushUnhandled removes requests of kind that have no entity of handledKind
+func (d *DatastoreManager) flushUnhandled(ctx context.Context, kind, handledKind string, notAfter time.Time, pageSize int) (int, error) {
+	var cursor *datastore.Cursor
+	deleted := 0
+	query := d.newQueryForKind(kind).Filter("ra<", notAfter).Limit(pageSize)
+
+	for {
+		keys, next, err := d.pageKeys(ctx, query, cursor)
+		if err != nil {
+			return deleted, err
+		}
+
+		for _, chunk := range dscon.ChunkKeys(keys, flushTxSize) {
+			var removed int
+			_, err := dscon.RunInTransaction(ctx, d.client, func(tx *datastore.Transaction) error {
+				removed = 0
+				handledKeys := make([]*datastore.Key, len(chunk))
+				for idx, key := range chunk {
+					handledKeys[idx] = d.createKeyForKind(key.Name, handledKind)
+				}
+
+				var merr datastore.MultiError
+				err := tx.GetMulti(handledKeys, make([]datastore.PropertyList, len(handledKeys)))
+				if err != nil {
+					var ok bool
+					if merr, ok = err.(datastore.MultiError); !ok {
+						return err
+					}
+				}
+
+				var toDelete []*datastore.Key
+				for idx, key := range chunk {
+					if merr == nil || merr[idx] == nil {
+						continue
+					} else if merr[idx] != datastore.ErrNoSuchEntity {
+						return merr[idx]
+					}
+					toDelete = append(toDelete, key)
+				}
+
+				removed = len(toDelete)
+				return tx.DeleteMulti(toDelete)
+			})
+			if err != nil {
+				return deleted, dscon.HandleError(err)
+			}
+			deleted += removed
+		}
+
+		if len(keys) < pageSize {
+			return deleted, nil
+		}
+		cursor = next
+	}
+}
+
+// rememberedRequest loads the fields of a handled request needed to know if it is still remembered
+type rememberedRequest struct {
+	Remember bool `datastore:"rmbr"`
+	// RememberFor is saved under its field name by the handled request kinds
+	RememberFor int       `datastore:"RememberFor"`
+	RequestedAt time.Time `datastore:"rat"`
+}
+
+// Load is implemented for the PropertyLoadSaver interface, the remaining properties of the entity are ignored
+func (r *rememberedRequest) Load(ps []datastore.Property) error {
+	err := datastore.LoadStruct(r, ps)
+	if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Save is implemented for the PropertyLoadSaver interface
+func (r *rememberedRequest) Save() ([]datastore.Property, error) {
+	return nil, errors.New("rememberedRequest is read only")
+}
+
+func (r *rememberedRequest) isRemembered(now time.Time) bool {
+	return r.Remember && (r.RememberFor <= 0 || r.RequestedAt.Add(time.Duration(r.RememberFor)*time.Second).After(now))
+}
+
+// flushHandled removes used requests of handledKind, and the request they handled, unless they are still remembered
+func (d *DatastoreManager) flushHandled(ctx context.Context, handledKind, kind string, notAfter time.Time, pageSize int) (int, error) {
+	var cursor datastore.Cursor
+	deleted := 0
+	query := d.newQueryForKind(handledKind).Filter("wsu=", true).Filter("rat<", notAfter).Limit(pageSize)
+	now := time.Now().UTC()
+
+	for page := 0; ; page++ {
+		q := query
+		if page > 0 {
+			q = q.Start(cursor)
+		}
+
+		var toDelete []*datastore.Key
+		read := 0
+		it := d.client.Run(ctx, q)
+		for {
+			var r rememberedRequest
+			key, err := it.Next(&r)
+			if err == iterator.Done {
+				break
+			} else if err != nil {
+				return deleted, dscon.HandleError(err)
+			}
+			read++
+
+			if r.isRemembered(now) {
+				continue
+			}
+			toDelete = append(toDelete, key, d.createKeyForKind(key.Name, kind))
+		}
+
+		var err error
+		if cursor, err = it.Cursor(); err != nil {
+			return deleted, dscon.HandleError(err)
+		}
+
+		if err := d.client.DeleteMulti(ctx, toDelete); err != nil {
+			return deleted, dscon.HandleError(err)
+		}
+		deleted += len(toDelete) / 2
+
+		if read < pageSize {
+			return deleted, nil
+		}
+	}
+}
+
+// flushSessions removes login sessions authenticated before notAfter that are not remembered anymore
+func (d *DatastoreManager) flushSessions(ctx context.Context, notAfter time.Time, pageSize int) (int, error) {
+	var cursor datastore.Cursor
+	deleted := 0
+	query := d.newQueryForKind(hydraConsentAunthenticationSessionKind).Filter("aat<", notAfter).Limit(pageSize)
+
+	for page := 0; ; page++ {
+		q := query
+		if page > 0 {
+			q = q.Start(cursor)
+		}
+
+		var toDelete []*datastore.Key
+		read := 0
+		it := d.client.Run(ctx, q)
+		for {
+			var s authenticationSession
+			key, err := it.Next(&s)
+			if err == iterator.Done {
+				break
+			} else if err != nil {
+				return deleted, dscon.HandleError(err)
+			}
+			read++
+
+			remembered, err := d.isSessionRemembered(ctx, &s)
+			if err != nil {
+				return deleted, err
+			} else if !remembered {
+				toDelete = append(toDelete, key)
+			}
+		}
+
+		var err error
+		if cursor, err = it.Cursor(); err != nil {
+			return deleted, dscon.HandleError(err)
+		}
+
+		if err := d.client.DeleteMulti(ctx, toDelete); err != nil {
+			return deleted, dscon.HandleError(err)
+		}
+		deleted += len(toDelete)
+
+		if read < pageSize {
+			return deleted, nil
+		}
+	}
+}
+
+// isSessionRemembered reports whether any handled login request for the session asked to remember it for longer
+func (d *DatastoreManager) isSessionRemembered(ctx context.Context, s *authenticationSession) (bool, error) {
+	query := d.newQueryForKind(hydraConsentAunthenticationRequestKind).Filter("lsi=", s.ID).KeysOnly()
+	keys, err := d.client.GetAll(ctx, query, nil)
+	if err != nil {
+		return false, dscon.HandleError(err)
+	} else if len(keys) == 0 {
+		return false, nil
+	}
+
+	handledKeys := make([]*datastore.Key, len(keys))
+	for idx, key := range keys {
+		handledKeys[idx] = d.createhandleConsentAuthenticationRequestKey(key.Name)
+	}
+
+	handled := make([]rememberedRequest, len(handledKeys))
+	var merr datastore.MultiError
+	if err := d.client.GetMulti(ctx, handledKeys, handled); err != nil {
+		var ok bool
+		if merr, ok = err.(datastore.MultiError); !ok {
+			return false, dscon.HandleError(err)
+		}
+	}
+
+	now := time.Now().UTC()
+	for idx, h := range handled {
+		if merr != nil && merr[idx] == datastore.ErrNoSuchEntity {
+			continue
+		} else if merr != nil && merr[idx] != nil {
+			return false, errors.WithStack(merr[idx])
+		}
+
+		// The session is remembered from the time it was authenticated, not requested
+		h.RequestedAt = s.AuthenticatedAt
+		if h.isRemembered(now) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
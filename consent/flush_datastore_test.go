@@ -0,0 +1,113 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/hydra/client"
+	"github.com/ory/hydra/consent"
+	"github.com/ory/hydra/pkg"
+	"github.com/pkg/errors"
+)
+
+func TestFlushInactiveRequests(t *testing.T) {
+	m, ok := managers["datastore"].(*DatastoreManager)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	ctx := context.Background()
+	d := NewDatastoreManager(m.client, "consent-flush-test", clientManager, fositeManager)
+	c := &client.Client{ClientID: "flush-client"}
+	old := time.Now().Add(-2 * time.Hour)
+
+	createRequest := func(challenge string, requestedAt time.Time) {
+		t.Helper()
+		r := &consent.ConsentRequest{Challenge: challenge, Verifier: challenge, Client: c, RequestedAt: requestedAt}
+		if err := d.CreateConsentRequest(ctx, r); err != nil {
+			t.Fatalf("could not create consent request %s: %v", challenge, err)
+		}
+	}
+	handleRequest := func(challenge string, used, remember bool) {
+		t.Helper()
+		h := &consent.HandledConsentRequest{Challenge: challenge, RequestedAt: old, WasUsed: used, Remember: remember}
+		data, err := handledConsentRequest(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.client.Put(ctx, d.createhandleConsentRequestKey(challenge), data); err != nil {
+			t.Fatalf("could not handle consent request %s: %v", challenge, err)
+		}
+	}
+
+	createRequest("unhandled-old", old)
+	createRequest("unhandled-new", time.Now())
+	createRequest("handled-unused", old)
+	handleRequest("handled-unused", false, false)
+	createRequest("handled-used", old)
+	handleRequest("handled-used", true, false)
+	createRequest("handled-remembered", old)
+	handleRequest("handled-remembered", true, true)
+
+	for _, s := range []*consent.AuthenticationSession{
+		{ID: "session-old", Subject: "flush", AuthenticatedAt: old},
+		{ID: "session-new", Subject: "flush", AuthenticatedAt: time.Now()},
+	} {
+		if err := d.CreateAuthenticationSession(ctx, s); err != nil {
+			t.Fatalf("could not create session %s: %v", s.ID, err)
+		}
+	}
+
+	stats, err := d.FlushInactiveRequests(ctx, FlushOptions{
+		UnhandledNotAfter: time.Now().Add(-time.Hour),
+		HandledRetention:  time.Hour,
+		SessionLifespan:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("could not flush requests: %v", err)
+	}
+
+	want := FlushStats{ConsentRequests: 1, HandledConsent: 1, Sessions: 1}
+	if stats != want {
+		t.Errorf("FlushInactiveRequests() = %+v, want %+v", stats, want)
+	}
+
+	for challenge, exists := range map[string]bool{
+		"unhandled-old":      false,
+		"unhandled-new":      true,
+		"handled-unused":     true,
+		"handled-used":       false,
+		"handled-remembered": true,
+	} {
+		var r consentRequestData
+		err := d.client.Get(ctx, d.createConsentReqKey(challenge), &r)
+		if exists && err != nil {
+			t.Errorf("expected consent request %s to be kept, got %v", challenge, err)
+		} else if !exists && err != datastore.ErrNoSuchEntity {
+			t.Errorf("expected consent request %s to be flushed, got %v", challenge, err)
+		}
+	}
+
+	if _, err := d.GetAuthenticationSession(ctx, "session-old"); errors.Cause(err) != pkg.ErrNotFound {
+		t.Errorf("expected session-old to be flushed, got %v", err)
+	}
+	if _, err := d.GetAuthenticationSession(ctx, "session-new"); err != nil {
+		t.Errorf("expected session-new to be kept, got %v", err)
+	}
+}
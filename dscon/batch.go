@@ -0,0 +1,25 @@
+package dscon
+
+import (
+	"cloud.google.com/go/datastore"
+)
+
+// MaxBatchSize is the maximum number of keys or mutations Datastore will accept in a single call
+const MaxBatchSize = 500
+
+// ChunkKeys splits keys into consecutive chunks holding at most size keys each
+func ChunkKeys(keys []*datastore.Key, size int) [][]*datastore.Key {
+	if size <= 0 || size > MaxBatchSize {
+		size = MaxBatchSize
+	}
+
+	chunks := make([][]*datastore.Key, 0, (len(keys)+size-1)/size)
+	for start := 0; start < len(keys); start += size {
+		end := start + size
+		if end > len(keys) {
+			end = len(keys)
+		}
+		chunks = append(chunks, keys[start:end])
+	}
+	return chunks
+}
@@ -0,0 +1,54 @@
+package dscon
+
+import (
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func makeKeys(n int) []*datastore.Key {
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = datastore.NameKey("Test", fmt.Sprintf("key-%d", i), nil)
+	}
+	return keys
+}
+
+func TestChunkKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		keys   int
+		size   int
+		chunks []int
+	}{
+		{"empty", 0, 10, []int{}},
+		{"exact", 20, 10, []int{10, 10}},
+		{"remainder", 25, 10, []int{10, 10, 5}},
+		{"default", 1001, 0, []int{500, 500, 1}},
+		{"capped", 600, 1000, []int{500, 100}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := makeKeys(tt.keys)
+			chunks := ChunkKeys(keys, tt.size)
+			if len(chunks) != len(tt.chunks) {
+				t.Fatalf("ChunkKeys() returned %d chunks, want %d", len(chunks), len(tt.chunks))
+			}
+
+			seen := 0
+			for idx, chunk := range chunks {
+				if len(chunk) != tt.chunks[idx] {
+					t.Errorf("chunk %d has %d keys, want %d", idx, len(chunk), tt.chunks[idx])
+				}
+				for _, key := range chunk {
+					if key != keys[seen] {
+						t.Fatalf("chunk %d is out of order at key %s", idx, key.Name)
+					}
+					seen++
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package dscon
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+)
+
+// Attributes added to the spans started by a Tracer
+const (
+	KindAttribute               = "datastore.kind"
+	NamespaceAttribute          = "datastore.namespace"
+	EntitiesAttribute           = "datastore.entities"
+	TransactionRetriesAttribute = "datastore.transaction.retries"
+)
+
+// Tracer starts a span for every operation of a Datastore manager once enabled
+type Tracer struct {
+	// Enabled must be set for spans to be started
+	Enabled bool
+
+	component string
+	namespace string
+}
+
+// NewTracer returns a disabled Tracer naming its spans hydra.datastore.<component>.<operation>
+func NewTracer(component, namespace string) Tracer {
+	return Tracer{component: component, namespace: namespace}
+}
+
+// StartSpan starts the span of operation op on entities of kind, which is left out if empty for operations spanning
+// several kinds. ctx is returned as is with a nil span, which is safe to use, when tracing is disabled.
+func (t Tracer) StartSpan(ctx context.Context, op, kind string) (context.Context, *trace.Span) {
+	if !t.Enabled {
+		return ctx, nil
+	}
+
+	ctx, span := trace.StartSpan(ctx, "hydra.datastore."+t.component+"."+op)
+	span.AddAttributes(trace.StringAttribute(NamespaceAttribute, t.namespace))
+	if kind != "" {
+		span.AddAttributes(trace.StringAttribute(KindAttribute, kind))
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+type spanKey struct{}
+
+// operationSpan returns the span started by a Tracer for the operation of ctx, or nil if there is none being recorded.
+// Other spans of ctx, e.g. the span of the HTTP request, are left alone.
+func operationSpan(ctx context.Context) *trace.Span {
+	span, _ := ctx.Value(spanKey{}).(*trace.Span)
+	if span == nil || !span.IsRecordingEvents() {
+		return nil
+	}
+	return span
+}
+
+// SetEntityCount records the number of entities read or written by the operation of span
+func SetEntityCount(span *trace.Span, n int) {
+	span.AddAttributes(trace.Int64Attribute(EntitiesAttribute, int64(n)))
+}
+
+// RunInTransaction calls client.RunInTransaction and records how many times f was retried on the span a Tracer
+// started for the operation of ctx, nothing is recorded while tracing is disabled
+func RunInTransaction(ctx context.Context, client *datastore.Client, f func(tx *datastore.Transaction) error, opts ...datastore.TransactionOption) (*datastore.Commit, error) {
+	span := operationSpan(ctx)
+	if span == nil {
+		return client.RunInTransaction(ctx, f, opts...)
+	}
+
+	attempts := 0
+	commit, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		attempts++
+		return f(tx)
+	}, opts...)
+	span.AddAttributes(trace.Int64Attribute(TransactionRetriesAttribute, int64(attempts-1)))
+	return commit, err
+}
@@ -0,0 +1,71 @@
+package dscon
+
+import (
+	"context"
+	"testing"
+
+	"go.opencensus.io/trace"
+)
+
+type spanRecorder struct {
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.spans = append(r.spans, s)
+}
+
+func TestTracer(t *testing.T) {
+	recorder := &spanRecorder{}
+	trace.RegisterExporter(recorder)
+	defer trace.UnregisterExporter(recorder)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	ctx := context.Background()
+	tracer := NewTracer("client", "tenant")
+
+	disabledCtx, span := tracer.StartSpan(ctx, "GetClient", "HydraClient")
+	if span != nil || disabledCtx != ctx {
+		t.Fatalf("expected no span to be started while tracing is disabled")
+	}
+	SetEntityCount(span, 1)
+	span.End()
+
+	tracer.Enabled = true
+	_, span = tracer.StartSpan(ctx, "GetClients", "HydraClient")
+	SetEntityCount(span, 3)
+	span.End()
+
+	if len(recorder.spans) != 1 {
+		t.Fatalf("expected 1 span to be exported, got %d", len(recorder.spans))
+	}
+	got := recorder.spans[0]
+	if got.Name != "hydra.datastore.client.GetClients" {
+		t.Errorf("unexpected span name %s", got.Name)
+	}
+	want := map[string]interface{}{KindAttribute: "HydraClient", NamespaceAttribute: "tenant", EntitiesAttribute: int64(3)}
+	for key, value := range want {
+		if got.Attributes[key] != value {
+			t.Errorf("expected attribute %s to be %v, got %v", key, value, got.Attributes[key])
+		}
+	}
+}
+
+func TestOperationSpan(t *testing.T) {
+	ctx, span := trace.StartSpan(context.Background(), "http.request", trace.WithSampler(trace.AlwaysSample()))
+	defer span.End()
+
+	tracer := NewTracer("client", "tenant")
+	disabledCtx, _ := tracer.StartSpan(ctx, "UpdateClient", "HydraClient")
+	if operationSpan(disabledCtx) != nil {
+		t.Errorf("expected the span of the request to be left alone while tracing is disabled")
+	}
+
+	tracer.Enabled = true
+	enabledCtx, opSpan := tracer.StartSpan(ctx, "UpdateClient", "HydraClient")
+	defer opSpan.End()
+	if operationSpan(enabledCtx) != opSpan {
+		t.Errorf("expected the span of the operation to be returned")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package envelope encrypts data with AES-256-GCM data keys, which are themselves wrapped by a key encryption key held
+// by Cloud KMS or in a local Keyring. The wrapped data key and the ID of the key encryption key are stored along with
+// the ciphertext so the key encryption key can be rotated.
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DataKeySize is the size of the AES-256 data keys
+	DataKeySize = 32
+	// DefaultDataKeyLifetime is how long a data key is used to encrypt data before a new one is generated by default
+	DefaultDataKeyLifetime = time.Hour
+
+	// maxOpenedDataKeys bounds how many unwrapped data keys are kept in memory
+	maxOpenedDataKeys = 1024
+)
+
+// KeyWrapper wraps data keys with a key encryption key
+type KeyWrapper interface {
+	// Wrap encrypts dataKey with the current key encryption key and returns the ID of the key along with the wrapped
+	// data key
+	Wrap(ctx context.Context, dataKey []byte) (string, []byte, error)
+	// Unwrap decrypts a data key wrapped with the key encryption key keyID
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// DataKey encrypts and decrypts data with AES-256-GCM
+type DataKey struct {
+	// KeyID is the ID of the key encryption key that wrapped the data key
+	KeyID string
+	// Wrapped is the data key wrapped by the key encryption key, it must be stored along with the ciphertexts
+	Wrapped []byte
+
+	aead cipher.AEAD
+}
+
+func newDataKey(keyID string, wrapped, key []byte) (*DataKey, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{KeyID: keyID, Wrapped: wrapped, aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aead, nil
+}
+
+// seal encrypts plaintext with aead and a random nonce, the nonce is prepended to the ciphertext
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts a ciphertext returned by seal
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("the ciphertext is too short")
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return plaintext, nil
+}
+
+// Seal encrypts plaintext, additionalData is authenticated but not encrypted and must be given again to Open, e.g. the
+// ID of the entity the ciphertext is stored in so it cannot be moved to another one.
+func (k *DataKey) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	return seal(k.aead, plaintext, additionalData)
+}
+
+// Open decrypts a ciphertext returned by Seal
+func (k *DataKey) Open(ciphertext, additionalData []byte) ([]byte, error) {
+	return open(k.aead, ciphertext, additionalData)
+}
+
+// Encrypter hands out data keys wrapped by a KeyWrapper. The same data key is used for DataKeyLifetime so the key
+// encryption key is not called for every encryption, and unwrapped data keys are kept in memory for the same reason.
+type Encrypter struct {
+	// DataKeyLifetime is how long a data key is used before a new one is generated, defaults to
+	// DefaultDataKeyLifetime
+	DataKeyLifetime time.Duration
+
+	wrapper KeyWrapper
+
+	mu      sync.Mutex
+	current *DataKey
+	created time.Time
+	opened  map[string]*DataKey
+}
+
+// NewEncrypter returns an Encrypter wrapping its data keys with wrapper
+func NewEncrypter(wrapper KeyWrapper) *Encrypter {
+	return &Encrypter{
+		DataKeyLifetime: DefaultDataKeyLifetime,
+		wrapper:         wrapper,
+		opened:          make(map[string]*DataKey),
+	}
+}
+
+// DataKey returns the data key to encrypt data with, a new one is generated and wrapped once the current one is older
+// than DataKeyLifetime.
+func (e *Encrypter) DataKey(ctx context.Context) (*DataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.current != nil && time.Since(e.created) < e.DataKeyLifetime {
+		return e.current, nil
+	}
+
+	key := make([]byte, DataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keyID, wrapped, err := e.wrapper.Wrap(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := newDataKey(keyID, wrapped, key)
+	if err != nil {
+		return nil, err
+	}
+
+	e.current, e.created = dataKey, time.Now()
+	e.remember(dataKey)
+	return dataKey, nil
+}
+
+// OpenDataKey returns the data key wrapped with the key encryption key keyID
+func (e *Encrypter) OpenDataKey(ctx context.Context, keyID string, wrapped []byte) (*DataKey, error) {
+	id := keyID + "/" + string(wrapped)
+	e.mu.Lock()
+	dataKey, ok := e.opened[id]
+	e.mu.Unlock()
+	if ok {
+		return dataKey, nil
+	}
+
+	key, err := e.wrapper.Unwrap(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey, err = newDataKey(keyID, wrapped, key); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	e.remember(dataKey)
+	e.mu.Unlock()
+	return dataKey, nil
+}
+
+// Rotated reports whether data encrypted by a data key wrapped with the key encryption key keyID should be encrypted
+// again, as the current data key is wrapped by another key encryption key.
+func (e *Encrypter) Rotated(ctx context.Context, keyID string) (bool, error) {
+	dataKey, err := e.DataKey(ctx)
+	if err != nil {
+		return false, err
+	}
+	return dataKey.KeyID != keyID, nil
+}
+
+// remember keeps dataKey in memory, e.mu must be held
+func (e *Encrypter) remember(dataKey *DataKey) {
+	if len(e.opened) >= maxOpenedDataKeys {
+		e.opened = make(map[string]*DataKey)
+	}
+	e.opened[dataKey.KeyID+"/"+string(dataKey.Wrapped)] = dataKey
+}
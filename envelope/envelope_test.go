@@ -0,0 +1,161 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/someone1/hydra-gcp/internal/kmstest"
+)
+
+type countingWrapper struct {
+	KeyWrapper
+	wraps, unwraps int
+}
+
+func (c *countingWrapper) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	c.wraps++
+	return c.KeyWrapper.Wrap(ctx, dataKey)
+}
+
+func (c *countingWrapper) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	c.unwraps++
+	return c.KeyWrapper.Unwrap(ctx, keyID, wrapped)
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, DataKeySize)
+}
+
+func TestNewKeyring(t *testing.T) {
+	if _, err := NewKeyring("missing", map[string][]byte{"k1": testKey(1)}); err == nil {
+		t.Error("expected an error for a missing primary key")
+	}
+	if _, err := NewKeyring("k1", map[string][]byte{"k1": []byte("short")}); err == nil {
+		t.Error("expected an error for a key of the wrong size")
+	}
+}
+
+func TestEncrypter(t *testing.T) {
+	ctx := context.Background()
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": testKey(1)})
+	if err != nil {
+		t.Fatalf("could not create keyring: %v", err)
+	}
+	wrapper := &countingWrapper{KeyWrapper: keyring}
+	encrypter := NewEncrypter(wrapper)
+
+	dataKey, err := encrypter.DataKey(ctx)
+	if err != nil {
+		t.Fatalf("could not get data key: %v", err)
+	}
+	ciphertext, err := dataKey.Seal([]byte("secret"), []byte("entity-1"))
+	if err != nil {
+		t.Fatalf("could not seal: %v", err)
+	}
+	if bytes.Contains(ciphertext, []byte("secret")) {
+		t.Error("expected the plaintext not to be readable")
+	}
+
+	if again, err := encrypter.DataKey(ctx); err != nil || again != dataKey || wrapper.wraps != 1 {
+		t.Errorf("expected the data key to be reused, got %d wraps and %v", wrapper.wraps, err)
+	}
+
+	// A new Encrypter unwraps the data key with the keyring
+	opened, err := NewEncrypter(wrapper).OpenDataKey(ctx, dataKey.KeyID, dataKey.Wrapped)
+	if err != nil {
+		t.Fatalf("could not open data key: %v", err)
+	}
+	if plaintext, err := opened.Open(ciphertext, []byte("entity-1")); err != nil || string(plaintext) != "secret" {
+		t.Errorf("expected the plaintext back, got %q and %v", plaintext, err)
+	}
+	if _, err := opened.Open(ciphertext, []byte("entity-2")); err == nil {
+		t.Error("expected the ciphertext not to open with other additional data")
+	}
+	if _, err := encrypter.OpenDataKey(ctx, dataKey.KeyID, dataKey.Wrapped); err != nil || wrapper.unwraps != 1 {
+		t.Errorf("expected the generated data key to be kept, got %d unwraps and %v", wrapper.unwraps, err)
+	}
+}
+
+func TestEncrypterRotation(t *testing.T) {
+	ctx := context.Background()
+	old, err := NewKeyring("k1", map[string][]byte{"k1": testKey(1)})
+	if err != nil {
+		t.Fatalf("could not create keyring: %v", err)
+	}
+	oldKey, err := NewEncrypter(old).DataKey(ctx)
+	if err != nil {
+		t.Fatalf("could not get data key: %v", err)
+	}
+
+	rotated, err := NewKeyring("k2", map[string][]byte{"k1": testKey(1), "k2": testKey(2)})
+	if err != nil {
+		t.Fatalf("could not create keyring: %v", err)
+	}
+	encrypter := NewEncrypter(rotated)
+	if ok, err := encrypter.Rotated(ctx, "k1"); err != nil || !ok {
+		t.Errorf("expected k1 to be rotated, got %v and %v", ok, err)
+	}
+	if ok, err := encrypter.Rotated(ctx, "k2"); err != nil || ok {
+		t.Errorf("expected k2 to be current, got %v and %v", ok, err)
+	}
+	if _, err := encrypter.OpenDataKey(ctx, oldKey.KeyID, oldKey.Wrapped); err != nil {
+		t.Errorf("expected data keys wrapped with k1 to still open: %v", err)
+	}
+	if _, err := encrypter.OpenDataKey(ctx, "k3", oldKey.Wrapped); err == nil {
+		t.Error("expected an unknown key encryption key to fail")
+	}
+}
+
+func TestKMSKeyWrapper(t *testing.T) {
+	ctx := context.Background()
+	server := kmstest.NewServer()
+	defer server.Close()
+
+	cryptoKey := "projects/test/locations/global/keyRings/test/cryptoKeys/sessions"
+	first, err := server.AddSymmetricKeyVersion(cryptoKey)
+	if err != nil {
+		t.Fatalf("could not add key version: %v", err)
+	}
+
+	wrapper, err := NewKMSKeyWrapper(ctx, cryptoKey, server.Client())
+	if err != nil {
+		t.Fatalf("could not create wrapper: %v", err)
+	}
+	keyID, wrapped, err := wrapper.Wrap(ctx, testKey(7))
+	if err != nil {
+		t.Fatalf("could not wrap: %v", err)
+	}
+	if keyID != first {
+		t.Errorf("expected the key ID to be the primary version %s, got %s", first, keyID)
+	}
+
+	if _, err := server.AddSymmetricKeyVersion(cryptoKey); err != nil {
+		t.Fatalf("could not add key version: %v", err)
+	}
+	if dataKey, err := wrapper.Unwrap(ctx, keyID, wrapped); err != nil || !bytes.Equal(dataKey, testKey(7)) {
+		t.Errorf("expected the data key back after rotating the crypto key, got %v", err)
+	}
+	if ok, err := NewEncrypter(wrapper).Rotated(ctx, first); err != nil || !ok {
+		t.Errorf("expected %s to be rotated, got %v and %v", first, ok, err)
+	}
+
+	server.SetState(first, kmstest.StateDisabled)
+	if _, err := wrapper.Unwrap(ctx, keyID, wrapped); err == nil {
+		t.Error("expected a disabled key version not to unwrap")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package envelope
+
+import (
+	"context"
+	"crypto/cipher"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// TypeCheck
+	_ KeyWrapper = (*Keyring)(nil)
+)
+
+// Keyring wraps data keys with local AES-256-GCM key encryption keys. Data keys are wrapped with the primary key and
+// unwrapped with the key they were wrapped with, so keys may be rotated by adding a new primary key and keeping the
+// previous ones until the data they protect was encrypted again.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring returns a Keyring holding keys by their ID, every key must be DataKeySize bytes long. primary is the ID
+// of the key wrapping new data keys.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, errors.Errorf("the primary key %s is not in the keyring", primary)
+	}
+
+	k := &Keyring{primary: primary, keys: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if len(key) != DataKeySize {
+			return nil, errors.Errorf("expected key %s to be %d bytes long, got %d", id, DataKeySize, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+// Wrap is implemented for the KeyWrapper interface
+func (k *Keyring) Wrap(_ context.Context, dataKey []byte) (string, []byte, error) {
+	wrapped, err := seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", nil, err
+	}
+	return k.primary, wrapped, nil
+}
+
+// Unwrap is implemented for the KeyWrapper interface
+func (k *Keyring) Unwrap(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, errors.Errorf("the key %s is not in the keyring", keyID)
+	}
+	return open(aead, wrapped, []byte(keyID))
+}
@@ -0,0 +1,93 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package envelope
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+var (
+	// TypeCheck
+	_ KeyWrapper = (*KMSKeyWrapper)(nil)
+)
+
+// KMSKeyWrapper wraps data keys with a Cloud KMS symmetric crypto key. The ID of the key encryption key is the name of
+// the crypto key version that wrapped the data key, Cloud KMS encrypts with the primary version of the crypto key and
+// decrypts with any enabled version.
+type KMSKeyWrapper struct {
+	service   *cloudkms.Service
+	cryptoKey string
+}
+
+// NewKMSKeyWrapper returns a KMSKeyWrapper for the crypto key at path cryptoKey, e.g.
+// projects/<project>/locations/<location>/keyRings/<keyring>/cryptoKeys/<key>. Requests are sent with client, the
+// default Google client is used if it is nil.
+func NewKMSKeyWrapper(ctx context.Context, cryptoKey string, client *http.Client) (*KMSKeyWrapper, error) {
+	if client == nil {
+		var err error
+		if client, err = google.DefaultClient(ctx, cloudkms.CloudPlatformScope); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	service, err := cloudkms.New(client)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &KMSKeyWrapper{service: service, cryptoKey: cryptoKey}, nil
+}
+
+// Wrap is implemented for the KeyWrapper interface
+func (k *KMSKeyWrapper) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	req := &cloudkms.EncryptRequest{Plaintext: base64.StdEncoding.EncodeToString(dataKey)}
+	resp, err := k.service.Projects.Locations.KeyRings.CryptoKeys.Encrypt(k.cryptoKey, req).Context(ctx).Do()
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	return resp.Name, wrapped, nil
+}
+
+// Unwrap is implemented for the KeyWrapper interface, the data key is decrypted with the crypto key of the keyID
+// version so data keys wrapped before switching to another crypto key can still be unwrapped.
+func (k *KMSKeyWrapper) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	cryptoKey := k.cryptoKey
+	if idx := strings.Index(keyID, "/cryptoKeyVersions/"); idx >= 0 {
+		cryptoKey = keyID[:idx]
+	}
+
+	req := &cloudkms.DecryptRequest{Ciphertext: base64.StdEncoding.EncodeToString(wrapped)}
+	resp, err := k.service.Projects.Locations.KeyRings.CryptoKeys.Decrypt(cryptoKey, req).Context(ctx).Do()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	dataKey, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return dataKey, nil
+}
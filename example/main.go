@@ -43,7 +43,10 @@ func main() {
 	logger := c.GetLogger()
 	w := herodot.NewJSONWriter(logger)
 
-	frontend, backend := hydragcp.GenerateIAMHydraHandler(ctx, c, gcpconfig, w, true)
+	frontend, backend, err := hydragcp.NewIAMHydraHandler(ctx, c, gcpconfig, w, true)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not bootstrap hydra")
+	}
 	// Protect the backend with something like "github.com/someone1/gcp-jwt-go/jwtmiddleware"
 
 	var wg sync.WaitGroup
@@ -3,10 +3,13 @@ module github.com/someone1/hydra-gcp
 require (
 	cloud.google.com/go v0.31.0
 	github.com/containerd/continuity v0.0.0-20181027224239-bea7585dbfac // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gobuffalo/packd v0.0.0-20181031195726-c82734870264 // indirect
 	github.com/gobuffalo/packr v1.17.0 // indirect
 	github.com/gogo/protobuf v1.1.1 // indirect
 	github.com/golang/gddo v0.0.0-20181009135830-6c035858b4d7 // indirect
+	github.com/golang/protobuf v1.2.0
+	github.com/gorilla/context v1.1.1
 	github.com/gorilla/sessions v1.1.3
 	github.com/imdario/mergo v0.3.6 // indirect
 	github.com/jmoiron/sqlx v1.2.0 // indirect
@@ -21,23 +24,26 @@ require (
 	github.com/ory/hydra v1.0.0-beta.9.0.20181026155100-c8104f4a43ec
 	github.com/ory/x v0.0.27
 	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
+	github.com/pborman/uuid v1.2.0
 	github.com/pkg/errors v0.8.0
 	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
 	github.com/prometheus/client_golang v0.9.0 // indirect
 	github.com/prometheus/common v0.0.0-20181020173914-7e9e6cabbd39 // indirect
 	github.com/prometheus/procfs v0.0.0-20181005140218-185b4288413d // indirect
+	github.com/rs/cors v1.6.0
 	github.com/sirupsen/logrus v1.1.1
 	github.com/someone1/fosite-gcp-oauth2 v0.0.0-20180921160433-89d8ad2aa972
 	github.com/someone1/gcp-jwt-go v2.0.1+incompatible
 	github.com/spf13/cast v1.3.0 // indirect
 	github.com/spf13/viper v1.2.1
 	github.com/stretchr/testify v1.2.2
+	github.com/urfave/negroni v1.0.0
 	go.opencensus.io v0.18.0
 	golang.org/x/crypto v0.0.0-20181030102418-4d3f4d9ffa16
 	golang.org/x/oauth2 v0.0.0-20181031022657-8527f56f7107
 	golang.org/x/sys v0.0.0-20181031143558-9b800f95dbbc // indirect
 	google.golang.org/api v0.0.0-20181101000641-61ce27ee8154
-	google.golang.org/genproto v0.0.0-20181029155118-b69ba1387ce2 // indirect
+	google.golang.org/genproto v0.0.0-20181029155118-b69ba1387ce2
 	google.golang.org/grpc v1.16.0
 	gopkg.in/resty.v1 v1.10.1 // indirect
 	gopkg.in/square/go-jose.v2 v2.1.9
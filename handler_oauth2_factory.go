@@ -16,17 +16,25 @@ import (
 	"github.com/ory/hydra/consent"
 	"github.com/ory/hydra/jwk"
 	"github.com/ory/hydra/oauth2"
-	"go.opencensus.io/trace"
 
 	fgoauth2 "github.com/someone1/fosite-gcp-oauth2"
+
+	dclient "github.com/someone1/hydra-gcp/client"
+	doauth2 "github.com/someone1/hydra-gcp/oauth2"
 )
 
 func newOAuth2Provider(ctxx context.Context, c *config.Config, jwtStrat jwk.JWTStrategy) fosite.OAuth2Provider {
 	var ctx = c.Context()
 	var store = ctx.FositeStore
-	attrs := []trace.Attribute{trace.Int64Attribute("bcrypt.workfactor", int64(c.BCryptWorkFactor))}
-	hasher := NewTracedHasher(&fosite.BCrypt{WorkFactor: c.BCryptWorkFactor}, attrs)
-	ctx.Hasher = hasher
+	var hasher = ctx.Hasher
+
+	// Client secrets are compared by the Datastore client manager so that their expiry and rotations are enforced
+	var manager *dclient.DatastoreManager
+	if ds, ok := store.(*doauth2.FositeDatastoreStore); ok {
+		if manager, ok = dclient.AsDatastoreManager(ds.Manager); ok {
+			hasher = dclient.NewSecretHasher(hasher)
+		}
+	}
 
 	fc := &compose.Config{
 		AccessTokenLifespan:            c.GetAccessTokenLifespan(),
@@ -57,7 +65,7 @@ func newOAuth2Provider(ctxx context.Context, c *config.Config, jwtStrat jwk.JWTS
 		c.GetLogger().Fatalf(`Environment variable OAUTH2_ACCESS_TOKEN_STRATEGY is set to "%s" but only "opaque" and "jwt" are valid values.`, c.OAuth2AccessTokenStrategy)
 	}
 
-	return compose.Compose(
+	provider := compose.Compose(
 		fc,
 		store,
 		&compose.CommonStrategy{
@@ -78,6 +86,10 @@ func newOAuth2Provider(ctxx context.Context, c *config.Config, jwtStrat jwk.JWTS
 		compose.OAuth2TokenIntrospectionFactory,
 		compose.OAuth2PKCEFactory,
 	)
+	if manager != nil {
+		return dclient.NewSecretAuthenticator(provider, manager)
+	}
+	return provider
 }
 
 func injectGCPOauth2(ctx context.Context, handler *server.Handler, c *config.Config, jwtStrat jwk.JWTStrategy) {
@@ -3,25 +3,35 @@ package hydragcp
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/ory/fosite"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
 	"go.opencensus.io/trace"
+
+	dclient "github.com/someone1/hydra-gcp/client"
 )
 
-// NewTracedHasher will wrap the given fosite.Hasher with one that will add spans to existing traces
+// NewTracedHasher will wrap the given fosite.Hasher with one that will add spans to existing traces and record the
+// hasher measures, see DefaultHasherViews
 func NewTracedHasher(hasher fosite.Hasher, attrs []trace.Attribute) fosite.Hasher {
-	return &tracedHasher{
+	t := &tracedHasher{
 		hashOp:    fmt.Sprintf("hydra.%T.hash", hasher),
 		compareOp: fmt.Sprintf("hydra.%T.compare", hasher),
 		attrs:     attrs,
 		Hasher:    hasher,
 	}
+	t.tags = hasherTags(hasher)
+	return t
 }
 
 type tracedHasher struct {
 	hashOp    string
 	compareOp string
 	attrs     []trace.Attribute
+	// tags are added to the hash measures, and to the compare measures of hashes that cannot be parsed
+	tags []tag.Mutator
 
 	fosite.Hasher
 }
@@ -30,12 +40,39 @@ func (t *tracedHasher) Hash(ctx context.Context, data []byte) ([]byte, error) {
 	tctx, span := trace.StartSpan(ctx, t.hashOp)
 	defer span.End()
 	span.AddAttributes(t.attrs...)
-	return t.Hasher.Hash(tctx, data)
+
+	start := time.Now()
+	hash, err := t.Hasher.Hash(tctx, data)
+	stats.RecordWithTags(tctx, t.tags, HashLatency.M(sinceInMilliseconds(start)))
+	return hash, err
 }
 
 func (t *tracedHasher) Compare(ctx context.Context, hash, data []byte) error {
 	tctx, span := trace.StartSpan(ctx, t.compareOp)
 	defer span.End()
 	span.AddAttributes(t.attrs...)
-	return t.Hasher.Compare(tctx, hash, data)
+
+	start := time.Now()
+	err := t.Hasher.Compare(tctx, hash, data)
+	// The compare is tagged with the algorithm and cost of the stored hash, which may not be those of the hasher
+	tags := hashTags(hash)
+	if tags == nil {
+		tags = append([]tag.Mutator(nil), t.tags...)
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	tags = append(tags, tag.Upsert(KeyCompareResult, result))
+	stats.RecordWithTags(tctx, tags, CompareLatency.M(sinceInMilliseconds(start)), Compares.M(1))
+	return err
+}
+
+// NeedsRehash is implemented for the client.RehashChecker interface
+func (t *tracedHasher) NeedsRehash(hash []byte) bool {
+	return dclient.NeedsRehash(t.Hasher, hash)
+}
+
+func sinceInMilliseconds(start time.Time) float64 {
+	return float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond)
 }
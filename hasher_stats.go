@@ -0,0 +1,97 @@
+package hydragcp
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ory/fosite"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Measures recorded by the hashers returned by NewTracedHasher
+var (
+	HashLatency    = stats.Float64("hydra/hasher/hash_latency", "Latency of hashing a secret", stats.UnitMilliseconds)
+	CompareLatency = stats.Float64("hydra/hasher/compare_latency", "Latency of comparing a secret to its hash", stats.UnitMilliseconds)
+	Compares       = stats.Int64("hydra/hasher/compares", "Number of secrets compared to their hash", stats.UnitDimensionless)
+)
+
+// Tags added to the measures of the hashers returned by NewTracedHasher
+var (
+	// KeyHasher is the algorithm, or the type of unknown hashers
+	KeyHasher, _ = tag.NewKey("hydra_hasher")
+	// KeyWorkFactor is the cost of the hasher, e.g. 10 for bcrypt or m=65536,t=3,p=4 for argon2id
+	KeyWorkFactor, _ = tag.NewKey("hydra_hasher_work_factor")
+	// KeyCompareResult is either success or failure
+	KeyCompareResult, _ = tag.NewKey("hydra_hasher_result")
+)
+
+// hasherLatencyDistribution buckets latencies in milliseconds
+var hasherLatencyDistribution = view.Distribution(1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000)
+
+// Views of the hasher measures, they must be registered with view.Register to be exported
+var (
+	HashLatencyView = &view.View{
+		Name:        "hydra/hasher/hash_latency",
+		Description: "Latency distribution of hashing a secret",
+		Measure:     HashLatency,
+		TagKeys:     []tag.Key{KeyHasher, KeyWorkFactor},
+		Aggregation: hasherLatencyDistribution,
+	}
+	CompareLatencyView = &view.View{
+		Name:        "hydra/hasher/compare_latency",
+		Description: "Latency distribution of comparing a secret to its hash",
+		Measure:     CompareLatency,
+		TagKeys:     []tag.Key{KeyHasher, KeyWorkFactor, KeyCompareResult},
+		Aggregation: hasherLatencyDistribution,
+	}
+	CompareCountView = &view.View{
+		Name:        "hydra/hasher/compares",
+		Description: "Number of secrets compared to their hash",
+		Measure:     Compares,
+		TagKeys:     []tag.Key{KeyHasher, KeyWorkFactor, KeyCompareResult},
+		Aggregation: view.Count(),
+	}
+
+	// DefaultHasherViews are all the views of the hasher measures
+	DefaultHasherViews = []*view.View{HashLatencyView, CompareLatencyView, CompareCountView}
+)
+
+// RegisterHasherViews registers DefaultHasherViews so they are exported by the registered exporters
+func RegisterHasherViews() error {
+	return view.Register(DefaultHasherViews...)
+}
+
+// hasherTags describes the algorithm and cost of hasher
+func hasherTags(hasher fosite.Hasher) []tag.Mutator {
+	switch h := hasher.(type) {
+	case *fosite.BCrypt:
+		return costTags(BCryptAlgorithm, h.WorkFactor, Argon2Params{}, ScryptParams{})
+	case *PHCHasher:
+		return costTags(h.algorithm(), h.bcryptCost(), h.argon2Params(), h.scryptParams())
+	}
+	return []tag.Mutator{tag.Upsert(KeyHasher, fmt.Sprintf("%T", hasher)), tag.Upsert(KeyWorkFactor, "")}
+}
+
+// hashTags describes the algorithm and cost hash was made with, it returns nil if hash cannot be parsed
+func hashTags(hash []byte) []tag.Mutator {
+	parsed, err := parsePHC(hash)
+	if err != nil {
+		return nil
+	}
+	return costTags(parsed.algorithm, parsed.bcryptCost, parsed.argon2, parsed.scrypt)
+}
+
+func costTags(algorithm string, bcryptCost int, argon2 Argon2Params, scrypt ScryptParams) []tag.Mutator {
+	var workFactor string
+	switch algorithm {
+	case BCryptAlgorithm:
+		workFactor = strconv.Itoa(bcryptCost)
+	case Argon2idAlgorithm:
+		workFactor = fmt.Sprintf("m=%d,t=%d,p=%d", argon2.Memory, argon2.Iterations, argon2.Parallelism)
+	case ScryptAlgorithm:
+		workFactor = fmt.Sprintf("ln=%d,r=%d,p=%d", scrypt.LogN, scrypt.R, scrypt.P)
+	}
+	return []tag.Mutator{tag.Upsert(KeyHasher, algorithm), tag.Upsert(KeyWorkFactor, workFactor)}
+}
@@ -0,0 +1,141 @@
+// Copyright © 2018 Prateek Malhotra (someone1@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hydragcp
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ory/fosite"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestTracedHasherStats(t *testing.T) {
+	if err := RegisterHasherViews(); err != nil {
+		t.Fatalf("could not register views: %v", err)
+	}
+	defer view.Unregister(DefaultHasherViews...)
+
+	ctx := context.Background()
+	h := NewTracedHasher(&fosite.BCrypt{WorkFactor: 4}, nil)
+	hash, err := h.Hash(ctx, []byte("secret"))
+	if err != nil {
+		t.Fatalf("could not hash: %v", err)
+	}
+	h.Compare(ctx, hash, []byte("secret"))
+	h.Compare(ctx, hash, []byte("secret"))
+	h.Compare(ctx, hash, []byte("wrong"))
+
+	rows, err := view.RetrieveData(CompareCountView.Name)
+	if err != nil {
+		t.Fatalf("could not retrieve data: %v", err)
+	}
+
+	counts := make(map[string]int64)
+	for _, row := range rows {
+		var result string
+		for _, tg := range row.Tags {
+			switch tg.Key {
+			case KeyCompareResult:
+				result = tg.Value
+			case KeyHasher:
+				if tg.Value != BCryptAlgorithm {
+					t.Errorf("expected the hasher tag to be bcrypt, got %s", tg.Value)
+				}
+			case KeyWorkFactor:
+				if tg.Value != "4" {
+					t.Errorf("expected the work factor tag to be 4, got %s", tg.Value)
+				}
+			}
+		}
+		counts[result] = row.Data.(*view.CountData).Value
+	}
+	if counts["success"] != 2 || counts["failure"] != 1 {
+		t.Errorf("expected 2 successful and 1 failed compares, got %v", counts)
+	}
+
+	rows, err = view.RetrieveData(HashLatencyView.Name)
+	if err != nil {
+		t.Fatalf("could not retrieve data: %v", err)
+	}
+	if len(rows) != 1 || rows[0].Data.(*view.DistributionData).Count != 1 {
+		t.Errorf("expected a single hash latency to be recorded, got %+v", rows)
+	}
+}
+
+func TestHasherTags(t *testing.T) {
+	h := &PHCHasher{Algorithm: Argon2idAlgorithm, Argon2: Argon2Params{Memory: 1024, Iterations: 2, Parallelism: 1}}
+	m, err := tagMap(hasherTags(h))
+	if err != nil {
+		t.Fatalf("could not apply tags: %v", err)
+	}
+	if v, _ := m.Value(KeyHasher); v != Argon2idAlgorithm {
+		t.Errorf("expected the hasher tag to be argon2id, got %s", v)
+	}
+	if v, _ := m.Value(KeyWorkFactor); v != "m=1024,t=2,p=1" {
+		t.Errorf("unexpected work factor tag %s", v)
+	}
+}
+
+func TestCompareTaggedWithStoredHash(t *testing.T) {
+	if err := RegisterHasherViews(); err != nil {
+		t.Fatalf("could not register views: %v", err)
+	}
+	defer view.Unregister(DefaultHasherViews...)
+
+	// A legacy bcrypt hash compared by a hasher configured for argon2id
+	legacy, err := testPHCHasher(BCryptAlgorithm).Hash(context.Background(), []byte("secret"))
+	if err != nil {
+		t.Fatalf("could not hash: %v", err)
+	}
+	h := NewTracedHasher(testPHCHasher(Argon2idAlgorithm), nil)
+	if err := h.Compare(context.Background(), legacy, []byte("secret")); err != nil {
+		t.Fatalf("could not compare: %v", err)
+	}
+	h.Compare(context.Background(), []byte("not a hash"), []byte("secret"))
+
+	rows, err := view.RetrieveData(CompareCountView.Name)
+	if err != nil {
+		t.Fatalf("could not retrieve data: %v", err)
+	}
+	got := make(map[string]string)
+	for _, row := range rows {
+		var hasher, workFactor string
+		for _, tg := range row.Tags {
+			switch tg.Key {
+			case KeyHasher:
+				hasher = tg.Value
+			case KeyWorkFactor:
+				workFactor = tg.Value
+			}
+		}
+		got[hasher] = workFactor
+	}
+	// Hashes that cannot be parsed are tagged with the hasher
+	want := map[string]string{BCryptAlgorithm: "4", Argon2idAlgorithm: "m=1024,t=1,p=1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the compares to be tagged with %v, got %v", want, got)
+	}
+}
+
+func tagMap(mutators []tag.Mutator) (*tag.Map, error) {
+	ctx, err := tag.New(context.Background(), mutators...)
+	if err != nil {
+		return nil, err
+	}
+	return tag.FromContext(ctx), nil
+}
@@ -16,7 +16,7 @@ package hydragcp
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -30,12 +30,12 @@ import (
 	sdk "github.com/ory/hydra/sdk/go/hydra"
 	swagger "github.com/ory/hydra/sdk/go/hydra/swagger"
 	"github.com/ory/x/healthx"
-	"github.com/pkg/errors"
 	"github.com/someone1/gcp-jwt-go"
 	"golang.org/x/crypto/bcrypt"
 	goauth2 "golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 	"golang.org/x/oauth2/google"
+	"gopkg.in/square/go-jose.v2"
 )
 
 var jConfig *gcpjwt.IAMConfig
@@ -72,7 +72,10 @@ func generateGCPHydraHandler(t *testing.T) (context.Context, http.Handler, http.
 	logger := c.GetLogger()
 	w := herodot.NewJSONWriter(logger)
 
-	f, b := GenerateIAMHydraHandler(ctx, c, jConfig, w, false)
+	f, b, err := NewIAMHydraHandler(ctx, c, jConfig, w, false)
+	if err != nil {
+		t.Fatalf("could not bootstrap hydra: %v", err)
+	}
 
 	return ctx, f, b
 }
@@ -149,23 +152,27 @@ func TestIntegration(t *testing.T) {
 	})
 
 	t.Run("JWK", func(t *testing.T) {
-		var lastRedirect string
-		var errRedirect = errors.New("cancel redirect")
-		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-			lastRedirect = req.URL.String()
-			return errRedirect
-		}
-		defer func() {
-			client.CheckRedirect = nil
-		}()
-
 		for _, path := range []string{jwk.WellKnownKeysPath} {
-			_, err := client.Get(frontendts.URL + path)
-			if err == nil || !strings.Contains(err.Error(), errRedirect.Error()) {
+			res, err := client.Get(frontendts.URL + path)
+			if err != nil {
 				t.Fatalf("could not get to endpoint %s due to error %v", path, err)
 			}
-			if want := fmt.Sprintf("https://www.googleapis.com/service_accounts/v1/jwk/%s", jConfig.ServiceAccount); lastRedirect != want {
-				t.Errorf("wanted %s, got %s", want, lastRedirect)
+
+			var keys jose.JSONWebKeySet
+			err = json.NewDecoder(res.Body).Decode(&keys)
+			res.Body.Close()
+			if err != nil {
+				t.Fatalf("could not decode the key set: %v", err)
+			}
+
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("expected status code %d, got %d", http.StatusOK, res.StatusCode)
+			}
+			if len(keys.Keys) == 0 {
+				t.Errorf("expected the service account keys to be served")
+			}
+			if !strings.HasPrefix(res.Header.Get("Cache-Control"), "public, max-age=") {
+				t.Errorf("unexpected Cache-Control header %s", res.Header.Get("Cache-Control"))
 			}
 		}
 	})
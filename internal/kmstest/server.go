@@ -0,0 +1,374 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kmstest provides an in-memory fake of the Cloud KMS REST API for use in tests.
+package kmstest
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/cloudkms/v1"
+)
+
+const (
+	// RSASignPKCS1 is the KMS algorithm for RS256 signatures
+	RSASignPKCS1 = "RSA_SIGN_PKCS1_2048_SHA256"
+	// RSASignPSS is the KMS algorithm for PS256 signatures
+	RSASignPSS = "RSA_SIGN_PSS_2048_SHA256"
+	// ECSignP256 is the KMS algorithm for ES256 signatures
+	ECSignP256 = "EC_SIGN_P256_SHA256"
+	// SymmetricEncryption is the KMS algorithm of symmetric encryption keys
+	SymmetricEncryption = "GOOGLE_SYMMETRIC_ENCRYPTION"
+
+	// StateEnabled is the state of a key version that may be used
+	StateEnabled = "ENABLED"
+	// StateDisabled is the state of a key version that may not be used
+	StateDisabled = "DISABLED"
+)
+
+type keyVersion struct {
+	name      string
+	algorithm string
+	state     string
+	signer    crypto.Signer
+	aead      cipher.AEAD
+}
+
+// Server is a fake Cloud KMS server holding keys in memory
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	versions map[string]*keyVersion
+	counts   map[string]int
+	// primaries holds the name of the primary version of symmetric crypto keys
+	primaries map[string]string
+}
+
+// NewServer starts a new fake Cloud KMS server, it should be closed when no longer needed
+func NewServer() *Server {
+	s := &Server{
+		versions:  make(map[string]*keyVersion),
+		counts:    make(map[string]int),
+		primaries: make(map[string]string),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Client returns an *http.Client sending every request to this server regardless of its host, it may be used as the
+// OAuth2HTTPClient of gcpjwt configurations.
+func (s *Server) Client() *http.Client {
+	target, _ := url.Parse(s.URL)
+	return &http.Client{Transport: &rewriteTransport{target: target, base: s.Server.Client().Transport}}
+}
+
+// AddAsymmetricKeyVersion creates a new enabled version of cryptoKey using algorithm and returns its name
+func (s *Server) AddAsymmetricKeyVersion(cryptoKey, algorithm string) (string, error) {
+	var signer crypto.Signer
+	var err error
+	switch algorithm {
+	case RSASignPKCS1, RSASignPSS:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case ECSignP256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return "", fmt.Errorf("kmstest: unsupported algorithm %s", algorithm)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counts[cryptoKey]++
+	name := fmt.Sprintf("%s/cryptoKeyVersions/%d", cryptoKey, s.counts[cryptoKey])
+	s.versions[name] = &keyVersion{name: name, algorithm: algorithm, state: StateEnabled, signer: signer}
+	return name, nil
+}
+
+// AddSymmetricKeyVersion creates a new enabled version of cryptoKey for symmetric encryption, makes it the primary
+// version and returns its name
+func (s *Server) AddSymmetricKeyVersion(cryptoKey string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counts[cryptoKey]++
+	name := fmt.Sprintf("%s/cryptoKeyVersions/%d", cryptoKey, s.counts[cryptoKey])
+	s.versions[name] = &keyVersion{name: name, algorithm: SymmetricEncryption, state: StateEnabled, aead: aead}
+	s.primaries[cryptoKey] = name
+	return name, nil
+}
+
+// SetState changes the state of a key version, e.g. to StateDisabled
+func (s *Server) SetState(version, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.versions[version]; ok {
+		v.state = state
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/publicKey"):
+		s.getPublicKey(w, strings.TrimSuffix(path, "/publicKey"))
+	case r.Method == http.MethodPost && strings.HasSuffix(path, ":asymmetricSign"):
+		s.asymmetricSign(w, r, strings.TrimSuffix(path, ":asymmetricSign"))
+	case r.Method == http.MethodPost && strings.HasSuffix(path, ":encrypt"):
+		s.encrypt(w, r, strings.TrimSuffix(path, ":encrypt"))
+	case r.Method == http.MethodPost && strings.HasSuffix(path, ":decrypt"):
+		s.decrypt(w, r, strings.TrimSuffix(path, ":decrypt"))
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/cryptoKeyVersions"):
+		s.listVersions(w, strings.TrimSuffix(path, "/cryptoKeyVersions"))
+	default:
+		writeError(w, http.StatusNotFound, "unknown method "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *Server) getVersion(name string) (*keyVersion, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.versions[name]
+	return v, ok
+}
+
+func (s *Server) getPublicKey(w http.ResponseWriter, name string) {
+	v, ok := s.getVersion(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, name+" not found")
+		return
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(v.signer.Public())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, &cloudkms.PublicKey{
+		Algorithm: v.algorithm,
+		Pem:       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	})
+}
+
+func (s *Server) asymmetricSign(w http.ResponseWriter, r *http.Request, name string) {
+	v, ok := s.getVersion(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, name+" not found")
+		return
+	} else if v.state != StateEnabled {
+		writeError(w, http.StatusBadRequest, name+" is not enabled")
+		return
+	}
+
+	var req cloudkms.AsymmetricSignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Digest == nil {
+		writeError(w, http.StatusBadRequest, "invalid sign request")
+		return
+	}
+	digest, err := base64.StdEncoding.DecodeString(req.Digest.Sha256)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var signature []byte
+	switch key := v.signer.(type) {
+	case *rsa.PrivateKey:
+		if v.algorithm == RSASignPSS {
+			signature, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, key, digest); err == nil {
+			signature, err = asn1.Marshal(struct{ R, S *big.Int }{r, s})
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, &cloudkms.AsymmetricSignResponse{Signature: base64.StdEncoding.EncodeToString(signature)})
+}
+
+// encrypt encrypts with the primary version of the crypto key name, the name of the version is prepended to the
+// ciphertext so decrypt can find it
+func (s *Server) encrypt(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	v, ok := s.versions[s.primaries[name]]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, name+" has no primary version")
+		return
+	} else if v.state != StateEnabled {
+		writeError(w, http.StatusBadRequest, v.name+" is not enabled")
+		return
+	}
+
+	var req cloudkms.EncryptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid encrypt request")
+		return
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(req.Plaintext)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	aad, err := base64.StdEncoding.DecodeString(req.AdditionalAuthenticatedData)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ciphertext := append([]byte(v.name+"\x00"), nonce...)
+	ciphertext = v.aead.Seal(ciphertext, nonce, plaintext, aad)
+
+	writeJSON(w, &cloudkms.EncryptResponse{Name: v.name, Ciphertext: base64.StdEncoding.EncodeToString(ciphertext)})
+}
+
+// decrypt decrypts a ciphertext returned by encrypt with any enabled version of the crypto key name
+func (s *Server) decrypt(w http.ResponseWriter, r *http.Request, name string) {
+	var req cloudkms.DecryptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid decrypt request")
+		return
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(req.Ciphertext)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	aad, err := base64.StdEncoding.DecodeString(req.AdditionalAuthenticatedData)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	idx := strings.IndexByte(string(ciphertext), 0)
+	if idx < 0 || !strings.HasPrefix(string(ciphertext[:idx]), name+"/cryptoKeyVersions/") {
+		writeError(w, http.StatusBadRequest, "the ciphertext was not encrypted with "+name)
+		return
+	}
+	v, ok := s.getVersion(string(ciphertext[:idx]))
+	if !ok {
+		writeError(w, http.StatusNotFound, string(ciphertext[:idx])+" not found")
+		return
+	} else if v.state != StateEnabled {
+		writeError(w, http.StatusBadRequest, v.name+" is not enabled")
+		return
+	}
+
+	sealed := ciphertext[idx+1:]
+	if len(sealed) < v.aead.NonceSize() {
+		writeError(w, http.StatusBadRequest, "the ciphertext is too short")
+		return
+	}
+	plaintext, err := v.aead.Open(nil, sealed[:v.aead.NonceSize()], sealed[v.aead.NonceSize():], aad)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "the ciphertext could not be decrypted")
+		return
+	}
+
+	writeJSON(w, &cloudkms.DecryptResponse{Plaintext: base64.StdEncoding.EncodeToString(plaintext)})
+}
+
+func (s *Server) listVersions(w http.ResponseWriter, cryptoKey string) {
+	s.mu.Lock()
+	var versions []*cloudkms.CryptoKeyVersion
+	for name, v := range s.versions {
+		if strings.HasPrefix(name, cryptoKey+"/cryptoKeyVersions/") {
+			versions = append(versions, &cloudkms.CryptoKeyVersion{Name: v.name, Algorithm: v.algorithm, State: v.state})
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Name < versions[j].Name })
+	writeJSON(w, &cloudkms.ListCryptoKeyVersionsResponse{CryptoKeyVersions: versions, TotalSize: int64(len(versions))})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message},
+	})
+}
+
+type rewriteTransport struct {
+	target *url.URL
+	base   http.RoundTripper
+}
+
+func (t *rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	req := r.WithContext(r.Context())
+	u := *r.URL
+	u.Scheme = t.target.Scheme
+	u.Host = t.target.Host
+	req.URL = &u
+	req.Host = t.target.Host
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,127 @@
+package invalidation
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Event tells that a Datastore entity was created, changed or deleted
+type Event struct {
+	// Kind of the entity, e.g. HydraClient
+	Kind string `json:"kind"`
+	// Namespace of the entity, several Hydra instances may share a Transport
+	Namespace string `json:"namespace,omitempty"`
+	// ID of the entity, e.g. the client ID
+	ID string `json:"id"`
+	// Origin is the ID of the Bus the event was published on
+	Origin string `json:"origin"`
+}
+
+// Handler is called with the events a Bus was subscribed to
+type Handler func(ctx context.Context, e Event)
+
+// Transport carries events between the replicas of a deployment
+type Transport interface {
+	// Publish sends e to every replica, including the one publishing it
+	Publish(ctx context.Context, e Event) error
+	// Subscribe calls h with the events published by any replica from now on, until ctx is done. It returns once
+	// events are being received.
+	Subscribe(ctx context.Context, h Handler) error
+}
+
+type subscription struct {
+	kind      string
+	namespace string
+}
+
+// DefaultPublishTimeout is how long publishing an event to the other replicas may take
+const DefaultPublishTimeout = 10 * time.Second
+
+// Bus dispatches the changes of Datastore entities to the caches of every replica. Events are dispatched to the
+// handlers of the publishing replica right away, and to the ones of the other replicas once Start was called on them.
+// Every replica is expected to subscribe to the same kinds, only the events of kinds subscribed to are published.
+type Bus struct {
+	// PublishTimeout is how long publishing an event to the other replicas may take, defaults to
+	// DefaultPublishTimeout
+	PublishTimeout time.Duration
+
+	transport Transport
+	origin    string
+	l         logrus.FieldLogger
+	pending   sync.WaitGroup
+
+	mu       sync.RWMutex
+	handlers map[subscription][]Handler
+}
+
+// NewBus returns a Bus carrying events over transport
+func NewBus(transport Transport, l logrus.FieldLogger) *Bus {
+	return &Bus{
+		PublishTimeout: DefaultPublishTimeout,
+		transport:      transport,
+		origin:         uuid.New(),
+		l:              l,
+		handlers:       make(map[subscription][]Handler),
+	}
+}
+
+// Subscribe calls h with the events of entities of kind in namespace
+func (b *Bus) Subscribe(kind, namespace string, h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := subscription{kind: kind, namespace: namespace}
+	b.handlers[key] = append(b.handlers[key], h)
+}
+
+// Publish tells every replica that the entity of kind in namespace identified by id changed. The handlers of this
+// replica are called before it returns, the event is published to the other replicas in the background so the change
+// is not held up by the transport, nor is publishing cancelled with ctx. A failure to reach the other replicas is
+// logged rather than returned, the change was already made.
+func (b *Bus) Publish(ctx context.Context, kind, namespace, id string) {
+	e := Event{Kind: kind, Namespace: namespace, ID: id, Origin: b.origin}
+	b.dispatch(ctx, e)
+
+	// The other replicas may subscribe to kinds this one does not, e.g. when it only writes
+	b.pending.Add(1)
+	go func() {
+		defer b.pending.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.PublishTimeout)
+		defer cancel()
+		if err := b.transport.Publish(ctx, e); err != nil {
+			b.l.WithError(err).WithField("kind", kind).WithField("id", id).Errorf("Could not publish invalidation event")
+		}
+	}()
+}
+
+// Wait blocks until the events published so far were sent to the other replicas or failed to, e.g. before the
+// transport is stopped
+func (b *Bus) Wait() {
+	b.pending.Wait()
+}
+
+// Start dispatches the events published by the other replicas until ctx is done
+func (b *Bus) Start(ctx context.Context) error {
+	return b.transport.Subscribe(ctx, func(ctx context.Context, e Event) {
+		// Events published by this Bus were already dispatched
+		if e.Origin != b.origin {
+			b.dispatch(ctx, e)
+		}
+	})
+}
+
+// dispatch calls the handlers subscribed to e
+func (b *Bus) dispatch(ctx context.Context, e Event) {
+	b.mu.RLock()
+	handlers := b.handlers[subscription{kind: e.Kind, namespace: e.Namespace}]
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(ctx, e)
+	}
+}
@@ -0,0 +1,191 @@
+package invalidation
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/client"
+	"github.com/sirupsen/logrus"
+
+	dclient "github.com/someone1/hydra-gcp/client"
+)
+
+// recorder records the IDs of the events it handles
+type recorder struct {
+	sync.Mutex
+	ids []string
+}
+
+func (r *recorder) handle(_ context.Context, e Event) {
+	r.Lock()
+	defer r.Unlock()
+	r.ids = append(r.ids, e.ID)
+}
+
+// got returns the IDs handled in order, events from other replicas may arrive after later local ones
+func (r *recorder) got() []string {
+	r.Lock()
+	defer r.Unlock()
+	ids := append([]string{}, r.ids...)
+	sort.Strings(ids)
+	return ids
+}
+
+func TestBus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transport := NewMemoryTransport()
+	replica1 := NewBus(transport, logrus.New())
+	replica2 := NewBus(transport, logrus.New())
+	for _, b := range []*Bus{replica1, replica2} {
+		if err := b.Start(ctx); err != nil {
+			t.Fatalf("could not start bus: %v", err)
+		}
+	}
+
+	var clients1, clients2, otherNamespace recorder
+	replica1.Subscribe("HydraClient", "tenant", clients1.handle)
+	replica2.Subscribe("HydraClient", "tenant", clients2.handle)
+	replica2.Subscribe("HydraClient", "other", otherNamespace.handle)
+
+	replica1.Publish(ctx, "HydraClient", "tenant", "client-1")
+	replica1.Publish(ctx, "HydraJWK", "tenant", "hydra.openid.id-token")
+	replica2.Publish(ctx, "HydraClient", "tenant", "client-2")
+	replica1.Wait()
+	replica2.Wait()
+
+	for name, tt := range map[string]struct {
+		r    *recorder
+		want []string
+	}{
+		"publishing replica": {&clients1, []string{"client-1", "client-2"}},
+		"receiving replica":  {&clients2, []string{"client-1", "client-2"}},
+		"other namespace":    {&otherNamespace, nil},
+	} {
+		if got := tt.r.got(); len(got) != len(tt.want) || (len(got) > 0 && (got[0] != tt.want[0] || got[1] != tt.want[1])) {
+			t.Errorf("%s: expected events %v, got %v", name, tt.want, got)
+		}
+	}
+
+	// A stopped replica only sees its own events
+	cancel()
+	var stopped recorder
+	stoppedCtx, stop := context.WithCancel(context.Background())
+	replica3 := NewBus(transport, logrus.New())
+	replica3.Subscribe("HydraClient", "tenant", stopped.handle)
+	if err := replica3.Start(stoppedCtx); err != nil {
+		t.Fatalf("could not start bus: %v", err)
+	}
+	stop()
+	replica3.Publish(context.Background(), "HydraClient", "tenant", "own")
+
+	// Unsubscribing happens in the background, wait for it before publishing from another replica
+	for {
+		transport.mu.RLock()
+		n := len(transport.handlers)
+		transport.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	replica1.Publish(context.Background(), "HydraClient", "tenant", "missed")
+	replica1.Wait()
+	if got := stopped.got(); len(got) != 1 || got[0] != "own" {
+		t.Errorf("expected only the own event to be handled, got %v", got)
+	}
+}
+
+func TestBusInvalidatesClientCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The memory manager stands for the Datastore shared by both replicas
+	store := client.NewMemoryManager(&fosite.BCrypt{WorkFactor: 4})
+	transport := NewMemoryTransport()
+
+	var caches []*dclient.CachingManager
+	var buses []*Bus
+	for i := 0; i < 2; i++ {
+		cache := dclient.NewCachingManager(store, dclient.CacheOptions{})
+		bus := NewBus(transport, logrus.New())
+		bus.Subscribe(dclient.ClientKind, "", func(ctx context.Context, e Event) {
+			cache.Invalidate(ctx, e.ID)
+		})
+		if err := bus.Start(ctx); err != nil {
+			t.Fatalf("could not start bus: %v", err)
+		}
+		caches, buses = append(caches, cache), append(buses, bus)
+	}
+
+	if err := caches[0].CreateClient(ctx, &client.Client{ClientID: "shared", Name: "before"}); err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	if c, err := caches[1].GetConcreteClient(ctx, "shared"); err != nil || c.Name != "before" {
+		t.Fatalf("unexpected lookup %+v: %v", c, err)
+	}
+
+	if err := caches[0].UpdateClient(ctx, &client.Client{ClientID: "shared", Name: "after"}); err != nil {
+		t.Fatalf("could not update client: %v", err)
+	}
+	if c, _ := caches[1].GetConcreteClient(ctx, "shared"); c.Name != "before" {
+		t.Fatalf("expected the second replica to serve its cached client until invalidated, got %+v", c)
+	}
+
+	buses[0].Publish(ctx, dclient.ClientKind, "", "shared")
+	buses[0].Wait()
+	if c, _ := caches[1].GetConcreteClient(ctx, "shared"); c.Name != "after" {
+		t.Errorf("expected the second replica to observe the update, got %+v", c)
+	}
+}
+
+// countingTransport records the events published and the error of the context they were published with
+type countingTransport struct {
+	sync.Mutex
+	events []Event
+	errs   []error
+}
+
+func (c *countingTransport) Publish(ctx context.Context, e Event) error {
+	c.Lock()
+	defer c.Unlock()
+	c.events = append(c.events, e)
+	c.errs = append(c.errs, ctx.Err())
+	return nil
+}
+
+func (c *countingTransport) Subscribe(context.Context, Handler) error {
+	return nil
+}
+
+func TestBusPublish(t *testing.T) {
+	transport := &countingTransport{}
+	bus := NewBus(transport, logrus.New())
+	var clients recorder
+	bus.Subscribe("HydraClient", "", clients.handle)
+
+	// The change is published once the request it was made for is done
+	ctx, cancel := context.WithCancel(context.Background())
+	bus.Publish(ctx, "HydraClient", "", "client-1")
+	cancel()
+	// Nothing subscribes to consent sessions here, other replicas may
+	bus.Publish(context.Background(), "HydraConsentRequestHandled", "", "challenge")
+	bus.Wait()
+
+	if got := clients.got(); len(got) != 1 || got[0] != "client-1" {
+		t.Errorf("expected the event to be dispatched locally, got %v", got)
+	}
+	if len(transport.events) != 2 {
+		t.Fatalf("expected every event to be published, got %v", transport.events)
+	}
+	for idx, err := range transport.errs {
+		if err != nil {
+			t.Errorf("expected %v not to be published with the request context, got %v", transport.events[idx], err)
+		}
+	}
+}
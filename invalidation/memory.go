@@ -0,0 +1,52 @@
+package invalidation
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryTransport is a Transport delivering events within the process, e.g. to several Buses standing for the
+// replicas of a deployment in tests.
+type MemoryTransport struct {
+	mu       sync.RWMutex
+	next     int
+	handlers map[int]Handler
+}
+
+// NewMemoryTransport returns an empty MemoryTransport
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{handlers: make(map[int]Handler)}
+}
+
+// Publish calls the handlers subscribed at this time with e
+func (m *MemoryTransport) Publish(ctx context.Context, e Event) error {
+	m.mu.RLock()
+	handlers := make([]Handler, 0, len(m.handlers))
+	for _, h := range m.handlers {
+		handlers = append(handlers, h)
+	}
+	m.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(ctx, e)
+	}
+	return nil
+}
+
+// Subscribe calls h with the events published from now on until ctx is done
+func (m *MemoryTransport) Subscribe(ctx context.Context, h Handler) error {
+	m.mu.Lock()
+	id := m.next
+	m.next++
+	m.handlers[id] = h
+	m.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.handlers, id)
+	}()
+	return nil
+}
@@ -0,0 +1,177 @@
+package invalidation
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	pubsubv1 "cloud.google.com/go/pubsub/apiv1"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// minRetention is the shortest retention Pub/Sub accepts, events are useless once the caches they invalidate
+	// expired
+	minRetention = 10 * time.Minute
+	// subscriptionExpiration is how long Pub/Sub keeps the subscription of a replica that stopped receiving without
+	// deleting it, e.g. one that crashed. It is the shortest expiration Pub/Sub accepts.
+	subscriptionExpiration = 24 * time.Hour
+	// subscribeTimeout is how long Subscribe waits for events to be received
+	subscribeTimeout = time.Minute
+	// probeKind is the kind of the events Subscribe publishes to find out when events are being received
+	probeKind = "invalidation.probe"
+)
+
+// PubSubTransport is a Transport over a Cloud Pub/Sub topic. Each replica receives the events from a subscription of
+// its own, so that every replica receives every event.
+type PubSubTransport struct {
+	topic        *pubsub.Topic
+	subscription *pubsub.Subscription
+	l            logrus.FieldLogger
+}
+
+// NewPubSubTransport returns a PubSubTransport publishing to topicID and receiving from subscriptionID, both are
+// created if they do not exist. subscriptionID must be unique to the replica, e.g. derived from GAE_INSTANCE, and
+// should be deleted with Delete when the replica shuts down, Pub/Sub deletes it after a day without receiving
+// otherwise. opts are used to create the subscription, they must authenticate like client.
+func NewPubSubTransport(ctx context.Context, client *pubsub.Client, topicID, subscriptionID string, l logrus.FieldLogger, opts ...option.ClientOption) (*PubSubTransport, error) {
+	topic := client.Topic(topicID)
+	if ok, err := topic.Exists(ctx); err != nil {
+		return nil, errors.WithStack(err)
+	} else if !ok {
+		if topic, err = client.CreateTopic(ctx, topicID); err != nil && status.Code(err) != codes.AlreadyExists {
+			return nil, errors.WithStack(err)
+		} else if err != nil {
+			topic = client.Topic(topicID)
+		}
+	}
+
+	subscription := client.Subscription(subscriptionID)
+	if ok, err := subscription.Exists(ctx); err != nil {
+		return nil, errors.WithStack(err)
+	} else if !ok {
+		if err := createSubscription(ctx, topic, subscription, opts); err != nil && status.Code(err) != codes.AlreadyExists {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return &PubSubTransport{topic: topic, subscription: subscription, l: l}, nil
+}
+
+// createSubscription creates subscription to topic with an expiration policy, which pubsub.SubscriptionConfig does not
+// support
+func createSubscription(ctx context.Context, topic *pubsub.Topic, subscription *pubsub.Subscription, opts []option.ClientOption) error {
+	if addr := os.Getenv("PUBSUB_EMULATOR_HOST"); addr != "" {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			return err
+		}
+		opts = []option.ClientOption{option.WithGRPCConn(conn)}
+	}
+
+	subscriber, err := pubsubv1.NewSubscriberClient(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	defer subscriber.Close()
+
+	_, err = subscriber.CreateSubscription(ctx, &pubsubpb.Subscription{
+		Name:  subscription.String(),
+		Topic: topic.String(),
+		// The default of Pub/Sub, messages are acknowledged as soon as they are received
+		AckDeadlineSeconds:       10,
+		MessageRetentionDuration: ptypes.DurationProto(minRetention),
+		ExpirationPolicy:         &pubsubpb.ExpirationPolicy{Ttl: ptypes.DurationProto(subscriptionExpiration)},
+	})
+	return err
+}
+
+// Publish publishes e to the topic, waiting for Pub/Sub to accept it
+func (p *PubSubTransport) Publish(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = p.topic.Publish(ctx, &pubsub.Message{Data: data}).Get(ctx)
+	return errors.WithStack(err)
+}
+
+// Subscribe receives the events of the subscription in the background until ctx is done. Pub/Sub does not tell when
+// messages start being pulled, so it publishes a probe event and returns once the probe is received.
+func (p *PubSubTransport) Subscribe(ctx context.Context, h Handler) error {
+	probe := uuid.New()
+	var once sync.Once
+	received := make(chan struct{})
+	stopped := make(chan error, 1)
+
+	rctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		err := p.subscription.Receive(rctx, func(ctx context.Context, msg *pubsub.Message) {
+			// Invalidations are idempotent and useless once late, so messages are never redelivered
+			msg.Ack()
+
+			var e Event
+			if err := json.Unmarshal(msg.Data, &e); err != nil {
+				p.l.WithError(err).Errorf("Could not decode invalidation event")
+				return
+			}
+			if e.Kind == probeKind {
+				// The probes of the other replicas are dropped
+				if e.ID == probe {
+					once.Do(func() { close(received) })
+				}
+				return
+			}
+			h(ctx, e)
+		})
+		if err != nil && rctx.Err() == nil {
+			p.l.WithError(err).Errorf("Stopped receiving invalidation events")
+		}
+		stopped <- err
+	}()
+
+	if err := p.Publish(ctx, Event{Kind: probeKind, ID: probe}); err != nil {
+		cancel()
+		return err
+	}
+
+	timer := time.NewTimer(subscribeTimeout)
+	defer timer.Stop()
+	select {
+	case <-received:
+		return nil
+	case err := <-stopped:
+		if err == nil {
+			err = errors.New("stopped receiving invalidation events")
+		}
+		return errors.WithStack(err)
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case <-timer.C:
+		cancel()
+		return errors.Errorf("no invalidation event was received within %s", subscribeTimeout)
+	}
+}
+
+// Delete deletes the subscription of the replica, the topic is left alone
+func (p *PubSubTransport) Delete(ctx context.Context) error {
+	return errors.WithStack(p.subscription.Delete(ctx))
+}
+
+// Stop sends the remaining published events and stops the publishing goroutines of the topic
+func (p *PubSubTransport) Stop() {
+	p.topic.Stop()
+}
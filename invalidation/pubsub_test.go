@@ -0,0 +1,75 @@
+package invalidation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	pubsubv1 "cloud.google.com/go/pubsub/apiv1"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc"
+)
+
+func TestPubSubTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := pstest.NewServer()
+	// The subscription is created with a connection of its own, it is closed once created
+	dial := func() option.ClientOption {
+		conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+		if err != nil {
+			t.Fatalf("could not dial the fake Pub/Sub: %v", err)
+		}
+		return option.WithGRPCConn(conn)
+	}
+
+	client, err := pubsub.NewClient(ctx, "project", dial())
+	if err != nil {
+		t.Fatalf("could not create the Pub/Sub client: %v", err)
+	}
+	transport, err := NewPubSubTransport(ctx, client, "invalidation", "replica", logrus.New(), dial())
+	if err != nil {
+		t.Fatalf("could not create the transport: %v", err)
+	}
+	defer transport.Stop()
+
+	subscriber, err := pubsubv1.NewSubscriberClient(ctx, dial())
+	if err != nil {
+		t.Fatalf("could not create the subscriber client: %v", err)
+	}
+	defer subscriber.Close()
+	sub, err := subscriber.GetSubscription(ctx, &pubsubpb.GetSubscriptionRequest{Subscription: "projects/project/subscriptions/replica"})
+	if err != nil {
+		t.Fatalf("could not get the subscription: %v", err)
+	}
+	if ttl, err := ptypes.Duration(sub.GetExpirationPolicy().GetTtl()); err != nil || ttl != subscriptionExpiration {
+		t.Errorf("expected the subscription to expire after %s, got %v: %v", subscriptionExpiration, ttl, err)
+	}
+
+	received := make(chan Event, 10)
+	if err := transport.Subscribe(ctx, func(_ context.Context, e Event) { received <- e }); err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	// The probe of another replica is not handled
+	if err := transport.Publish(ctx, Event{Kind: probeKind, ID: "other"}); err != nil {
+		t.Fatalf("could not publish the probe: %v", err)
+	}
+	if err := transport.Publish(ctx, Event{Kind: "HydraClient", ID: "client-1"}); err != nil {
+		t.Fatalf("could not publish: %v", err)
+	}
+	select {
+	case e := <-received:
+		if e.Kind != "HydraClient" || e.ID != "client-1" {
+			t.Errorf("expected the client event, got %+v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the event to be received")
+	}
+}
@@ -0,0 +1,95 @@
+package hydragcp
+
+import (
+	"context"
+	"time"
+
+	"github.com/ory/hydra/config"
+	"github.com/pkg/errors"
+
+	dclient "github.com/someone1/hydra-gcp/client"
+	dconsent "github.com/someone1/hydra-gcp/consent"
+	djwk "github.com/someone1/hydra-gcp/jwk"
+	doauth2 "github.com/someone1/hydra-gcp/oauth2"
+)
+
+// DefaultJanitorLifespans returns the lifespan of each OAuth2 session kind as configured for Hydra. Hydra has no
+// refresh token lifespan so refresh tokens are left out, set JanitorOptions.RefreshTokenLifespan to flush them. Their
+// tombstones are flushed after the RefreshTokenReuseWindow of the store.
+func DefaultJanitorLifespans(c *config.Config) map[doauth2.TokenKind]time.Duration {
+	return map[doauth2.TokenKind]time.Duration{
+		doauth2.AccessTokenKind:   c.GetAccessTokenLifespan(),
+		doauth2.AuthorizeCodeKind: c.GetAuthCodeLifespan(),
+		doauth2.PKCEKind:          c.GetAuthCodeLifespan(),
+		doauth2.OpenIDConnectKind: c.GetAuthCodeLifespan(),
+	}
+}
+
+// NewJanitor returns a Janitor for the Datastore backed store configured in c, it must be called after
+// GenerateIAMHydraHandler. DefaultJanitorLifespans are used if opts does not set any lifespans.
+func NewJanitor(c *config.Config, opts doauth2.JanitorOptions) (*doauth2.Janitor, error) {
+	store, ok := c.Context().FositeStore.(*doauth2.FositeDatastoreStore)
+	if !ok {
+		return nil, errors.Errorf("expected the fosite store to be a *FositeDatastoreStore, got %T instead", c.Context().FositeStore)
+	}
+
+	if opts.Lifespans == nil {
+		opts.Lifespans = DefaultJanitorLifespans(c)
+	}
+
+	return doauth2.NewJanitor(store, opts), nil
+}
+
+// StartJanitor will flush expired OAuth2 sessions from Datastore every interval in its own goroutine until ctx is done.
+func StartJanitor(ctx context.Context, c *config.Config, interval time.Duration, opts doauth2.JanitorOptions) (*doauth2.Janitor, error) {
+	janitor, err := NewJanitor(c, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	go janitor.Start(ctx, interval)
+	return janitor, nil
+}
+
+// FlushConsentRequests removes consent and login requests, and login sessions, that are no longer needed from the
+// Datastore backed consent manager configured in c. It must be called after GenerateIAMHydraHandler.
+func FlushConsentRequests(ctx context.Context, c *config.Config, opts dconsent.FlushOptions) (dconsent.FlushStats, error) {
+	manager, ok := c.Context().ConsentManager.(*dconsent.DatastoreManager)
+	if !ok {
+		return dconsent.FlushStats{}, errors.Errorf("expected the consent manager to be a *DatastoreManager, got %T instead", c.Context().ConsentManager)
+	}
+
+	return manager.FlushInactiveRequests(ctx, opts)
+}
+
+// StartSecretExpiryWatcher will call hook for every client secret of the Datastore backed client manager configured in
+// c expiring within notice, checking every interval in its own goroutine until ctx is done. It must be called after
+// GenerateIAMHydraHandler.
+func StartSecretExpiryWatcher(ctx context.Context, c *config.Config, interval, notice time.Duration, hook dclient.SecretExpiryHook) (*dclient.SecretExpiryWatcher, error) {
+	store, ok := c.Context().FositeStore.(*doauth2.FositeDatastoreStore)
+	if !ok {
+		return nil, errors.Errorf("expected the fosite store to be a *FositeDatastoreStore, got %T instead", c.Context().FositeStore)
+	}
+	manager, ok := dclient.AsDatastoreManager(store.Manager)
+	if !ok {
+		return nil, errors.Errorf("expected the client manager to be a *DatastoreManager, got %T instead", store.Manager)
+	}
+
+	watcher := dclient.NewSecretExpiryWatcher(manager, notice, c.GetLogger())
+	watcher.Subscribe(hook)
+	go watcher.Start(ctx, interval)
+	return watcher, nil
+}
+
+// StartKeyRotation will rotate the keys of the Datastore backed JWK manager configured in c following policy, checking
+// every interval in its own goroutine until ctx is done. It must be called after GenerateIAMHydraHandler.
+func StartKeyRotation(ctx context.Context, c *config.Config, interval time.Duration, policy djwk.KeyRotationPolicy) (*djwk.KeyRotationScheduler, error) {
+	manager, ok := c.Context().KeyManager.(*djwk.DatastoreManager)
+	if !ok {
+		return nil, errors.Errorf("expected the key manager to be a *DatastoreManager, got %T instead", c.Context().KeyManager)
+	}
+
+	scheduler := djwk.NewKeyRotationScheduler(manager, policy, c.GetLogger())
+	go scheduler.Start(ctx, interval)
+	return scheduler, nil
+}
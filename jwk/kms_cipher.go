@@ -0,0 +1,84 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwk
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/someone1/hydra-gcp/envelope"
+)
+
+// KMSCipher encrypts key material with a data key generated for every key and wrapped by a Cloud KMS symmetric crypto
+// key, so the keys cannot be read with the system secret alone. The crypto key version that wrapped the data key is
+// recorded on each entity.
+type KMSCipher struct {
+	encrypter *envelope.Encrypter
+}
+
+// NewKMSCipher returns a KMSCipher wrapping data keys with the crypto key at path cryptoKey, e.g.
+// projects/<project>/locations/<location>/keyRings/<keyring>/cryptoKeys/<key>. Requests are sent with client, the
+// default Google client is used if it is nil.
+func NewKMSCipher(ctx context.Context, cryptoKey string, client *http.Client) (*KMSCipher, error) {
+	wrapper, err := envelope.NewKMSKeyWrapper(ctx, cryptoKey, client)
+	if err != nil {
+		return nil, err
+	}
+	return newKMSCipher(wrapper), nil
+}
+
+func newKMSCipher(wrapper envelope.KeyWrapper) *KMSCipher {
+	encrypter := envelope.NewEncrypter(wrapper)
+	// A data key is generated for every key
+	encrypter.DataKeyLifetime = 0
+	return &KMSCipher{encrypter: encrypter}
+}
+
+// keyData returns the additional data authenticating the key material of j, so it cannot be moved to another key
+func keyData(j *jwkData) []byte {
+	return []byte(j.Set + "/" + j.KID)
+}
+
+// seal encrypts plaintext into the key data of j
+func (c *KMSCipher) seal(ctx context.Context, j *jwkData, plaintext []byte) error {
+	dataKey, err := c.encrypter.DataKey(ctx)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := dataKey.Seal(plaintext, keyData(j))
+	if err != nil {
+		return err
+	}
+
+	j.KeyData = base64.URLEncoding.EncodeToString(ciphertext)
+	j.KeyVersion, j.DataKey = dataKey.KeyID, dataKey.Wrapped
+	return nil
+}
+
+// open decrypts the key data of j sealed by seal
+func (c *KMSCipher) open(ctx context.Context, j *jwkData) ([]byte, error) {
+	ciphertext, err := base64.URLEncoding.DecodeString(j.KeyData)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dataKey, err := c.encrypter.OpenDataKey(ctx, j.KeyVersion, j.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	return dataKey.Open(ciphertext, keyData(j))
+}
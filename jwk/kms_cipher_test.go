@@ -0,0 +1,75 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwk
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/someone1/hydra-gcp/internal/kmstest"
+)
+
+const testCryptoKey = "projects/test/locations/global/keyRings/test/cryptoKeys/jwk"
+
+func newTestKMSCipher(t *testing.T) (*KMSCipher, *kmstest.Server, string) {
+	server := kmstest.NewServer()
+	version, err := server.AddSymmetricKeyVersion(testCryptoKey)
+	require.NoError(t, err)
+
+	cipher, err := NewKMSCipher(context.Background(), testCryptoKey, server.Client())
+	require.NoError(t, err)
+	return cipher, server, version
+}
+
+func TestKMSCipher(t *testing.T) {
+	ctx := context.Background()
+	cipher, server, version := newTestKMSCipher(t)
+	defer server.Close()
+
+	first := &jwkData{Set: "set", KID: "first"}
+	second := &jwkData{Set: "set", KID: "second"}
+	require.NoError(t, cipher.seal(ctx, first, []byte("private key")))
+	require.NoError(t, cipher.seal(ctx, second, []byte("private key")))
+
+	require.Equal(t, version, first.KeyVersion)
+	require.NotContains(t, first.KeyData, "private key")
+	require.False(t, bytes.Equal(first.DataKey, second.DataKey), "expected a data key for every key")
+
+	plaintext, err := cipher.open(ctx, first)
+	require.NoError(t, err)
+	require.Equal(t, "private key", string(plaintext))
+
+	// The key data cannot be moved to another key
+	moved := *first
+	moved.KID = "second"
+	_, err = cipher.open(ctx, &moved)
+	require.Error(t, err)
+
+	// Keys are still read after the crypto key was rotated, with a new cipher not holding the data keys
+	_, err = server.AddSymmetricKeyVersion(testCryptoKey)
+	require.NoError(t, err)
+	rotated, err := NewKMSCipher(ctx, testCryptoKey, server.Client())
+	require.NoError(t, err)
+	plaintext, err = rotated.open(ctx, second)
+	require.NoError(t, err)
+	require.Equal(t, "private key", string(plaintext))
+
+	third := &jwkData{Set: "set", KID: "third"}
+	require.NoError(t, rotated.seal(ctx, third, []byte("private key")))
+	require.NotEqual(t, version, third.KeyVersion)
+}
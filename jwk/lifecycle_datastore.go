@@ -0,0 +1,411 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwk
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/hydra/jwk"
+	"github.com/ory/hydra/pkg"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/someone1/hydra-gcp/dscon"
+)
+
+// KeyState is the lifecycle state of a key
+type KeyState string
+
+const (
+	// KeyStateNext keys are published ahead of the time they are used from, so relying parties have them cached by
+	// then
+	KeyStateNext KeyState = "next"
+	// KeyStateActive keys are used to sign, the newest one first. Keys added through the manager are active.
+	KeyStateActive KeyState = "active"
+	// KeyStateRetired keys are no longer used to sign but still published until they expire, so tokens signed by
+	// them can be verified
+	KeyStateRetired KeyState = "retired"
+	// KeyStateRevoked keys are no longer published
+	KeyStateRevoked KeyState = "revoked"
+)
+
+const (
+	// DefaultKeyLifetime is how long a key is active before it is retired by default
+	DefaultKeyLifetime = 30 * 24 * time.Hour
+	// DefaultKeyPrePublish is how long the next key is published before it becomes active by default
+	DefaultKeyPrePublish = 24 * time.Hour
+	// DefaultKeyGracePeriod is how long a retired key is still published by default
+	DefaultKeyGracePeriod = 24 * time.Hour
+)
+
+// stateRank orders the published keys, Hydra signs with the first key pair of a set
+var stateRank = map[KeyState]int{
+	KeyStateActive:  0,
+	KeyStateNext:    1,
+	KeyStateRetired: 2,
+}
+
+// published returns whether the key is valid to publish at now
+func (j *jwkData) published(now time.Time) bool {
+	if _, ok := stateRank[KeyState(j.State)]; !ok {
+		return false
+	}
+	return j.ExpiresAt.IsZero() || now.Before(j.ExpiresAt)
+}
+
+// publishedKeys returns the keys of ds valid to publish at now, active keys first, the order of ds is kept otherwise
+func publishedKeys(ds []jwkData, now time.Time) []jwkData {
+	published := make([]jwkData, 0, len(ds))
+	for i := range ds {
+		if ds[i].published(now) {
+			published = append(published, ds[i])
+		}
+	}
+	sort.SliceStable(published, func(i, k int) bool {
+		return stateRank[KeyState(published[i].State)] < stateRank[KeyState(published[k].State)]
+	})
+	return published
+}
+
+// keyPairID returns the ID shared by the public and private keys generated together, e.g. by a jwk.KeyGenerator
+func keyPairID(kid string) string {
+	for _, prefix := range []string{"public:", "private:"} {
+		if strings.HasPrefix(kid, prefix) {
+			return strings.TrimPrefix(kid, prefix)
+		}
+	}
+	return kid
+}
+
+// KeyRotationPolicy configures the rotation of a key set by ApplyKeyRotation
+type KeyRotationPolicy struct {
+	// Set is the key set rotated, jwk.IDTokenKeyName if empty
+	Set string
+	// Generator generates the key pairs, a jwk.RS256Generator if nil as Hydra signs ID Tokens with RS256
+	Generator jwk.KeyGenerator
+	// Lifetime is how long a key is active before the next one replaces it, DefaultKeyLifetime if zero
+	Lifetime time.Duration
+	// PrePublish is how long the next key is published before it becomes active, DefaultKeyPrePublish if zero
+	PrePublish time.Duration
+	// GracePeriod is how long a retired key is still published, DefaultKeyGracePeriod if zero. It should be longer
+	// than the ID Token lifespan plus the time relying parties cache the key set.
+	GracePeriod time.Duration
+}
+
+func (p KeyRotationPolicy) withDefaults() KeyRotationPolicy {
+	if p.Set == "" {
+		p.Set = jwk.IDTokenKeyName
+	}
+	if p.Generator == nil {
+		p.Generator = &jwk.RS256Generator{}
+	}
+	if p.Lifetime <= 0 {
+		p.Lifetime = DefaultKeyLifetime
+	}
+	if p.PrePublish <= 0 {
+		p.PrePublish = DefaultKeyPrePublish
+	}
+	if p.GracePeriod <= 0 {
+		p.GracePeriod = DefaultKeyGracePeriod
+	}
+	return p
+}
+
+// KeyRotationReport lists the key pairs, by the ID shared by their public and private keys, changed by
+// ApplyKeyRotation
+type KeyRotationReport struct {
+	Generated []string
+	Activated []string
+	Retired   []string
+}
+
+// Changed returns whether any key was changed
+func (r KeyRotationReport) Changed() bool {
+	return len(r.Generated)+len(r.Activated)+len(r.Retired) > 0
+}
+
+// keyPair is the public and private keys of a pair, they always share the same lifecycle
+type keyPair struct {
+	id       string
+	state    KeyState
+	entities []*jwkData
+}
+
+func (p *keyPair) notBefore() time.Time {
+	return p.entities[0].NotBefore
+}
+
+func (p *keyPair) set(state KeyState, notBefore, expiresAt time.Time) {
+	p.state = state
+	for _, entity := range p.entities {
+		entity.State = string(state)
+		entity.NotBefore = notBefore
+		entity.ExpiresAt = expiresAt
+	}
+}
+
+// rotationPlan is what planRotation decided to change in a key set
+type rotationPlan struct {
+	report KeyRotationReport
+	// changed are the stored keys to update
+	changed []*jwkData
+	// generateActive and generateNext are the not before times of the key pairs to generate, if not zero
+	generateActive time.Time
+	generateNext   time.Time
+}
+
+// planRotation decides which keys of ds to promote or retire at now to follow policy, and which key pairs to generate
+func planRotation(ds []jwkData, policy KeyRotationPolicy, now time.Time) rotationPlan {
+	var pairs []*keyPair
+	byID := make(map[string]*keyPair)
+	for i := range ds {
+		id := keyPairID(ds[i].KID)
+		pair, ok := byID[id]
+		if !ok {
+			pair = &keyPair{id: id, state: KeyState(ds[i].State)}
+			byID[id] = pair
+			pairs = append(pairs, pair)
+		}
+		pair.entities = append(pair.entities, &ds[i])
+	}
+
+	var current, next *keyPair
+	var active []*keyPair
+	for _, pair := range pairs {
+		if !pair.entities[0].published(now) {
+			continue
+		}
+		switch pair.state {
+		case KeyStateActive:
+			active = append(active, pair)
+			if current == nil || pair.notBefore().After(current.notBefore()) {
+				current = pair
+			}
+		case KeyStateNext:
+			if next == nil || pair.notBefore().Before(next.notBefore()) {
+				next = pair
+			}
+		}
+	}
+
+	var plan rotationPlan
+	changed := make(map[*keyPair]bool)
+	switch {
+	case next != nil && (current == nil || !now.Before(next.notBefore())):
+		// The next key replaces the active ones, right away if there is none, e.g. because it was revoked
+		notBefore := next.notBefore()
+		if now.Before(notBefore) {
+			notBefore = now
+		}
+		next.set(KeyStateActive, notBefore, time.Time{})
+		changed[next] = true
+		plan.report.Activated = append(plan.report.Activated, next.id)
+
+		for _, pair := range active {
+			pair.set(KeyStateRetired, pair.notBefore(), now.Add(policy.GracePeriod))
+			changed[pair] = true
+			plan.report.Retired = append(plan.report.Retired, pair.id)
+		}
+		current, next = next, nil
+	case current == nil:
+		plan.generateActive = now
+	}
+
+	if next == nil {
+		activeSince := now
+		if current != nil {
+			activeSince = current.notBefore()
+		}
+		if !now.Before(activeSince.Add(policy.Lifetime - policy.PrePublish)) {
+			// The next key is published for at least PrePublish, even if the rotation is late
+			plan.generateNext = activeSince.Add(policy.Lifetime)
+			if earliest := now.Add(policy.PrePublish); plan.generateNext.Before(earliest) {
+				plan.generateNext = earliest
+			}
+		}
+	}
+
+	for _, pair := range pairs {
+		if changed[pair] {
+			plan.changed = append(plan.changed, pair.entities...)
+		}
+	}
+	return plan
+}
+
+// ApplyKeyRotation moves the key set of policy one step forward in its lifecycle: the next key pair becomes active once
+// its not before time is reached and the active ones are retired, to be published for the grace period only. The
+// next key pair is generated PrePublish ahead of time, and an active one right away if the set has none. It is meant to
+// be called regularly, e.g. by a KeyRotationScheduler.
+func (d *DatastoreManager) ApplyKeyRotation(ctx context.Context, policy KeyRotationPolicy) (KeyRotationReport, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "ApplyKeyRotation", hydraJWKKind)
+	defer span.End()
+
+	policy = policy.withDefaults()
+	// Key pairs are generated once even if the transaction is retried
+	generated := make(map[KeyState]*jose.JSONWebKeySet)
+	generate := func(state KeyState) (*jose.JSONWebKeySet, error) {
+		if keys, ok := generated[state]; ok {
+			return keys, nil
+		}
+		keys, err := policy.Generator.Generate("", "sig")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		generated[state] = keys
+		return keys, nil
+	}
+
+	var report KeyRotationReport
+	_, err := dscon.RunInTransaction(ctx, d.client, func(tx *datastore.Transaction) error {
+		qry := datastore.NewQuery(hydraJWKKind).Namespace(d.namespace).Ancestor(d.generateJWKParentKey(policy.Set)).Transaction(tx)
+		var ds []jwkData
+		if _, err := d.client.GetAll(ctx, qry, &ds); err != nil {
+			return err
+		}
+
+		plan := planRotation(ds, policy, time.Now().UTC())
+		var mutations []*datastore.Mutation
+		for _, entity := range plan.changed {
+			mutations = append(mutations, datastore.NewUpdate(entity.Key, entity))
+		}
+
+		for state, notBefore := range map[KeyState]time.Time{KeyStateActive: plan.generateActive, KeyStateNext: plan.generateNext} {
+			if notBefore.IsZero() {
+				continue
+			}
+			keys, err := generate(state)
+			if err != nil {
+				return err
+			}
+			for i := range keys.Keys {
+				entity, err := d.newKeyEntity(ctx, policy.Set, &keys.Keys[i], d.Cipher)
+				if err != nil {
+					return err
+				}
+				entity.State, entity.NotBefore = string(state), notBefore
+				mutations = append(mutations, datastore.NewInsert(d.generateJWKKey(policy.Set, keys.Keys[i].KeyID), entity))
+			}
+			plan.report.Generated = append(plan.report.Generated, keyPairID(keys.Keys[0].KeyID))
+		}
+		sort.Strings(plan.report.Generated)
+
+		report = plan.report
+		if len(mutations) == 0 {
+			return nil
+		}
+		_, err := tx.Mutate(mutations...)
+		return err
+	})
+	if err != nil {
+		return KeyRotationReport{}, dscon.HandleError(err)
+	}
+
+	if report.Changed() {
+		d.changed(ctx, policy.Set)
+	}
+	return report, nil
+}
+
+// RevokeKey revokes the key kid of set and the other key of its pair, they are no longer published. If they were
+// active, the next call to ApplyKeyRotation activates the next key pair or generates one.
+func (d *DatastoreManager) RevokeKey(ctx context.Context, set, kid string) error {
+	ctx, span := d.tracer.StartSpan(ctx, "RevokeKey", hydraJWKKind)
+	defer span.End()
+
+	_, err := dscon.RunInTransaction(ctx, d.client, func(tx *datastore.Transaction) error {
+		qry := datastore.NewQuery(hydraJWKKind).Namespace(d.namespace).Ancestor(d.generateJWKParentKey(set)).Transaction(tx)
+		var ds []jwkData
+		if _, err := d.client.GetAll(ctx, qry, &ds); err != nil {
+			return err
+		}
+
+		var mutations []*datastore.Mutation
+		for i := range ds {
+			if keyPairID(ds[i].KID) != keyPairID(kid) {
+				continue
+			}
+			ds[i].State = string(KeyStateRevoked)
+			mutations = append(mutations, datastore.NewUpdate(ds[i].Key, &ds[i]))
+		}
+		if len(mutations) == 0 {
+			return errors.WithStack(pkg.ErrNotFound)
+		}
+
+		_, err := tx.Mutate(mutations...)
+		return err
+	})
+	if errors.Cause(err) == pkg.ErrNotFound {
+		return err
+	} else if err != nil {
+		return dscon.HandleError(err)
+	}
+
+	d.changed(ctx, set)
+	return nil
+}
+
+// KeyRotationScheduler applies a KeyRotationPolicy regularly
+type KeyRotationScheduler struct {
+	manager *DatastoreManager
+	policy  KeyRotationPolicy
+	l       logrus.FieldLogger
+	mu      sync.Mutex
+}
+
+// NewKeyRotationScheduler returns a KeyRotationScheduler rotating the keys of manager following policy
+func NewKeyRotationScheduler(manager *DatastoreManager, policy KeyRotationPolicy, l logrus.FieldLogger) *KeyRotationScheduler {
+	return &KeyRotationScheduler{
+		manager: manager,
+		policy:  policy.withDefaults(),
+		l:       l,
+	}
+}
+
+// Run applies the policy once
+func (s *KeyRotationScheduler) Run(ctx context.Context) (KeyRotationReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.manager.ApplyKeyRotation(ctx, s.policy)
+}
+
+// Start applies the policy every interval until ctx is done, interval should be a fraction of the PrePublish and
+// GracePeriod of the policy
+func (s *KeyRotationScheduler) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := s.Run(ctx)
+		if err != nil {
+			s.l.WithError(err).Errorf("Could not rotate the keys of set %s", s.policy.Set)
+		} else if report.Changed() {
+			s.l.WithField("set", s.policy.Set).Infof("Rotated keys, generated %v, activated %v and retired %v", report.Generated, report.Activated, report.Retired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
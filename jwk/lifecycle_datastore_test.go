@@ -0,0 +1,158 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/hydra/jwk"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyPair(id string, state KeyState, notBefore, expiresAt time.Time) []jwkData {
+	var ds []jwkData
+	for _, prefix := range []string{"public:", "private:"} {
+		ds = append(ds, jwkData{KID: prefix + id, State: string(state), NotBefore: notBefore, ExpiresAt: expiresAt})
+	}
+	return ds
+}
+
+func kids(ds []jwkData) []string {
+	var kids []string
+	for i := range ds {
+		kids = append(kids, ds[i].KID)
+	}
+	return kids
+}
+
+func TestPublishedKeys(t *testing.T) {
+	now := time.Now()
+	var ds []jwkData
+	ds = append(ds, testKeyPair("next", KeyStateNext, now.Add(time.Hour), time.Time{})...)
+	ds = append(ds, testKeyPair("active", KeyStateActive, now.Add(-time.Hour), time.Time{})...)
+	ds = append(ds, testKeyPair("retired", KeyStateRetired, now.Add(-2*time.Hour), now.Add(time.Hour))...)
+	ds = append(ds, testKeyPair("expired", KeyStateRetired, now.Add(-3*time.Hour), now.Add(-time.Hour))...)
+	ds = append(ds, testKeyPair("revoked", KeyStateRevoked, now.Add(-time.Hour), time.Time{})...)
+
+	require.Equal(t, []string{
+		"public:active", "private:active",
+		"public:next", "private:next",
+		"public:retired", "private:retired",
+	}, kids(publishedKeys(ds, now)))
+}
+
+func TestPlanRotation(t *testing.T) {
+	policy := KeyRotationPolicy{Lifetime: 10 * time.Hour, PrePublish: 2 * time.Hour, GracePeriod: time.Hour}.withDefaults()
+	now := time.Now()
+
+	// An empty set gets an active key pair
+	plan := planRotation(nil, policy, now)
+	require.Equal(t, now, plan.generateActive)
+	require.True(t, plan.generateNext.IsZero())
+
+	// The next key pair is generated PrePublish before the active one reaches its lifetime
+	ds := testKeyPair("active", KeyStateActive, now.Add(-7*time.Hour), time.Time{})
+	plan = planRotation(ds, policy, now)
+	require.False(t, plan.report.Changed())
+	require.True(t, plan.generateNext.IsZero())
+
+	plan = planRotation(ds, policy, now.Add(time.Hour))
+	require.Equal(t, now.Add(3*time.Hour), plan.generateNext)
+	require.True(t, plan.generateActive.IsZero())
+
+	// A late rotation still publishes the next key pair for PrePublish
+	plan = planRotation(ds, policy, now.Add(5*time.Hour))
+	require.Equal(t, now.Add(7*time.Hour), plan.generateNext)
+
+	// The next key pair replaces the active one at its not before time
+	ds = append(ds, testKeyPair("next", KeyStateNext, now.Add(3*time.Hour), time.Time{})...)
+	plan = planRotation(ds, policy, now.Add(time.Hour))
+	require.False(t, plan.report.Changed())
+	require.True(t, plan.generateNext.IsZero())
+
+	later := now.Add(3 * time.Hour)
+	plan = planRotation(ds, policy, later)
+	require.Equal(t, KeyRotationReport{Activated: []string{"next"}, Retired: []string{"active"}}, plan.report)
+	require.Len(t, plan.changed, 4)
+	for i := range ds {
+		switch keyPairID(ds[i].KID) {
+		case "active":
+			require.Equal(t, string(KeyStateRetired), ds[i].State)
+			require.Equal(t, later.Add(policy.GracePeriod), ds[i].ExpiresAt)
+		case "next":
+			require.Equal(t, string(KeyStateActive), ds[i].State)
+		}
+	}
+	require.True(t, plan.generateNext.IsZero())
+}
+
+func TestPlanRotationRevoked(t *testing.T) {
+	policy := KeyRotationPolicy{}.withDefaults()
+	now := time.Now()
+
+	// The next key pair is activated right away when there is no active one left
+	ds := testKeyPair("revoked", KeyStateRevoked, now.Add(-time.Hour), time.Time{})
+	ds = append(ds, testKeyPair("next", KeyStateNext, now.Add(time.Hour), time.Time{})...)
+	plan := planRotation(ds, policy, now)
+	require.Equal(t, []string{"next"}, plan.report.Activated)
+	require.Empty(t, plan.report.Retired)
+	require.Equal(t, now, ds[2].NotBefore)
+	require.True(t, plan.generateActive.IsZero())
+
+	// Or a new active key pair is generated
+	plan = planRotation(ds[:2], policy, now)
+	require.Equal(t, now, plan.generateActive)
+}
+
+func TestManagerKeyRotation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("requires the Datastore emulator")
+	}
+
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, "jwk-test")
+	require.NoError(t, err)
+	m := NewDatastoreManager(client, "jwk-lifecycle-test", &jwk.AEAD{Key: encryptionKey})
+
+	policy := KeyRotationPolicy{Set: "TestManagerKeyRotation", Generator: &jwk.ECDSA256Generator{}, Lifetime: time.Hour, PrePublish: 2 * time.Hour}
+	report, err := m.ApplyKeyRotation(ctx, policy)
+	require.NoError(t, err)
+	// The lifetime is shorter than the pre publication, so the next key pair is generated right away
+	require.Len(t, report.Generated, 2)
+
+	keys, err := m.GetKeySet(ctx, policy.Set)
+	require.NoError(t, err)
+	require.Len(t, keys.Keys, 4)
+	active := keyPairID(keys.Keys[0].KeyID)
+
+	// Revoking the active key pair activates the next one
+	require.NoError(t, m.RevokeKey(ctx, policy.Set, keys.Keys[0].KeyID))
+	report, err = m.ApplyKeyRotation(ctx, policy)
+	require.NoError(t, err)
+	require.Len(t, report.Activated, 1)
+	require.NotEqual(t, active, report.Activated[0])
+
+	keys, err = m.GetKeySet(ctx, policy.Set)
+	require.NoError(t, err)
+	for _, key := range keys.Keys {
+		require.NotEqual(t, active, keyPairID(key.KeyID))
+	}
+	require.Equal(t, report.Activated[0], keyPairID(keys.Keys[0].KeyID))
+
+	require.NoError(t, m.DeleteKeySet(ctx, policy.Set))
+}
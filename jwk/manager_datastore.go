@@ -27,6 +27,8 @@ import (
 	"github.com/ory/hydra/pkg"
 	"github.com/pkg/errors"
 	"gopkg.in/square/go-jose.v2"
+
+	"github.com/someone1/hydra-gcp/dscon"
 )
 
 var (
@@ -36,7 +38,10 @@ var (
 
 const (
 	hydraJWKKind = "HydraJWK"
-	jwkVersion   = 1
+	jwkVersion   = 2
+
+	// KeyKind is the Datastore kind of keys, the kind of the changes reported to OnChange
+	KeyKind = hydraJWKKind
 )
 
 type jwkData struct {
@@ -48,6 +53,16 @@ type jwkData struct {
 	KeyData          string         `datastore:"keydata,noindex"`
 	DatastoreVersion int            `datastore:"v"`
 
+	// KeyVersion and DataKey identify the data key KeyData is sealed with if it was encrypted by a KMSCipher,
+	// KeyVersion is the crypto key version that wrapped the data key
+	KeyVersion string `datastore:"kv,noindex"`
+	DataKey    []byte `datastore:"dk,noindex"`
+
+	// State is the KeyState of the key, it is published from NotBefore if it is the next key and until ExpiresAt if set
+	State     string    `datastore:"state,noindex"`
+	NotBefore time.Time `datastore:"nbf,noindex"`
+	ExpiresAt time.Time `datastore:"exp,noindex"`
+
 	update bool `datastore:"-"`
 }
 
@@ -71,13 +86,11 @@ func (j *jwkData) Load(ps []datastore.Property) error {
 	case jwkVersion:
 		// Up to date, nothing to do
 		break
-	// case 1:
-	// 	// Update to version 2 here
-	// 	h.Active = true
-	// 	fallthrough
-	// case 2:
-	// 	//update to version 3 here
-	// 	fallthrough
+	case 1:
+		// Keys stored before lifecycle states were all in use
+		j.State = string(KeyStateActive)
+		j.NotBefore = j.CreatedAt
+		fallthrough
 	case -1:
 		// This is here to complete saving the entity should we need to udpate it
 		if j.DatastoreVersion == -1 {
@@ -97,6 +110,12 @@ func (j *jwkData) Save() ([]datastore.Property, error) {
 	if j.CreatedAt.IsZero() {
 		j.CreatedAt = time.Now()
 	}
+	if j.State == "" {
+		j.State = string(KeyStateActive)
+	}
+	if j.NotBefore.IsZero() {
+		j.NotBefore = j.CreatedAt
+	}
 
 	if j.Set == "" || j.KID == "" || j.KeyData == "" {
 		return nil, errors.New("Missing sid, kid, or keydata")
@@ -110,6 +129,7 @@ func NewDatastoreManager(client *datastore.Client, namespace string, cipher *jwk
 		Cipher:    cipher,
 		client:    client,
 		namespace: namespace,
+		tracer:    dscon.NewTracer("jwk", namespace),
 	}
 }
 
@@ -117,6 +137,29 @@ type DatastoreManager struct {
 	client    *datastore.Client
 	namespace string
 	Cipher    *jwk.AEAD
+	// KMSCipher encrypts the keys added from now on instead of Cipher if set. Keys are read whichever of the two
+	// encrypted them.
+	KMSCipher *KMSCipher
+	tracer    dscon.Tracer
+	// onChange are called with the name of every key set changed
+	onChange []func(ctx context.Context, set string)
+}
+
+// EnableTracing starts a span for every operation of the manager from now on
+func (d *DatastoreManager) EnableTracing() {
+	d.tracer.Enabled = true
+}
+
+// OnChange registers f to be called with the name of every key set a key was added to or deleted from through the
+// manager. It must be called before the manager is used.
+func (d *DatastoreManager) OnChange(f func(ctx context.Context, set string)) {
+	d.onChange = append(d.onChange, f)
+}
+
+func (d *DatastoreManager) changed(ctx context.Context, set string) {
+	for _, f := range d.onChange {
+		f(ctx, set)
+	}
 }
 
 func (d *DatastoreManager) generateJWKParentKey(sid string) *datastore.Key {
@@ -132,31 +175,65 @@ func (d *DatastoreManager) generateJWKKey(sid, kid string) *datastore.Key {
 	return key
 }
 
-func (d *DatastoreManager) generateKeyInsertMutation(set string, key *jose.JSONWebKey, cipher *jwk.AEAD) (*datastore.Mutation, error) {
-	out, err := json.Marshal(key)
+func (d *DatastoreManager) generateKeyInsertMutation(ctx context.Context, set string, key *jose.JSONWebKey, cipher *jwk.AEAD) (*datastore.Mutation, error) {
+	entity, err := d.newKeyEntity(ctx, set, key, cipher)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
+	return datastore.NewInsert(d.generateJWKKey(set, key.KeyID), entity), nil
+}
 
-	encrypted, err := cipher.Encrypt(out)
+// newKeyEntity returns the entity of key with its key material encrypted
+func (d *DatastoreManager) newKeyEntity(ctx context.Context, set string, key *jose.JSONWebKey, cipher *jwk.AEAD) (*jwkData, error) {
+	out, err := json.Marshal(key)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	datastoreKey := d.generateJWKKey(set, key.KeyID)
-
 	entity := &jwkData{
 		Set:     set,
 		KID:     key.KeyID,
 		Version: 0,
-		KeyData: encrypted,
 	}
 
-	return datastore.NewInsert(datastoreKey, entity), nil
+	if d.KMSCipher != nil {
+		if err := d.KMSCipher.seal(ctx, entity, out); err != nil {
+			return nil, err
+		}
+	} else if entity.KeyData, err = cipher.Encrypt(out); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return entity, nil
+}
+
+// decryptKey decrypts the key of entity with the cipher that encrypted it
+func (d *DatastoreManager) decryptKey(ctx context.Context, entity *jwkData) (*jose.JSONWebKey, error) {
+	var key []byte
+	var err error
+	if entity.KeyVersion == "" {
+		key, err = d.Cipher.Decrypt(entity.KeyData)
+	} else if d.KMSCipher == nil {
+		return nil, errors.Errorf("key %s of set %s is encrypted with Cloud KMS but no KMSCipher is configured", entity.KID, entity.Set)
+	} else {
+		key, err = d.KMSCipher.open(ctx, entity)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var c jose.JSONWebKey
+	if err := json.Unmarshal(key, &c); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &c, nil
 }
 
 func (d *DatastoreManager) AddKey(ctx context.Context, set string, key *jose.JSONWebKey) error {
-	mutation, err := d.generateKeyInsertMutation(set, key, d.Cipher)
+	ctx, span := d.tracer.StartSpan(ctx, "AddKey", hydraJWKKind)
+	defer span.End()
+
+	mutation, err := d.generateKeyInsertMutation(ctx, set, key, d.Cipher)
 	if err != nil {
 		return err
 	}
@@ -167,11 +244,15 @@ func (d *DatastoreManager) AddKey(ctx context.Context, set string, key *jose.JSO
 		return errors.WithStack(err)
 	}
 
+	d.changed(ctx, set)
 	return nil
 }
 
 func (d *DatastoreManager) AddKeySet(ctx context.Context, set string, keys *jose.JSONWebKeySet) error {
-	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+	ctx, span := d.tracer.StartSpan(ctx, "AddKeySet", hydraJWKKind)
+	defer span.End()
+
+	_, err := dscon.RunInTransaction(ctx, d.client, func(tx *datastore.Transaction) error {
 		return d.addKeySet(ctx, tx, d.Cipher, set, keys)
 	})
 
@@ -179,6 +260,7 @@ func (d *DatastoreManager) AddKeySet(ctx context.Context, set string, keys *jose
 		return errors.WithStack(err)
 	}
 
+	d.changed(ctx, set)
 	return nil
 }
 
@@ -186,7 +268,7 @@ func (d *DatastoreManager) addKeySet(ctx context.Context, tx *datastore.Transact
 	var mutations []*datastore.Mutation
 
 	for _, key := range keys.Keys {
-		mutation, err := d.generateKeyInsertMutation(set, &key, cipher)
+		mutation, err := d.generateKeyInsertMutation(ctx, set, &key, cipher)
 		if err != nil {
 			return err
 		}
@@ -198,6 +280,9 @@ func (d *DatastoreManager) addKeySet(ctx context.Context, tx *datastore.Transact
 }
 
 func (d *DatastoreManager) GetKey(ctx context.Context, set, kid string) (*jose.JSONWebKeySet, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "GetKey", hydraJWKKind)
+	defer span.End()
+
 	var entity jwkData
 	datastoreKey := d.generateJWKKey(set, kid)
 
@@ -206,22 +291,20 @@ func (d *DatastoreManager) GetKey(ctx context.Context, set, kid string) (*jose.J
 		return nil, errors.WithStack(pkg.ErrNotFound)
 	}
 
-	key, err := d.Cipher.Decrypt(entity.KeyData)
+	c, err := d.decryptKey(ctx, &entity)
 	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	var c jose.JSONWebKey
-	if err := json.Unmarshal(key, &c); err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
 
 	return &jose.JSONWebKeySet{
-		Keys: []jose.JSONWebKey{c},
+		Keys: []jose.JSONWebKey{*c},
 	}, nil
 }
 
 func (d *DatastoreManager) GetKeySet(ctx context.Context, set string) (*jose.JSONWebKeySet, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "GetKeySet", hydraJWKKind)
+	defer span.End()
+
 	var ds []jwkData
 	parentKey := d.generateJWKParentKey(set)
 
@@ -234,28 +317,29 @@ func (d *DatastoreManager) GetKeySet(ctx context.Context, set string) (*jose.JSO
 		return nil, errors.Wrap(pkg.ErrNotFound, "")
 	}
 
+	// Only the keys valid to publish are returned, active ones first as Hydra signs with the first key of the set
+	ds = publishedKeys(ds, time.Now())
 	keys := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{}}
-	for _, j := range ds {
-		key, err := d.Cipher.Decrypt(j.KeyData)
+	for i := range ds {
+		c, err := d.decryptKey(ctx, &ds[i])
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, err
 		}
-
-		var c jose.JSONWebKey
-		if err := json.Unmarshal(key, &c); err != nil {
-			return nil, errors.WithStack(err)
-		}
-		keys.Keys = append(keys.Keys, c)
+		keys.Keys = append(keys.Keys, *c)
 	}
 
 	if len(keys.Keys) == 0 {
 		return nil, errors.WithStack(pkg.ErrNotFound)
 	}
 
+	dscon.SetEntityCount(span, len(keys.Keys))
 	return keys, nil
 }
 
 func (d *DatastoreManager) DeleteKey(ctx context.Context, set, kid string) error {
+	ctx, span := d.tracer.StartSpan(ctx, "DeleteKey", hydraJWKKind)
+	defer span.End()
+
 	datastoreKey := d.generateJWKKey(set, kid)
 	if err := d.client.Delete(ctx, datastoreKey); err == datastore.ErrNoSuchEntity {
 		return errors.WithStack(pkg.ErrNotFound)
@@ -263,17 +347,23 @@ func (d *DatastoreManager) DeleteKey(ctx context.Context, set, kid string) error
 		return errors.WithStack(err)
 	}
 
+	d.changed(ctx, set)
 	return nil
 }
 
 func (d *DatastoreManager) DeleteKeySet(ctx context.Context, set string) error {
-	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+	ctx, span := d.tracer.StartSpan(ctx, "DeleteKeySet", hydraJWKKind)
+	defer span.End()
+
+	_, err := dscon.RunInTransaction(ctx, d.client, func(tx *datastore.Transaction) error {
 		return d.deleteKeySet(ctx, tx, set)
 	})
 
 	if err != nil {
 		return errors.WithStack(err)
 	}
+
+	d.changed(ctx, set)
 	return nil
 }
 
@@ -287,49 +377,3 @@ func (d *DatastoreManager) deleteKeySet(ctx context.Context, tx *datastore.Trans
 
 	return tx.DeleteMulti(keys)
 }
-
-// This is iffy - this is a special hydra case from the cli only - will it even work?
-// func (d *DatastoreManager) RotateKeys(new *AEAD) error {
-// 	sids := make([]string, 0)
-// 	if err := m.DB.Select(&sids, "SELECT sid FROM hydra_jwk GROUP BY sid"); err != nil {
-// 		return sqlcon.HandleError(err)
-// 	}
-
-// 	sets := make([]jose.JSONWebKeySet, 0)
-// 	for _, sid := range sids {
-// 		set, err := m.GetKeySet(context.TODO(), sid)
-// 		if err != nil {
-// 			return errors.WithStack(err)
-// 		}
-// 		sets = append(sets, *set)
-// 	}
-
-// 	tx, err := m.DB.Beginx()
-// 	if err != nil {
-// 		return errors.WithStack(err)
-// 	}
-
-// 	for k, set := range sets {
-// 		if err := m.deleteKeySet(context.TODO(), tx, sids[k]); err != nil {
-// 			if re := tx.Rollback(); re != nil {
-// 				return errors.Wrap(err, re.Error())
-// 			}
-// 			return sqlcon.HandleError(err)
-// 		}
-
-// 		if err := m.addKeySet(context.TODO(), tx, new, sids[k], &set); err != nil {
-// 			if re := tx.Rollback(); re != nil {
-// 				return errors.Wrap(err, re.Error())
-// 			}
-// 			return sqlcon.HandleError(err)
-// 		}
-// 	}
-
-// 	if err := tx.Commit(); err != nil {
-// 		if re := tx.Rollback(); re != nil {
-// 			return errors.Wrap(err, re.Error())
-// 		}
-// 		return sqlcon.HandleError(err)
-// 	}
-// 	return nil
-// }
@@ -32,6 +32,7 @@ import (
 	"cloud.google.com/go/datastore"
 	. "github.com/ory/hydra/jwk"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
 )
 
 var managers = map[string]Manager{}
@@ -77,29 +78,131 @@ func TestManagerKeySet(t *testing.T) {
 	}
 }
 
-// func TestManagerRotate(t *testing.T) {
-// 	ks, err := testGenerator.Generate("TestManagerRotate", "sig")
-// 	require.NoError(t, err)
+func TestManagerOnChange(t *testing.T) {
+	if testing.Short() {
+		t.Skip("requires the Datastore emulator")
+	}
+
+	ks, err := testGenerator.Generate("TestManagerOnChange", "sig")
+	require.NoError(t, err)
+
+	client, err := datastore.NewClient(context.Background(), "jwk-test")
+	require.NoError(t, err)
+	m := NewDatastoreManager(client, "jwk-test", &AEAD{Key: encryptionKey})
 
-// 	newKey, _ := RandomBytes(32)
-// 	newCipher := &AEAD{Key: newKey}
+	var changed []string
+	m.OnChange(func(_ context.Context, set string) {
+		changed = append(changed, set)
+	})
+
+	require.NoError(t, m.AddKeySet(context.TODO(), "TestManagerOnChange", ks))
+	require.NoError(t, m.DeleteKey(context.TODO(), "TestManagerOnChange", ks.Keys[0].KeyID))
+	require.NoError(t, m.DeleteKeySet(context.TODO(), "TestManagerOnChange"))
+	require.Equal(t, []string{"TestManagerOnChange", "TestManagerOnChange", "TestManagerOnChange"}, changed)
+
+	_, err = m.GetKeySet(context.TODO(), "TestManagerOnChange")
+	require.Error(t, err)
+	require.Len(t, changed, 3)
+}
+
+func TestManagerRotateKeys(t *testing.T) {
+	if testing.Short() {
+		t.Skip("requires the Datastore emulator")
+	}
 
-// 	for name, m := range managers {
-// 		t.Run(fmt.Sprintf("manager=%s", name), func(t *testing.T) {
-// 			require.NoError(t, m.AddKeySet(context.TODO(), "TestManagerRotate", ks))
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, "jwk-test")
+	require.NoError(t, err)
+	m := NewDatastoreManager(client, "jwk-rotate-test", &AEAD{Key: encryptionKey})
+
+	sets := map[string]*jose.JSONWebKeySet{}
+	for _, set := range []string{"TestManagerRotateKeys-a", "TestManagerRotateKeys-b", "TestManagerRotateKeys-c"} {
+		ks, err := testGenerator.Generate(set, "sig")
+		require.NoError(t, err)
+		require.NoError(t, m.AddKeySet(ctx, set, ks))
+		sets[set] = ks
+	}
 
-// 			require.NoError(t, m.RotateKeys(newCipher))
+	newKey, _ := RandomBytes(32)
+	newCipher := &AEAD{Key: newKey}
 
-// 			_, err = m.GetKeySet(context.TODO(), "TestManagerRotate")
-// 			require.Error(t, err)
+	// Interrupt a first run after the first set was rotated and checkpointed, and the second one rotated
+	_, _, err = m.rotateKeySet(ctx, "TestManagerRotateKeys-a", newCipher)
+	require.NoError(t, err)
+	_, err = client.Put(ctx, m.rotationCheckpointKey(newCipher), &rotationCheckpoint{Set: "TestManagerRotateKeys-a"})
+	require.NoError(t, err)
+	_, _, err = m.rotateKeySet(ctx, "TestManagerRotateKeys-b", newCipher)
+	require.NoError(t, err)
 
-// 			m.Cipher = newCipher
-// 			got, err := m.GetKeySet(context.TODO(), "TestManagerRotate")
-// 			require.NoError(t, err)
+	var changed []string
+	m.OnChange(func(_ context.Context, set string) {
+		changed = append(changed, set)
+	})
 
-// 			for _, key := range ks.Keys {
-// 				require.EqualValues(t, ks.Key(key.KeyID), got.Key(key.KeyID))
-// 			}
-// 		})
-// 	}
-// }
+	stats, err := m.RotateKeysWithStats(ctx, newCipher)
+	require.NoError(t, err)
+	require.Equal(t, RotateStats{Sets: 2, Rotated: 2, Skipped: 2}, stats)
+	require.Equal(t, []string{"TestManagerRotateKeys-c"}, changed)
+
+	var checkpoint rotationCheckpoint
+	require.Equal(t, datastore.ErrNoSuchEntity, client.Get(ctx, m.rotationCheckpointKey(newCipher), &checkpoint))
+
+	_, err = m.GetKeySet(ctx, "TestManagerRotateKeys-a")
+	require.Error(t, err)
+
+	m.Cipher = newCipher
+	for set, ks := range sets {
+		got, err := m.GetKeySet(ctx, set)
+		require.NoError(t, err)
+		for _, key := range ks.Keys {
+			require.EqualValues(t, ks.Key(key.KeyID), got.Key(key.KeyID))
+		}
+	}
+}
+
+func TestManagerKMSCipher(t *testing.T) {
+	if testing.Short() {
+		t.Skip("requires the Datastore emulator")
+	}
+
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, "jwk-test")
+	require.NoError(t, err)
+	m := NewDatastoreManager(client, "jwk-kms-test", &AEAD{Key: encryptionKey})
+
+	legacy, err := testGenerator.Generate("legacy", "sig")
+	require.NoError(t, err)
+	require.NoError(t, m.AddKeySet(ctx, "TestManagerKMSCipher", legacy))
+
+	cipher, server, version := newTestKMSCipher(t)
+	defer server.Close()
+	m.KMSCipher = cipher
+
+	kms, err := testGenerator.Generate("kms", "sig")
+	require.NoError(t, err)
+	require.NoError(t, m.AddKeySet(ctx, "TestManagerKMSCipher", kms))
+
+	var entity jwkData
+	require.NoError(t, client.Get(ctx, m.generateJWKKey("TestManagerKMSCipher", kms.Keys[0].KeyID), &entity))
+	require.Equal(t, version, entity.KeyVersion)
+
+	// Keys encrypted by either cipher are read
+	got, err := m.GetKeySet(ctx, "TestManagerKMSCipher")
+	require.NoError(t, err)
+	require.Len(t, got.Keys, len(legacy.Keys)+len(kms.Keys))
+	for _, ks := range []*jose.JSONWebKeySet{legacy, kms} {
+		for _, key := range ks.Keys {
+			require.EqualValues(t, ks.Key(key.KeyID), got.Key(key.KeyID))
+		}
+	}
+
+	// Rotating the system secret leaves the keys encrypted by Cloud KMS alone
+	newKey, _ := RandomBytes(32)
+	stats, err := m.RotateKeysWithStats(ctx, &AEAD{Key: newKey})
+	require.NoError(t, err)
+	require.Equal(t, RotateStats{Sets: 1, Rotated: len(legacy.Keys), Skipped: len(kms.Keys)}, stats)
+
+	m.KMSCipher = nil
+	_, err = m.GetKey(ctx, "TestManagerKMSCipher", kms.Keys[0].KeyID)
+	require.Error(t, err)
+}
@@ -0,0 +1,191 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/hydra/jwk"
+	"github.com/pkg/errors"
+
+	"github.com/someone1/hydra-gcp/dscon"
+)
+
+const hydraJWKRotationKind = "HydraJWKRotation"
+
+// RotateStats reports what RotateKeysWithStats did
+type RotateStats struct {
+	// Sets is the number of key sets walked, sets completed by a previous run are not counted
+	Sets int
+	// Rotated is the number of keys encrypted again with the new cipher
+	Rotated int
+	// Skipped is the number of keys already encrypted with the new cipher, e.g. by an interrupted run, or encrypted by a
+	// KMSCipher
+	Skipped int
+}
+
+// rotationCheckpoint records the last key set rotated to a cipher, so an interrupted rotation resumes after it
+type rotationCheckpoint struct {
+	Set       string    `datastore:"set,noindex"`
+	UpdatedAt time.Time `datastore:"uat,noindex"`
+}
+
+// rotationCheckpointKey returns the key of the checkpoint of the rotation to new, named after a fingerprint of its key
+// so the checkpoint of another rotation is never resumed
+func (d *DatastoreManager) rotationCheckpointKey(new *jwk.AEAD) *datastore.Key {
+	sum := sha256.Sum256(new.Key)
+	key := datastore.NameKey(hydraJWKRotationKind, hex.EncodeToString(sum[:8]), nil)
+	key.Namespace = d.namespace
+	return key
+}
+
+// RotateKeys decrypts every key with the manager's Cipher and encrypts it again with new, see RotateKeysWithStats
+func (d *DatastoreManager) RotateKeys(ctx context.Context, new *jwk.AEAD) error {
+	_, err := d.RotateKeysWithStats(ctx, new)
+	return err
+}
+
+// RotateKeysWithStats decrypts every key with the manager's Cipher and encrypts it again with new, e.g. when changing
+// the system secret. Key sets are rotated one after the other, in transactions of at most dscon.MaxBatchSize keys, and
+// a checkpoint is saved after each of them. Running the rotation again after an error resumes after the last set
+// completed, keys already encrypted with new and keys encrypted by a KMSCipher are skipped. The manager keeps using its
+// Cipher afterwards.
+func (d *DatastoreManager) RotateKeysWithStats(ctx context.Context, new *jwk.AEAD) (RotateStats, error) {
+	ctx, span := d.tracer.StartSpan(ctx, "RotateKeysWithStats", hydraJWKKind)
+	defer span.End()
+
+	var stats RotateStats
+	checkpointKey := d.rotationCheckpointKey(new)
+	var checkpoint rotationCheckpoint
+	if err := d.client.Get(ctx, checkpointKey, &checkpoint); err != nil && err != datastore.ErrNoSuchEntity {
+		return stats, dscon.HandleError(err)
+	}
+
+	sets, err := d.keySets(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	for _, set := range sets {
+		// Sets are walked in key order
+		if checkpoint.Set != "" && set <= checkpoint.Set {
+			continue
+		}
+
+		rotated, skipped, err := d.rotateKeySet(ctx, set, new)
+		stats.Rotated += rotated
+		stats.Skipped += skipped
+		if err != nil {
+			return stats, err
+		}
+		stats.Sets++
+		if rotated > 0 {
+			d.changed(ctx, set)
+		}
+
+		checkpoint = rotationCheckpoint{Set: set, UpdatedAt: time.Now().UTC()}
+		if _, err := d.client.Put(ctx, checkpointKey, &checkpoint); err != nil {
+			return stats, dscon.HandleError(err)
+		}
+	}
+
+	if err := d.client.Delete(ctx, checkpointKey); err != nil {
+		return stats, dscon.HandleError(err)
+	}
+	dscon.SetEntityCount(span, stats.Rotated)
+	return stats, nil
+}
+
+// keySets returns the names of every key set, the distinct parents of the keys, in key order
+func (d *DatastoreManager) keySets(ctx context.Context) ([]string, error) {
+	qry := datastore.NewQuery(hydraJWKKind).Namespace(d.namespace).KeysOnly()
+	keys, err := d.client.GetAll(ctx, qry, nil)
+	if err != nil {
+		return nil, dscon.HandleError(err)
+	}
+
+	// The keys of a set are next to each other
+	var sets []string
+	for _, key := range keys {
+		if key.Parent == nil {
+			continue
+		}
+		if len(sets) == 0 || sets[len(sets)-1] != key.Parent.Name {
+			sets = append(sets, key.Parent.Name)
+		}
+	}
+	return sets, nil
+}
+
+// rotateKeySet encrypts the keys of set with new and returns how many keys were rotated and skipped
+func (d *DatastoreManager) rotateKeySet(ctx context.Context, set string, new *jwk.AEAD) (int, int, error) {
+	qry := datastore.NewQuery(hydraJWKKind).Namespace(d.namespace).Ancestor(d.generateJWKParentKey(set)).KeysOnly()
+	keys, err := d.client.GetAll(ctx, qry, nil)
+	if err != nil {
+		return 0, 0, dscon.HandleError(err)
+	}
+
+	var rotated, skipped int
+	for _, chunk := range dscon.ChunkKeys(keys, 0) {
+		var chunkRotated, chunkSkipped int
+		_, err := dscon.RunInTransaction(ctx, d.client, func(tx *datastore.Transaction) error {
+			chunkRotated, chunkSkipped = 0, 0
+			entities := make([]jwkData, len(chunk))
+			if err := tx.GetMulti(chunk, entities); err != nil {
+				return err
+			}
+
+			var mutations []*datastore.Mutation
+			for i := range entities {
+				// Keys encrypted by a KMSCipher do not depend on the system secret
+				if entities[i].KeyVersion != "" {
+					chunkSkipped++
+					continue
+				}
+
+				plaintext, err := d.Cipher.Decrypt(entities[i].KeyData)
+				if err != nil {
+					if _, nerr := new.Decrypt(entities[i].KeyData); nerr == nil {
+						chunkSkipped++
+						continue
+					}
+					return errors.Wrapf(err, "could not decrypt key %s of set %s", entities[i].KID, set)
+				}
+
+				if entities[i].KeyData, err = new.Encrypt(plaintext); err != nil {
+					return errors.WithStack(err)
+				}
+				mutations = append(mutations, datastore.NewUpdate(chunk[i], &entities[i]))
+				chunkRotated++
+			}
+			if len(mutations) == 0 {
+				return nil
+			}
+
+			_, terr := tx.Mutate(mutations...)
+			return terr
+		})
+		if err != nil {
+			return rotated, skipped, dscon.HandleError(err)
+		}
+		rotated += chunkRotated
+		skipped += chunkSkipped
+	}
+	return rotated, skipped, nil
+}
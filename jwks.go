@@ -0,0 +1,231 @@
+package hydragcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ory/hydra/jwk"
+	"github.com/ory/hydra/pkg"
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// defaultJWKSMaxAge is how long a key set is cached when its source does not say otherwise
+	defaultJWKSMaxAge = 5 * time.Minute
+	// DefaultJWKSRefreshTimeout is how long fetching a key set may take by default
+	DefaultJWKSRefreshTimeout = 10 * time.Second
+	// googleJWKSURL is where Google publishes the public keys of a service account
+	googleJWKSURL = "https://www.googleapis.com/service_accounts/v1/jwk/%s"
+)
+
+// KeySetSource fetches a JSON Web Key Set along with how long it may be cached for
+type KeySetSource interface {
+	FetchKeySet(ctx context.Context) (*jose.JSONWebKeySet, time.Duration, error)
+}
+
+// JWKSOptions configures a JWKSHandler
+type JWKSOptions struct {
+	// KeyManager, if set, is used to merge the public keys of Hydra's own hydra.openid.id-token key set into the
+	// served key set.
+	KeyManager jwk.Manager
+	// StaleWhileRevalidate is how long an expired key set is still served while it is fetched again in the
+	// background. It is also served for that long if fetching it fails, e.g. during an outage of the source.
+	StaleWhileRevalidate time.Duration
+	// RefreshTimeout is how long fetching the key set may take, defaults to DefaultJWKSRefreshTimeout
+	RefreshTimeout time.Duration
+}
+
+// JWKSHandler serves a JSON Web Key Set fetched from a KeySetSource, caching it for as long as the source allows.
+type JWKSHandler struct {
+	source KeySetSource
+	opts   JWKSOptions
+
+	mu         sync.Mutex
+	keys       *jose.JSONWebKeySet
+	expires    time.Time
+	refreshing bool
+}
+
+// NewJWKSHandler returns a JWKSHandler serving the key set of source
+func NewJWKSHandler(source KeySetSource, opts JWKSOptions) *JWKSHandler {
+	return &JWKSHandler{source: source, opts: opts}
+}
+
+// NewServiceAccountJWKSHandler returns a JWKSHandler serving the public keys Google publishes for serviceAccount,
+// fetched with client (http.DefaultClient if nil).
+func NewServiceAccountJWKSHandler(serviceAccount string, client *http.Client, opts JWKSOptions) *JWKSHandler {
+	return NewJWKSHandler(&RemoteKeySetSource{URL: serviceAccountJWKSURL(serviceAccount), Client: client}, opts)
+}
+
+func serviceAccountJWKSURL(serviceAccount string) string {
+	return fmt.Sprintf(googleJWKSURL, serviceAccount)
+}
+
+// KeySet returns the cached key set of the source, fetching it if needed, merged with Hydra's ID Token keys.
+func (j *JWKSHandler) KeySet(ctx context.Context) (*jose.JSONWebKeySet, time.Duration, error) {
+	keys, maxAge, err := j.sourceKeySet(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if j.opts.KeyManager == nil {
+		return keys, maxAge, nil
+	}
+
+	idTokenKeys, err := j.opts.KeyManager.GetKeySet(ctx, jwk.IDTokenKeyName)
+	if errors.Cause(err) == pkg.ErrNotFound {
+		return keys, maxAge, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	merged := &jose.JSONWebKeySet{Keys: append([]jose.JSONWebKey{}, keys.Keys...)}
+	if public, err := jwk.FindKeysByPrefix(idTokenKeys, "public"); err == nil {
+		merged.Keys = append(merged.Keys, public.Keys...)
+	}
+	return merged, maxAge, nil
+}
+
+func (j *JWKSHandler) sourceKeySet(ctx context.Context) (*jose.JSONWebKeySet, time.Duration, error) {
+	j.mu.Lock()
+	keys, expires := j.keys, j.expires
+	now := time.Now()
+
+	switch {
+	case keys != nil && now.Before(expires):
+		j.mu.Unlock()
+		return keys, expires.Sub(now), nil
+	case keys != nil && now.Before(expires.Add(j.opts.StaleWhileRevalidate)):
+		if !j.refreshing {
+			j.refreshing = true
+			go j.refreshInBackground()
+		}
+		j.mu.Unlock()
+		return keys, 0, nil
+	}
+	j.mu.Unlock()
+
+	if err := j.refresh(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.keys, time.Until(j.expires), nil
+}
+
+// refreshInBackground refreshes the key set while the stale one is served, failures are left to the next request
+func (j *JWKSHandler) refreshInBackground() {
+	defer func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.refreshing = false
+	}()
+
+	j.refresh(context.Background())
+}
+
+func (j *JWKSHandler) refresh(ctx context.Context) error {
+	timeout := j.opts.RefreshTimeout
+	if timeout <= 0 {
+		timeout = DefaultJWKSRefreshTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	keys, maxAge, err := j.source.FetchKeySet(ctx)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys, j.expires = keys, time.Now().Add(maxAge)
+	return nil
+}
+
+// ServeHTTP serves the key set, telling clients how long they may cache it for
+func (j *JWKSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	keys, maxAge, err := j.KeySet(r.Context())
+	if err != nil {
+		http.Error(w, "could not fetch the JSON Web Key Set", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RemoteKeySetSource fetches a JSON Web Key Set over HTTP, honouring the Cache-Control and Expires headers of the
+// response.
+type RemoteKeySetSource struct {
+	URL string
+	// Client is used to fetch the key set, http.DefaultClient is used if nil
+	Client *http.Client
+}
+
+// FetchKeySet is implemented for the KeySetSource interface
+func (s *RemoteKeySetSource) FetchKeySet(ctx context.Context) (*jose.JSONWebKeySet, time.Duration, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf("expected status code %d when fetching %s, got %d", http.StatusOK, s.URL, resp.StatusCode)
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	return &keys, cacheMaxAge(resp.Header, time.Now()), nil
+}
+
+// cacheMaxAge returns how long a response may be cached for according to its headers
+func cacheMaxAge(h http.Header, now time.Time) time.Duration {
+	if cc := h.Get("Cache-Control"); cc != "" {
+		for _, directive := range strings.Split(cc, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			switch {
+			case directive == "no-store" || directive == "no-cache":
+				return 0
+			case strings.HasPrefix(directive, "max-age="):
+				if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && seconds >= 0 {
+					return time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+
+	if expires := h.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			if t.Before(now) {
+				return 0
+			}
+			return t.Sub(now)
+		}
+	}
+
+	return defaultJWKSMaxAge
+}
@@ -0,0 +1,247 @@
+// Copyright © 2018 Prateek Malhotra (someone1@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hydragcp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ory/hydra/jwk"
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+)
+
+type fakeKeySetSource struct {
+	mu      sync.Mutex
+	keys    *jose.JSONWebKeySet
+	maxAge  time.Duration
+	err     error
+	fetches int
+	// hang makes fetches wait for their context to be done
+	hang bool
+}
+
+func (f *fakeKeySetSource) FetchKeySet(ctx context.Context) (*jose.JSONWebKeySet, time.Duration, error) {
+	f.mu.Lock()
+	f.fetches++
+	keys, maxAge, err, hang := f.keys, f.maxAge, f.err, f.hang
+	f.mu.Unlock()
+
+	if hang {
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return keys, maxAge, nil
+}
+
+func (f *fakeKeySetSource) setHang(hang bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hang = hang
+}
+
+func (f *fakeKeySetSource) set(maxAge time.Duration, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxAge, f.err = maxAge, err
+}
+
+func (f *fakeKeySetSource) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetches
+}
+
+func generateTestKeySet(t *testing.T, id string) *jose.JSONWebKeySet {
+	t.Helper()
+	keys, err := (&jwk.RS256Generator{}).Generate(id, "sig")
+	if err != nil {
+		t.Fatalf("could not generate keys: %v", err)
+	}
+	return keys
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"none", http.Header{}, defaultJWKSMaxAge},
+		{"maxAge", http.Header{"Cache-Control": {"public, max-age=3600, must-revalidate"}}, time.Hour},
+		{"noStore", http.Header{"Cache-Control": {"no-store"}}, 0},
+		{"invalidMaxAge", http.Header{"Cache-Control": {"max-age=soon"}}, defaultJWKSMaxAge},
+		{"expires", http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, time.Hour},
+		{"expired", http.Header{"Expires": {now.Add(-time.Hour).UTC().Format(http.TimeFormat)}}, 0},
+		{"maxAgeOverExpires", http.Header{"Cache-Control": {"max-age=60"}, "Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Expires only has a precision of a second
+			if got := cacheMaxAge(tt.header, now); got < tt.want-time.Second || got > tt.want {
+				t.Errorf("cacheMaxAge() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteKeySetSource(t *testing.T) {
+	keys := generateTestKeySet(t, "remote")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=120")
+		json.NewEncoder(w).Encode(keys)
+	}))
+	defer server.Close()
+
+	fetched, maxAge, err := (&RemoteKeySetSource{URL: server.URL}).FetchKeySet(context.Background())
+	if err != nil {
+		t.Fatalf("could not fetch key set: %v", err)
+	}
+	if maxAge != 2*time.Minute {
+		t.Errorf("expected a max age of 2m, got %s", maxAge)
+	}
+	if len(fetched.Key("public:remote")) != 1 {
+		t.Errorf("expected the remote key in the key set")
+	}
+}
+
+func TestJWKSHandler(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Cache", func(t *testing.T) {
+		source := &fakeKeySetSource{keys: generateTestKeySet(t, "cache"), maxAge: time.Hour}
+		handler := NewJWKSHandler(source, JWKSOptions{})
+
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, jwk.WellKnownKeysPath, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+			if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=3599" && cc != "public, max-age=3600" {
+				t.Errorf("unexpected Cache-Control header %s", cc)
+			}
+		}
+		if source.count() != 1 {
+			t.Errorf("expected the key set to be fetched once, got %d", source.count())
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		source := &fakeKeySetSource{keys: generateTestKeySet(t, "expired")}
+		handler := NewJWKSHandler(source, JWKSOptions{})
+
+		if _, _, err := handler.KeySet(ctx); err != nil {
+			t.Fatal(err)
+		}
+		source.set(0, errors.New("outage"))
+		if _, _, err := handler.KeySet(ctx); err == nil {
+			t.Errorf("expected an error without stale-while-revalidate")
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, jwk.WellKnownKeysPath, nil))
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("expected status 502, got %d", w.Code)
+		}
+	})
+
+	t.Run("StaleWhileRevalidate", func(t *testing.T) {
+		source := &fakeKeySetSource{keys: generateTestKeySet(t, "stale"), err: nil}
+		handler := NewJWKSHandler(source, JWKSOptions{StaleWhileRevalidate: time.Hour})
+
+		if _, _, err := handler.KeySet(ctx); err != nil {
+			t.Fatal(err)
+		}
+		source.set(0, errors.New("outage"))
+
+		keys, maxAge, err := handler.KeySet(ctx)
+		if err != nil {
+			t.Fatalf("expected the stale key set to be served, got %v", err)
+		}
+		if maxAge != 0 || len(keys.Key("public:stale")) != 1 {
+			t.Errorf("unexpected stale key set with max age %s", maxAge)
+		}
+
+		// The refresh happens in the background
+		for i := 0; i < 100 && source.count() < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if source.count() < 2 {
+			t.Errorf("expected the key set to be fetched again in the background")
+		}
+	})
+
+	t.Run("RefreshTimeout", func(t *testing.T) {
+		source := &fakeKeySetSource{keys: generateTestKeySet(t, "timeout")}
+		handler := NewJWKSHandler(source, JWKSOptions{StaleWhileRevalidate: time.Hour, RefreshTimeout: 10 * time.Millisecond})
+
+		if _, _, err := handler.KeySet(ctx); err != nil {
+			t.Fatal(err)
+		}
+		source.setHang(true)
+		if _, _, err := handler.KeySet(ctx); err != nil {
+			t.Fatalf("expected the stale key set to be served, got %v", err)
+		}
+
+		// The hanging background refresh times out and another one is started by the next request
+		for i := 0; i < 100 && source.count() < 3; i++ {
+			time.Sleep(10 * time.Millisecond)
+			if _, _, err := handler.KeySet(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if source.count() < 3 {
+			t.Errorf("expected the key set to be fetched again once the refresh timed out, got %d fetches", source.count())
+		}
+
+		// A request without a stale key set to serve gives up as well
+		handler = NewJWKSHandler(source, JWKSOptions{RefreshTimeout: 10 * time.Millisecond})
+		if _, _, err := handler.KeySet(ctx); errors.Cause(err) != context.DeadlineExceeded {
+			t.Errorf("expected the fetch to time out, got %v", err)
+		}
+	})
+
+	t.Run("MergeIDTokenKeys", func(t *testing.T) {
+		manager := &jwk.MemoryManager{}
+		if err := manager.AddKeySet(ctx, jwk.IDTokenKeyName, generateTestKeySet(t, "hydra")); err != nil {
+			t.Fatal(err)
+		}
+
+		source := &fakeKeySetSource{keys: generateTestKeySet(t, "google"), maxAge: time.Hour}
+		handler := NewJWKSHandler(source, JWKSOptions{KeyManager: manager})
+
+		keys, _, err := handler.KeySet(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys.Key("public:google")) != 1 || len(keys.Key("public:hydra")) != 1 {
+			t.Errorf("expected both key sets to be merged, got %d keys", len(keys.Keys))
+		}
+		if len(keys.Key("private:hydra")) != 0 {
+			t.Errorf("expected private keys to be left out")
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package hydragcp
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ory/fosite"
+	"github.com/ory/herodot"
+	"github.com/ory/hydra/config"
+	"github.com/pkg/errors"
+	"github.com/someone1/gcp-jwt-go"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/cloudkms/v1"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/someone1/fosite-gcp-oauth2"
+)
+
+const (
+	kmsEnabledState = "ENABLED"
+	// kmsKeySetTTL is how long the public keys of a crypto key are kept before listing its versions again
+	kmsKeySetTTL = 5 * time.Minute
+	// kmsKeySetMinRefresh bounds how often an unknown kid may trigger listing the key versions again
+	kmsKeySetMinRefresh = 30 * time.Second
+)
+
+// GenerateKMSHydraHandler will bootstrap Hydra using a Cloud KMS asymmetric signing key version to sign JWT Access
+// Tokens and ID Tokens and return http.Handlers for you to use. signingMethod must match the algorithm of the key
+// version in kmsconfig, e.g. gcpjwt.SigningMethodKMSRS256, gcpjwt.SigningMethodKMSES256 or
+// gcpjwt.SigningMethodKMSPS256. The JWKS served by the frontend holds the public keys of every enabled version of the
+// crypto key so tokens signed by previous versions can still be verified. If enableCors is set, CORS is enabled on the
+// frontend and backend with the same CORS_* environment variables Hydra uses.
+func GenerateKMSHydraHandler(ctx context.Context, c *config.Config, kmsconfig *gcpjwt.KMSConfig, signingMethod *gcpjwt.SigningMethodKMS, h herodot.Writer, enableCors bool) (http.Handler, http.Handler, error) {
+	return New(ctx, c, append(handlerOptions(h, enableCors), WithKMSSigner(kmsconfig, signingMethod))...)
+}
+
+// kmsStrategy signs with the configured key version and verifies tokens signed by any enabled version of its key
+type kmsStrategy struct {
+	*oauth2.KMSStrategy
+
+	keys *kmsKeySet
+}
+
+func newKMSStrategy(ctx context.Context, kmsconfig *gcpjwt.KMSConfig, signingMethod *gcpjwt.SigningMethodKMS) (*kmsStrategy, error) {
+	strategy, err := oauth2.NewKMSStrategy(ctx, signingMethod, kmsconfig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	keys, err := newKMSKeySet(ctx, kmsconfig, signingMethod.Alg())
+	if err != nil {
+		return nil, err
+	}
+
+	return &kmsStrategy{KMSStrategy: strategy, keys: keys}, nil
+}
+
+// Decode will decode a JWT token signed by any enabled version of the crypto key
+func (k *kmsStrategy) Decode(ctx context.Context, token string) (*jwt.Token, error) {
+	parsedToken, err := jwt.Parse(token, k.keys.keyfunc(ctx))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	} else if !parsedToken.Valid {
+		return nil, errors.WithStack(fosite.ErrInactiveToken)
+	}
+
+	return parsedToken, nil
+}
+
+// Validate validates a token and returns its signature or an error if the token is not valid.
+func (k *kmsStrategy) Validate(ctx context.Context, token string) (string, error) {
+	if _, err := k.Decode(ctx, token); err != nil {
+		return "", err
+	}
+
+	return k.GetSignature(ctx, token)
+}
+
+// kmsKeySet holds the public keys of every enabled version of a Cloud KMS crypto key
+type kmsKeySet struct {
+	service   *cloudkms.Service
+	cryptoKey string
+	algorithm string
+
+	mu      sync.RWMutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+}
+
+func newKMSKeySet(ctx context.Context, kmsconfig *gcpjwt.KMSConfig, algorithm string) (*kmsKeySet, error) {
+	idx := strings.Index(kmsconfig.KeyPath, "/cryptoKeyVersions/")
+	if idx < 0 {
+		return nil, errors.Errorf("expected a crypto key version path, got %s", kmsconfig.KeyPath)
+	}
+
+	client := kmsconfig.OAuth2HTTPClient
+	if client == nil {
+		var err error
+		if client, err = google.DefaultClient(ctx, cloudkms.CloudPlatformScope); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	service, err := cloudkms.New(client)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	k := &kmsKeySet{service: service, cryptoKey: kmsconfig.KeyPath[:idx], algorithm: algorithm}
+	if _, err := k.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// kmsKeyID returns the kid of a crypto key version, it matches gcpjwt.KMSConfig.KeyID
+func kmsKeyID(version string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(version)))
+}
+
+// KeySet returns the public keys of every enabled version of the crypto key, listing them again if they are stale
+func (k *kmsKeySet) KeySet(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	k.mu.RLock()
+	keys, fetched := k.keys, k.fetched
+	k.mu.RUnlock()
+
+	if keys != nil && time.Since(fetched) < kmsKeySetTTL {
+		return keys, nil
+	}
+	return k.refresh(ctx)
+}
+
+func (k *kmsKeySet) age() time.Duration {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return time.Since(k.fetched)
+}
+
+func (k *kmsKeySet) refresh(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	versions := k.service.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions
+
+	keys := &jose.JSONWebKeySet{}
+	err := versions.List(k.cryptoKey).Pages(ctx, func(resp *cloudkms.ListCryptoKeyVersionsResponse) error {
+		for _, version := range resp.CryptoKeyVersions {
+			if version.State != kmsEnabledState {
+				continue
+			}
+
+			pub, err := versions.GetPublicKey(version.Name).Context(ctx).Do()
+			if err != nil {
+				return err
+			}
+
+			block, _ := pem.Decode([]byte(pub.Pem))
+			if block == nil {
+				return errors.Errorf("could not decode the public key of %s", version.Name)
+			}
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return err
+			}
+
+			keys.Keys = append(keys.Keys, jose.JSONWebKey{
+				Key:       key,
+				KeyID:     kmsKeyID(version.Name),
+				Algorithm: k.algorithm,
+				Use:       "sig",
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	k.mu.Lock()
+	k.keys, k.fetched = keys, time.Now()
+	k.mu.Unlock()
+
+	return keys, nil
+}
+
+// keyfunc returns a jwt.Keyfunc selecting the public key by the token's kid, the key versions are listed again if the
+// kid is unknown in case the key was rotated since they were last listed.
+func (k *kmsKeySet) keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*gcpjwt.SigningMethodKMS); !ok {
+			return nil, errors.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		keys, err := k.KeySet(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if found := keys.Key(kid); len(found) == 0 && k.age() > kmsKeySetMinRefresh {
+			if keys, err = k.refresh(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		if found := keys.Key(kid); len(found) > 0 {
+			return found[0].Key, nil
+		}
+		return nil, errors.Errorf("unknown kid `%s` found in header", kid)
+	}
+}
+
+// FetchKeySet is implemented for the KeySetSource interface
+func (k *kmsKeySet) FetchKeySet(ctx context.Context) (*jose.JSONWebKeySet, time.Duration, error) {
+	keys, err := k.KeySet(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	maxAge := kmsKeySetTTL - k.age()
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return keys, maxAge, nil
+}
@@ -0,0 +1,161 @@
+// Copyright © 2018 Prateek Malhotra (someone1@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hydragcp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	fjwt "github.com/ory/fosite/token/jwt"
+	"github.com/someone1/gcp-jwt-go"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/someone1/hydra-gcp/internal/kmstest"
+)
+
+func generateKMSToken(t *testing.T, strategy *kmsStrategy) string {
+	t.Helper()
+	ctx := context.Background()
+
+	kid, err := strategy.GetPublicKeyID(ctx)
+	if err != nil {
+		t.Fatalf("could not get key id: %v", err)
+	}
+
+	headers := fjwt.NewHeaders()
+	headers.Add("kid", kid)
+	token, _, err := strategy.Generate(ctx, jwt.MapClaims{"sub": "kms-test"}, headers)
+	if err != nil {
+		t.Fatalf("could not generate token: %v", err)
+	}
+	return token
+}
+
+func TestKMSStrategy(t *testing.T) {
+	server := kmstest.NewServer()
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		algorithm string
+		method    *gcpjwt.SigningMethodKMS
+	}{
+		{"RS256", kmstest.RSASignPKCS1, gcpjwt.SigningMethodKMSRS256},
+		{"PS256", kmstest.RSASignPSS, gcpjwt.SigningMethodKMSPS256},
+		{"ES256", kmstest.ECSignP256, gcpjwt.SigningMethodKMSES256},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cryptoKey := "projects/test/locations/global/keyRings/hydra/cryptoKeys/" + tt.name
+
+			first, err := server.AddAsymmetricKeyVersion(cryptoKey, tt.algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := &gcpjwt.KMSConfig{KeyPath: first, GCPConfig: gcpjwt.GCPConfig{OAuth2HTTPClient: server.Client()}}
+			strategy, err := newKMSStrategy(ctx, config, tt.method)
+			if err != nil {
+				t.Fatalf("could not create strategy: %v", err)
+			}
+
+			token := generateKMSToken(t, strategy)
+			parsed, err := strategy.Decode(ctx, token)
+			if err != nil {
+				t.Fatalf("could not validate token: %v", err)
+			}
+			if alg := parsed.Header["alg"]; alg != tt.name {
+				t.Errorf("expected alg %s, got %v", tt.name, alg)
+			}
+
+			// Rotate the key, tokens signed by the previous version must still verify
+			second, err := server.AddAsymmetricKeyVersion(cryptoKey, tt.algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rotated, err := newKMSStrategy(ctx, &gcpjwt.KMSConfig{KeyPath: second, GCPConfig: config.GCPConfig}, tt.method)
+			if err != nil {
+				t.Fatalf("could not create strategy: %v", err)
+			}
+			if _, err := rotated.Validate(ctx, token); err != nil {
+				t.Errorf("expected token signed by the previous version to validate, got %v", err)
+			}
+			if _, err := rotated.Validate(ctx, generateKMSToken(t, rotated)); err != nil {
+				t.Errorf("could not validate token: %v", err)
+			}
+
+			// Disabled versions must not be published
+			server.SetState(first, kmstest.StateDisabled)
+			keys, err := rotated.keys.refresh(ctx)
+			if err != nil {
+				t.Fatalf("could not refresh keys: %v", err)
+			}
+			if len(keys.Key(kmsKeyID(first))) != 0 {
+				t.Errorf("expected disabled key version to be left out of the key set")
+			}
+			if len(keys.Key(kmsKeyID(second))) != 1 {
+				t.Errorf("expected enabled key version in the key set")
+			}
+		})
+	}
+}
+
+func TestKMSJWKSHandler(t *testing.T) {
+	server := kmstest.NewServer()
+	defer server.Close()
+
+	cryptoKey := "projects/test/locations/global/keyRings/hydra/cryptoKeys/jwks"
+	var versions []string
+	for i := 0; i < 2; i++ {
+		version, err := server.AddAsymmetricKeyVersion(cryptoKey, kmstest.RSASignPKCS1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+
+	config := &gcpjwt.KMSConfig{KeyPath: versions[1], GCPConfig: gcpjwt.GCPConfig{OAuth2HTTPClient: server.Client()}}
+	keys, err := newKMSKeySet(context.Background(), config, "RS256")
+	if err != nil {
+		t.Fatalf("could not create key set: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	NewJWKSHandler(keys, JWKSOptions{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var set jose.JSONWebKeySet
+	if err := json.NewDecoder(w.Body).Decode(&set); err != nil {
+		t.Fatalf("could not decode key set: %v", err)
+	}
+	for _, version := range versions {
+		found := set.Key(kmsKeyID(version))
+		if len(found) != 1 {
+			t.Errorf("expected key %s in the key set", version)
+			continue
+		}
+		if !found[0].IsPublic() || found[0].Algorithm != "RS256" || found[0].Use != "sig" {
+			t.Errorf("unexpected key %+v", found[0])
+		}
+	}
+}
@@ -2,50 +2,43 @@ package hydragcp
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 
-	"github.com/julienschmidt/httprouter"
 	"github.com/ory/herodot"
-	"github.com/ory/hydra/cmd/server"
 	"github.com/ory/hydra/config"
-	"github.com/ory/hydra/jwk"
 	"github.com/someone1/gcp-jwt-go"
-	"github.com/spf13/viper"
 
-	"github.com/someone1/fosite-gcp-oauth2"
 	dconfig "github.com/someone1/hydra-gcp/config"
 )
 
 func init() {
 	config.RegisterBackend(&dconfig.DatastoreConnection{})
+	config.RegisterBackend(placeholder)
 }
 
 // GenerateIAMHydraHandler will bootstrap Hydra using the IAM API to sign JWT AccessTokens and return http.Handlers for you to use.
+// If enableCors is set, CORS is enabled on the frontend and backend with the same CORS_* environment variables Hydra
+// uses. It exits through the logger of c if Hydra cannot be bootstrapped, see NewIAMHydraHandler to handle the error.
 func GenerateIAMHydraHandler(ctx context.Context, c *config.Config, gcpconfig *gcpjwt.IAMConfig, h herodot.Writer, enableCors bool) (http.Handler, http.Handler) {
-	viper.AutomaticEnv()
-	viper.Set("CORS_ENABLED", enableCors)
-
-	c.BuildVersion = "hydra-gcp"
-	handler := server.NewHandler(c, h)
-
-	frontend := httprouter.New()
-	backend := httprouter.New()
-
-	handler.RegisterRoutes(frontend, backend)
-
-	enhancedFrontend := server.EnhanceRouter(c, nil, handler, frontend, nil, false)
-	enhanceBackend := server.EnhanceRouter(c, nil, handler, backend, nil, enableCors)
-
-	jwtStrat := oauth2.NewIAMStrategy(ctx, gcpjwt.SigningMethodIAMJWT, gcpconfig)
-
-	injectGCPOauth2(ctx, handler, c, jwtStrat)
+	frontend, backend, err := NewIAMHydraHandler(ctx, c, gcpconfig, h, enableCors)
+	if err != nil {
+		c.GetLogger().WithError(err).Fatal("Could not bootstrap hydra")
+	}
+	return frontend, backend
+}
 
-	serveMux := http.NewServeMux()
-	serveMux.HandleFunc(jwk.WellKnownKeysPath, func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, fmt.Sprintf("https://www.googleapis.com/service_accounts/v1/jwk/%s", gcpconfig.ServiceAccount), http.StatusTemporaryRedirect)
-	})
-	serveMux.Handle("/", enhancedFrontend)
+// NewIAMHydraHandler is GenerateIAMHydraHandler returning an error if Hydra cannot be bootstrapped. See New for more
+// options.
+func NewIAMHydraHandler(ctx context.Context, c *config.Config, gcpconfig *gcpjwt.IAMConfig, h herodot.Writer, enableCors bool) (http.Handler, http.Handler, error) {
+	return New(ctx, c, append(handlerOptions(h, enableCors), WithIAMSigner(gcpconfig))...)
+}
 
-	return serveMux, enhanceBackend
+// handlerOptions returns the options of the handlers bootstrapped with a herodot.Writer and CORS switched on or off
+func handlerOptions(h herodot.Writer, enableCors bool) []Option {
+	opts := []Option{WithWriter(h)}
+	if enableCors {
+		corsOptions := corsOptionsFromEnv()
+		opts = append(opts, WithCORS(corsOptions), WithFrontendCORS(corsOptions))
+	}
+	return opts
 }
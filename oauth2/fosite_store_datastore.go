@@ -34,6 +34,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/someone1/hydra-gcp/dscon"
+	"github.com/someone1/hydra-gcp/envelope"
 )
 
 const (
@@ -43,7 +44,7 @@ const (
 	hydraOauth2AuthCodeKind = "HydraOauth2Code"
 	hydraOauth2PKCEKind     = "HydraOauth2PKCE"
 	uniqueTableKind         = "Unique"
-	oauth2Version           = 2
+	oauth2Version           = 4
 )
 
 type uniqueConstraint struct{}
@@ -66,8 +67,17 @@ type hydraOauth2Data struct {
 	Active        bool           `datastore:"act"`
 	Session       []byte         `datastore:"sess"`
 
+	// KeyID and DataKey identify the data key the session and EncryptedForm are sealed with, Form is left empty. They
+	// are not set if the entity is not encrypted.
+	KeyID         string `datastore:"kid,noindex"`
+	DataKey       []byte `datastore:"dk,noindex"`
+	EncryptedForm []byte `datastore:"efd,noindex"`
+
 	Version int `datastore:"v"`
 	update  bool
+	// redactForm is set if the form was stored by a version not redacting it, forms are redacted only once so hashed
+	// values are not hashed again
+	redactForm bool
 }
 
 // LoadKey is implemented for the KeyLoader interface
@@ -93,8 +103,15 @@ func (h *hydraOauth2Data) Load(ps []datastore.Property) error {
 		// Update to version 2 here
 		h.Active = true
 		fallthrough
-	// case 2:
-	// 	//update to version 3 here
+	case 2:
+		// Version 3 may seal the session and form, they are sealed when the entity is updated if an Encrypter is set
+		fallthrough
+	case 3:
+		// Version 4 redacts the form, it is redacted when the entity is updated if a FormRedactor is set
+		h.redactForm = true
+		fallthrough
+	// case 4:
+	// 	//update to version 5 here
 	// 	fallthrough
 	case -1:
 		// This is here to complete saving the entity should we need to udpate it
@@ -123,9 +140,24 @@ type FositeDatastoreStore struct {
 	client.Manager
 	L                   logrus.FieldLogger
 	AccessTokenLifespan time.Duration
-
-	client    *datastore.Client
-	namespace string
+	// FlushConcurrency is the number of chunks deleted in parallel by FlushInactiveAccessTokens, defaults to 1
+	FlushConcurrency int
+	// RefreshTokenReuseWindow is how long revoked refresh tokens are kept as tombstones. If one is presented again
+	// within the window, every token of its request is revoked. Refresh tokens are deleted when revoked if it is not
+	// positive. Defaults to DefaultRefreshTokenReuseWindow.
+	RefreshTokenReuseWindow time.Duration
+	// Encrypter seals the sessions and forms of the entities written from now on if set. Entities are read whether they
+	// are sealed or not, the ones stored in plaintext or sealed with a rotated key encryption key are sealed again with
+	// the current data key when they are read.
+	Encrypter *envelope.Encrypter
+	// FormRedactor redacts the request forms before they are stored, forms stored by a previous version are redacted
+	// when they are read. Forms are stored as is if it is nil. Defaults to NewFormRedactor.
+	FormRedactor *FormRedactor
+
+	client     *datastore.Client
+	namespace  string
+	tracer     dscon.Tracer
+	reuseHooks []RefreshTokenReuseHook
 }
 
 // NewFositeDatastoreStore initializes a new FositeDatastoreStore with the given client
@@ -136,14 +168,22 @@ func NewFositeDatastoreStore(m client.Manager,
 	accessTokenLifespan time.Duration,
 ) *FositeDatastoreStore {
 	return &FositeDatastoreStore{
-		Manager:             m,
-		L:                   l,
-		AccessTokenLifespan: accessTokenLifespan,
-		client:              client,
-		namespace:           namespace,
+		Manager:                 m,
+		L:                       l,
+		AccessTokenLifespan:     accessTokenLifespan,
+		RefreshTokenReuseWindow: DefaultRefreshTokenReuseWindow,
+		FormRedactor:            NewFormRedactor(),
+		client:                  client,
+		namespace:               namespace,
+		tracer:                  dscon.NewTracer("oauth2", namespace),
 	}
 }
 
+// EnableTracing starts a span for every operation of the manager from now on
+func (f *FositeDatastoreStore) EnableTracing() {
+	f.tracer.Enabled = true
+}
+
 func (f *FositeDatastoreStore) createOIDCKey(sig string) *datastore.Key {
 	return f.createKeyForKind(sig, hydraOauth2OpenIDKind)
 }
@@ -160,17 +200,81 @@ func (f *FositeDatastoreStore) createPKCEKey(sig string) *datastore.Key {
 	return f.createKeyForKind(sig, hydraOauth2PKCEKind)
 }
 
+// createUniqueKey returns the key of the row enforcing a single entity of kind per request ID
+func (f *FositeDatastoreStore) createUniqueKey(kind, requestID string) *datastore.Key {
+	return f.createKeyForKind(uniqueTableKind, kind+requestID)
+}
+
 func (f *FositeDatastoreStore) createKeyForKind(sig, kind string) *datastore.Key {
 	key := datastore.NameKey(kind, sig, nil)
 	key.Namespace = f.namespace
 	return key
 }
 
+// sealedData returns the additional data authenticating a sealed field of the entity at key, so it cannot be moved to
+// another entity
+func sealedData(key *datastore.Key, field string) []byte {
+	return []byte(key.Kind + "/" + key.Name + "/" + field)
+}
+
+// seal encrypts the session and form of d, stored at key, with the current data key
+func (f *FositeDatastoreStore) seal(ctx context.Context, key *datastore.Key, d *hydraOauth2Data) error {
+	dataKey, err := f.Encrypter.DataKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	session, err := dataKey.Seal(d.Session, sealedData(key, "sess"))
+	if err != nil {
+		return err
+	}
+	form, err := dataKey.Seal([]byte(d.Form), sealedData(key, "fd"))
+	if err != nil {
+		return err
+	}
+
+	d.Session, d.Form, d.EncryptedForm = session, "", form
+	d.KeyID, d.DataKey = dataKey.KeyID, dataKey.Wrapped
+	return nil
+}
+
+// open decrypts the session and form of d, stored at key, if they are sealed. It reports whether d should be sealed
+// again because it is stored in plaintext or its data key was wrapped by a rotated key encryption key.
+func (f *FositeDatastoreStore) open(ctx context.Context, key *datastore.Key, d *hydraOauth2Data) (bool, error) {
+	if d.KeyID == "" {
+		return f.Encrypter != nil, nil
+	} else if f.Encrypter == nil {
+		return false, errors.Errorf("%s is encrypted but no Encrypter is configured", key.Kind)
+	}
+
+	rotated, err := f.Encrypter.Rotated(ctx, d.KeyID)
+	if err != nil {
+		return false, err
+	}
+	dataKey, err := f.Encrypter.OpenDataKey(ctx, d.KeyID, d.DataKey)
+	if err != nil {
+		return false, err
+	}
+
+	session, err := dataKey.Open(d.Session, sealedData(key, "sess"))
+	if err != nil {
+		return false, err
+	}
+	form, err := dataKey.Open(d.EncryptedForm, sealedData(key, "fd"))
+	if err != nil {
+		return false, err
+	}
+
+	d.Session, d.Form, d.EncryptedForm = session, string(form), nil
+	d.KeyID, d.DataKey = "", nil
+	return rotated, nil
+}
+
 func (f *FositeDatastoreStore) newQueryForKind(kind string) *datastore.Query {
 	return datastore.NewQuery(kind).Namespace(f.namespace)
 }
 
-func oauth2DataFromRequest(signature string, r fosite.Requester, logger logrus.FieldLogger) (*hydraOauth2Data, error) {
+func oauth2DataFromRequest(signature string, r fosite.Requester, redactor *FormRedactor, logger logrus.FieldLogger) (*hydraOauth2Data, error) {
 	subject := ""
 	if r.GetSession() == nil {
 		logger.Debugf("Got an empty session in oauth2DataFromRequest")
@@ -190,7 +294,7 @@ func oauth2DataFromRequest(signature string, r fosite.Requester, logger logrus.F
 		Client:        r.GetClient().GetID(),
 		Scopes:        strings.Join([]string(r.GetRequestedScopes()), "|"),
 		GrantedScopes: strings.Join([]string(r.GetGrantedScopes()), "|"),
-		Form:          r.GetRequestForm().Encode(),
+		Form:          redactor.Redact(r.GetRequestForm()).Encode(),
 		Session:       session,
 		Subject:       subject,
 		Active:        true,
@@ -230,19 +334,24 @@ func (h *hydraOauth2Data) toRequest(session fosite.Session, cm client.Manager, l
 }
 
 func (f *FositeDatastoreStore) createSession(ctx context.Context, key *datastore.Key, requester fosite.Requester, unique bool) error {
-	data, err := oauth2DataFromRequest(key.Name, requester, f.L)
+	data, err := oauth2DataFromRequest(key.Name, requester, f.FormRedactor, f.L)
 	if err != nil {
 		return err
 	}
+	if f.Encrypter != nil {
+		if err := f.seal(ctx, key, data); err != nil {
+			return err
+		}
+	}
 
 	mutations := []*datastore.Mutation{datastore.NewInsert(key, data)}
 	if unique {
 		// Unique Constraint for RequestID
-		uniqueKey := f.createKeyForKind(uniqueTableKind, key.Kind+data.Request)
+		uniqueKey := f.createUniqueKey(key.Kind, data.Request)
 		mutations = append(mutations, datastore.NewInsert(uniqueKey, &uniqueConstraint{}))
 	}
 
-	_, err = f.client.RunInTransaction(ctx, func(t *datastore.Transaction) error {
+	_, err = dscon.RunInTransaction(ctx, f.client, func(t *datastore.Transaction) error {
 		_, terr := t.Mutate(mutations...)
 		return terr
 	})
@@ -261,7 +370,14 @@ func (f *FositeDatastoreStore) findSessionBySignature(ctx context.Context, key *
 			return nil, errors.Wrap(fosite.ErrNotFound, "")
 		}
 		return nil, dscon.HandleError(err)
-	} else if !d.Active && key.Kind == hydraOauth2AuthCodeKind {
+	}
+
+	reseal, err := f.open(ctx, key, &d)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.Active && key.Kind == hydraOauth2AuthCodeKind {
 		if r, err := d.toRequest(session, f.Manager, f.L); err != nil {
 			return nil, err
 		} else {
@@ -271,8 +387,12 @@ func (f *FositeDatastoreStore) findSessionBySignature(ctx context.Context, key *
 		return nil, errors.WithStack(fosite.ErrInactiveToken)
 	}
 
-	if d.update {
-		mutation := datastore.NewUpdate(key, &d)
+	if d.update || reseal {
+		updated, err := f.prepareUpdate(ctx, key, &d)
+		if err != nil {
+			return nil, err
+		}
+		mutation := datastore.NewUpdate(key, updated)
 		if _, err := f.client.Mutate(ctx, mutation); err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -282,15 +402,35 @@ func (f *FositeDatastoreStore) findSessionBySignature(ctx context.Context, key *
 	return d.toRequest(session, f.Manager, f.L)
 }
 
+// prepareUpdate redacts the form of d, stored at key and opened, if it was stored by a version not redacting it and
+// returns the entity to write back, sealed if an Encrypter is set. d is kept in plaintext to build the request.
+func (f *FositeDatastoreStore) prepareUpdate(ctx context.Context, key *datastore.Key, d *hydraOauth2Data) (*hydraOauth2Data, error) {
+	if d.redactForm {
+		form, err := f.FormRedactor.redactEncoded(d.Form)
+		if err != nil {
+			return nil, err
+		}
+		d.Form, d.redactForm = form, false
+	}
+
+	updated := *d
+	if f.Encrypter != nil {
+		if err := f.seal(ctx, key, &updated); err != nil {
+			return nil, err
+		}
+	}
+	return &updated, nil
+}
+
 func (f *FositeDatastoreStore) deleteSession(ctx context.Context, key *datastore.Key, unique bool) error {
 	mutations := []*datastore.Mutation{datastore.NewDelete(key)}
-	_, err := f.client.RunInTransaction(ctx, func(t *datastore.Transaction) error {
+	_, err := dscon.RunInTransaction(ctx, f.client, func(t *datastore.Transaction) error {
 		if unique {
 			var data hydraOauth2Data
 			if err := t.Get(key, &data); err != nil {
 				return err
 			}
-			mutations = append(mutations, datastore.NewDelete(f.createKeyForKind(uniqueTableKind, key.Kind+data.Request)))
+			mutations = append(mutations, datastore.NewDelete(f.createUniqueKey(key.Kind, data.Request)))
 		}
 
 		_, terr := t.Mutate(mutations...)
@@ -316,9 +456,9 @@ func (f *FositeDatastoreStore) revokeSession(ctx context.Context, id, kind strin
 	mutations := make([]*datastore.Mutation, 0, len(keys)*2)
 	for _, key := range keys {
 		mutations = append(mutations, datastore.NewDelete(key))
-		mutations = append(mutations, datastore.NewDelete(f.createKeyForKind(uniqueTableKind, key.Kind+id)))
+		mutations = append(mutations, datastore.NewDelete(f.createUniqueKey(key.Kind, id)))
 	}
-	_, err = f.client.RunInTransaction(ctx, func(t *datastore.Transaction) error {
+	_, err = dscon.RunInTransaction(ctx, f.client, func(t *datastore.Transaction) error {
 		_, terr := t.Mutate(mutations...)
 		return terr
 	})
@@ -329,26 +469,44 @@ func (f *FositeDatastoreStore) revokeSession(ctx context.Context, id, kind strin
 }
 
 func (f *FositeDatastoreStore) CreateOpenIDConnectSession(ctx context.Context, signature string, requester fosite.Requester) error {
+	ctx, span := f.tracer.StartSpan(ctx, "CreateOpenIDConnectSession", hydraOauth2OpenIDKind)
+	defer span.End()
+
 	return f.createSession(ctx, f.createOIDCKey(signature), requester, false)
 }
 
 func (f *FositeDatastoreStore) GetOpenIDConnectSession(ctx context.Context, signature string, requester fosite.Requester) (fosite.Requester, error) {
+	ctx, span := f.tracer.StartSpan(ctx, "GetOpenIDConnectSession", hydraOauth2OpenIDKind)
+	defer span.End()
+
 	return f.findSessionBySignature(ctx, f.createOIDCKey(signature), requester.GetSession())
 }
 
 func (f *FositeDatastoreStore) DeleteOpenIDConnectSession(ctx context.Context, signature string) error {
+	ctx, span := f.tracer.StartSpan(ctx, "DeleteOpenIDConnectSession", hydraOauth2OpenIDKind)
+	defer span.End()
+
 	return f.deleteSession(ctx, f.createOIDCKey(signature), false)
 }
 
 func (f *FositeDatastoreStore) CreateAuthorizeCodeSession(ctx context.Context, signature string, requester fosite.Requester) error {
+	ctx, span := f.tracer.StartSpan(ctx, "CreateAuthorizeCodeSession", hydraOauth2AuthCodeKind)
+	defer span.End()
+
 	return f.createSession(ctx, f.createCodeKey(signature), requester, false)
 }
 
 func (f *FositeDatastoreStore) GetAuthorizeCodeSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	ctx, span := f.tracer.StartSpan(ctx, "GetAuthorizeCodeSession", hydraOauth2AuthCodeKind)
+	defer span.End()
+
 	return f.findSessionBySignature(ctx, f.createCodeKey(signature), session)
 }
 
 func (f *FositeDatastoreStore) InvalidateAuthorizeCodeSession(ctx context.Context, signature string) error {
+	ctx, span := f.tracer.StartSpan(ctx, "InvalidateAuthorizeCodeSession", hydraOauth2AuthCodeKind)
+	defer span.End()
+
 	var data hydraOauth2Data
 	key := f.createCodeKey(signature)
 
@@ -356,8 +514,15 @@ func (f *FositeDatastoreStore) InvalidateAuthorizeCodeSession(ctx context.Contex
 	if err != nil {
 		return dscon.HandleError(err)
 	}
+	if _, err := f.open(ctx, key, &data); err != nil {
+		return err
+	}
 	data.Active = false
-	mutation := datastore.NewUpdate(key, &data)
+	updated, err := f.prepareUpdate(ctx, key, &data)
+	if err != nil {
+		return err
+	}
+	mutation := datastore.NewUpdate(key, updated)
 	if _, err := f.client.Mutate(ctx, mutation); err != nil {
 		return dscon.HandleError(err)
 	}
@@ -366,73 +531,131 @@ func (f *FositeDatastoreStore) InvalidateAuthorizeCodeSession(ctx context.Contex
 }
 
 func (f *FositeDatastoreStore) DeleteAuthorizeCodeSession(ctx context.Context, signature string) error {
+	ctx, span := f.tracer.StartSpan(ctx, "DeleteAuthorizeCodeSession", hydraOauth2AuthCodeKind)
+	defer span.End()
+
 	return f.deleteSession(ctx, f.createCodeKey(signature), false)
 }
 
 func (f *FositeDatastoreStore) CreateAccessTokenSession(ctx context.Context, signature string, requester fosite.Requester) error {
+	ctx, span := f.tracer.StartSpan(ctx, "CreateAccessTokenSession", hydraOauth2AccessKind)
+	defer span.End()
+
 	return f.createSession(ctx, f.createAccessKey(signature), requester, true)
 }
 
 func (f *FositeDatastoreStore) GetAccessTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	ctx, span := f.tracer.StartSpan(ctx, "GetAccessTokenSession", hydraOauth2AccessKind)
+	defer span.End()
+
 	return f.findSessionBySignature(ctx, f.createAccessKey(signature), session)
 }
 
 func (f *FositeDatastoreStore) DeleteAccessTokenSession(ctx context.Context, signature string) error {
+	ctx, span := f.tracer.StartSpan(ctx, "DeleteAccessTokenSession", hydraOauth2AccessKind)
+	defer span.End()
+
 	return f.deleteSession(ctx, f.createAccessKey(signature), true)
 }
 
 func (f *FositeDatastoreStore) CreateRefreshTokenSession(ctx context.Context, signature string, requester fosite.Requester) error {
+	ctx, span := f.tracer.StartSpan(ctx, "CreateRefreshTokenSession", hydraOauth2RefreshKind)
+	defer span.End()
+
 	return f.createSession(ctx, f.createRefreshKey(signature), requester, true)
 }
 
 func (f *FositeDatastoreStore) GetRefreshTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
-	return f.findSessionBySignature(ctx, f.createRefreshKey(signature), session)
+	ctx, span := f.tracer.StartSpan(ctx, "GetRefreshTokenSession", hydraOauth2RefreshKind)
+	defer span.End()
+
+	r, err := f.findSessionBySignature(ctx, f.createRefreshKey(signature), session)
+	if errors.Cause(err) != fosite.ErrNotFound || f.RefreshTokenReuseWindow <= 0 {
+		return r, err
+	}
+
+	if reused, rerr := f.detectRefreshTokenReuse(ctx, signature); rerr != nil {
+		return nil, rerr
+	} else if reused {
+		// Reported as not found so that fosite rejects the request as invalid
+		return nil, errors.Wrap(fosite.ErrNotFound, "the refresh token was revoked and reused")
+	}
+	return nil, err
 }
 
 func (f *FositeDatastoreStore) DeleteRefreshTokenSession(ctx context.Context, signature string) error {
+	ctx, span := f.tracer.StartSpan(ctx, "DeleteRefreshTokenSession", hydraOauth2RefreshKind)
+	defer span.End()
+
 	return f.deleteSession(ctx, f.createRefreshKey(signature), true)
 }
 
 func (f *FositeDatastoreStore) CreatePKCERequestSession(ctx context.Context, signature string, requester fosite.Requester) error {
+	ctx, span := f.tracer.StartSpan(ctx, "CreatePKCERequestSession", hydraOauth2PKCEKind)
+	defer span.End()
+
 	return f.createSession(ctx, f.createPKCEKey(signature), requester, false)
 }
 
 func (f *FositeDatastoreStore) GetPKCERequestSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	ctx, span := f.tracer.StartSpan(ctx, "GetPKCERequestSession", hydraOauth2PKCEKind)
+	defer span.End()
+
 	return f.findSessionBySignature(ctx, f.createPKCEKey(signature), session)
 }
 
 func (f *FositeDatastoreStore) DeletePKCERequestSession(ctx context.Context, signature string) error {
+	ctx, span := f.tracer.StartSpan(ctx, "DeletePKCERequestSession", hydraOauth2PKCEKind)
+	defer span.End()
+
 	return f.deleteSession(ctx, f.createPKCEKey(signature), false)
 }
 
 func (f *FositeDatastoreStore) CreateImplicitAccessTokenSession(ctx context.Context, signature string, requester fosite.Requester) error {
+	ctx, span := f.tracer.StartSpan(ctx, "CreateImplicitAccessTokenSession", hydraOauth2AccessKind)
+	defer span.End()
+
 	return f.CreateAccessTokenSession(ctx, signature, requester)
 }
 
 func (f *FositeDatastoreStore) RevokeRefreshToken(ctx context.Context, id string) error {
+	ctx, span := f.tracer.StartSpan(ctx, "RevokeRefreshToken", hydraOauth2RefreshKind)
+	defer span.End()
+
+	// fosite revokes the refresh tokens of a request when rotating them
+	if f.RefreshTokenReuseWindow > 0 {
+		return f.tombstoneRefreshTokens(ctx, id)
+	}
 	return f.revokeSession(ctx, id, hydraOauth2RefreshKind)
 }
 
 func (f *FositeDatastoreStore) RevokeAccessToken(ctx context.Context, id string) error {
+	ctx, span := f.tracer.StartSpan(ctx, "RevokeAccessToken", hydraOauth2AccessKind)
+	defer span.End()
+
 	return f.revokeSession(ctx, id, hydraOauth2AccessKind)
 }
 
+// FlushInactiveAccessTokens removes access tokens, and their Unique rows, requested before notAfter or the
+// configured access token lifespan, whichever is earlier.
 func (f *FositeDatastoreStore) FlushInactiveAccessTokens(ctx context.Context, notAfter time.Time) error {
+	_, err := f.FlushInactiveAccessTokensWithStats(ctx, notAfter)
+	return err
+}
+
+// FlushInactiveAccessTokensWithStats works like FlushInactiveAccessTokens but reports how many entities were
+// flushed. Expired access tokens are swept with a cursor and deleted in chunks of at most dscon.MaxBatchSize
+// mutations, FlushConcurrency chunks at a time.
+func (f *FositeDatastoreStore) FlushInactiveAccessTokensWithStats(ctx context.Context, notAfter time.Time) (FlushStats, error) {
+	ctx, span := f.tracer.StartSpan(ctx, "FlushInactiveAccessTokensWithStats", hydraOauth2AccessKind)
+	defer span.End()
+
 	expireTime := time.Now().Add(-f.AccessTokenLifespan)
-	query := f.newQueryForKind(hydraOauth2AccessKind).KeysOnly()
 	if expireTime.Before(notAfter) {
-		query = query.Filter("rat<", expireTime)
-	} else {
-		query = query.Filter("rat<", notAfter)
-	}
-
-	keys, err := f.client.GetAll(ctx, query, nil)
-	if err != nil {
-		return dscon.HandleError(err)
+		notAfter = expireTime
 	}
 
-	if err = f.client.DeleteMulti(ctx, keys); err != nil {
-		return errors.WithStack(err)
-	}
-	return nil
+	stats, err := f.sweepKind(ctx, AccessTokenKind, notAfter, sweepOptions{concurrency: f.FlushConcurrency})
+	dscon.SetEntityCount(span, stats.Deleted+stats.Unique)
+	return stats, err
 }
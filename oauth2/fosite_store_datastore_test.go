@@ -15,16 +15,25 @@
 package oauth2
 
 import (
+	"bytes"
 	"context"
+	"net/url"
 	"testing"
+	"time"
 
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/client"
 	"github.com/ory/hydra/pkg"
+	"github.com/sirupsen/logrus"
+
+	"github.com/someone1/hydra-gcp/envelope"
 )
 
 type mockHydraOauth2Data struct {
 	Active  bool   `datastore:"act"`
 	Version int    `datastore:"v"`
 	Client  string `datastore:"cid"`
+	Form    string `datastore:"fd"`
 }
 
 func TestFositeInterfaceType(t *testing.T) {
@@ -64,3 +73,154 @@ func TestHydraOauth2DataLoad(t *testing.T) {
 		t.Error("could not get datastore connection")
 	}
 }
+
+func TestSessionEncryption(t *testing.T) {
+	t.Parallel()
+	m, ok := fositeStores["datastore"].(*FositeDatastoreStore)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	ctx := context.Background()
+	store := NewFositeDatastoreStore(clientManager, m.client, "encryption-test", logrus.New(), time.Hour)
+	r := &fosite.Request{
+		ID:          "encryption-request",
+		RequestedAt: time.Now(),
+		Client:      &client.Client{ClientID: "foobar"},
+		Form:        url.Values{"nonce": {"the-nonce"}},
+		Session:     &fosite.DefaultSession{Subject: "encrypted-subject"},
+	}
+
+	// Written in plaintext before encryption was enabled
+	if err := store.CreateAccessTokenSession(ctx, "plaintext", r); err != nil {
+		t.Fatalf("could not create access token session: %v", err)
+	}
+
+	keyring, err := envelope.NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, envelope.DataKeySize)})
+	if err != nil {
+		t.Fatalf("could not create keyring: %v", err)
+	}
+	store.Encrypter = envelope.NewEncrypter(keyring)
+	if err := store.CreateRefreshTokenSession(ctx, "sealed", r); err != nil {
+		t.Fatalf("could not create refresh token session: %v", err)
+	}
+
+	var raw hydraOauth2Data
+	if err := m.client.Get(ctx, store.createRefreshKey("sealed"), &raw); err != nil {
+		t.Fatalf("could not get refresh token: %v", err)
+	}
+	if raw.KeyID != "k1" || raw.Form != "" || bytes.Contains(raw.Session, []byte("encrypted-subject")) {
+		t.Errorf("expected the session and form to be sealed with k1, got %+v", raw)
+	}
+	got, err := store.GetRefreshTokenSession(ctx, "sealed", &fosite.DefaultSession{})
+	if err != nil {
+		t.Fatalf("could not get refresh token session: %v", err)
+	}
+	if got.GetSession().GetSubject() != "encrypted-subject" || got.GetRequestForm().Get("nonce") != "the-nonce" {
+		t.Errorf("expected the session and form to be opened, got %+v", got)
+	}
+
+	// Plaintext entities are sealed when read
+	if _, err := store.GetAccessTokenSession(ctx, "plaintext", &fosite.DefaultSession{}); err != nil {
+		t.Fatalf("could not get access token session: %v", err)
+	}
+	if err := m.client.Get(ctx, store.createAccessKey("plaintext"), &raw); err != nil {
+		t.Fatalf("could not get access token: %v", err)
+	}
+	if raw.KeyID != "k1" || bytes.Contains(raw.Session, []byte("encrypted-subject")) {
+		t.Errorf("expected the plaintext session to be sealed, got %+v", raw)
+	}
+
+	// Entities sealed with a rotated key are sealed again with the primary key
+	keyring, err = envelope.NewKeyring("k2", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, envelope.DataKeySize),
+		"k2": bytes.Repeat([]byte{2}, envelope.DataKeySize),
+	})
+	if err != nil {
+		t.Fatalf("could not create keyring: %v", err)
+	}
+	store.Encrypter = envelope.NewEncrypter(keyring)
+	if _, err := store.GetRefreshTokenSession(ctx, "sealed", &fosite.DefaultSession{}); err != nil {
+		t.Fatalf("could not get refresh token session: %v", err)
+	}
+	if err := m.client.Get(ctx, store.createRefreshKey("sealed"), &raw); err != nil {
+		t.Fatalf("could not get refresh token: %v", err)
+	}
+	if raw.KeyID != "k2" {
+		t.Errorf("expected the session to be sealed again with k2, got %s", raw.KeyID)
+	}
+
+	store.Encrypter = nil
+	if _, err := store.GetRefreshTokenSession(ctx, "sealed", &fosite.DefaultSession{}); err == nil {
+		t.Error("expected a sealed session not to be read without an Encrypter")
+	}
+}
+
+func TestHydraOauth2DataRedactForm(t *testing.T) {
+	t.Parallel()
+	m, ok := fositeStores["datastore"].(*FositeDatastoreStore)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	ctx := context.Background()
+	store := NewFositeDatastoreStore(clientManager, m.client, "redact-test", logrus.New(), time.Hour)
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"the-token"}, "client_secret": {"the-secret"}}
+
+	// Stored verbatim by a previous version
+	key := store.createAccessKey("stored-verbatim")
+	mock := mockHydraOauth2Data{Version: 3, Active: true, Client: "foobar", Form: form.Encode()}
+	if _, err := m.client.Put(ctx, key, &mock); err != nil {
+		t.Fatalf("could not store dummy data: %v", err)
+	}
+	r, err := store.findSessionBySignature(ctx, key, nil)
+	if err != nil {
+		t.Fatalf("could not get data: %v", err)
+	}
+	if got := r.GetRequestForm(); got.Get("refresh_token") != "" || got.Get("grant_type") != "refresh_token" {
+		t.Errorf("expected the refresh token to be redacted, got %v", got)
+	}
+
+	var d hydraOauth2Data
+	if err := m.client.Get(ctx, key, &d); err != nil {
+		t.Fatalf("could not get data: %v", err)
+	}
+	if d.Version != oauth2Version || d.Form != "grant_type=refresh_token" {
+		t.Errorf("expected the stored form to be scrubbed, got version %d and %s", d.Version, d.Form)
+	}
+
+	// Scrubbed when invalidated without being read first
+	key = store.createCodeKey("invalidated-verbatim")
+	if _, err := m.client.Put(ctx, key, &mock); err != nil {
+		t.Fatalf("could not store dummy data: %v", err)
+	}
+	if err := store.InvalidateAuthorizeCodeSession(ctx, "invalidated-verbatim"); err != nil {
+		t.Fatalf("could not invalidate the authorize code: %v", err)
+	}
+	d = hydraOauth2Data{}
+	if err := m.client.Get(ctx, key, &d); err != nil {
+		t.Fatalf("could not get data: %v", err)
+	}
+	if d.Active || d.Version != oauth2Version || d.Form != "grant_type=refresh_token" {
+		t.Errorf("expected the invalidated form to be scrubbed, got active %v, version %d and %s", d.Active, d.Version, d.Form)
+	}
+
+	// Redacted before being stored
+	if err := store.CreateAccessTokenSession(ctx, "redacted", &fosite.Request{
+		ID:      "redact-request",
+		Client:  &client.Client{ClientID: "foobar"},
+		Form:    form,
+		Session: &fosite.DefaultSession{},
+	}); err != nil {
+		t.Fatalf("could not create access token session: %v", err)
+	}
+	if err := m.client.Get(ctx, store.createAccessKey("redacted"), &d); err != nil {
+		t.Fatalf("could not get data: %v", err)
+	}
+	if d.Form != "grant_type=refresh_token" {
+		t.Errorf("expected the form to be redacted, got %s", d.Form)
+	}
+	if form.Get("client_secret") == "" {
+		t.Error("expected the request form not to be changed")
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth2
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+
+	"github.com/someone1/hydra-gcp/dscon"
+)
+
+// TokenKind identifies one of the Datastore kinds used to persist OAuth2 sessions
+type TokenKind string
+
+const (
+	// AccessTokenKind holds access token sessions
+	AccessTokenKind TokenKind = hydraOauth2AccessKind
+	// RefreshTokenKind holds refresh token sessions
+	RefreshTokenKind TokenKind = hydraOauth2RefreshKind
+	// AuthorizeCodeKind holds authorize code sessions
+	AuthorizeCodeKind TokenKind = hydraOauth2AuthCodeKind
+	// PKCEKind holds PKCE request sessions
+	PKCEKind TokenKind = hydraOauth2PKCEKind
+	// OpenIDConnectKind holds OpenID Connect sessions
+	OpenIDConnectKind TokenKind = hydraOauth2OpenIDKind
+	// RefreshTokenTombstoneKind holds the tombstones of revoked refresh tokens, by when they were revoked
+	RefreshTokenTombstoneKind TokenKind = hydraOauth2RefreshTombstoneKind
+)
+
+// TokenKinds lists every kind the Janitor knows how to flush
+var TokenKinds = []TokenKind{AccessTokenKind, RefreshTokenKind, AuthorizeCodeKind, PKCEKind, OpenIDConnectKind, RefreshTokenTombstoneKind}
+
+// hasUniqueConstraint reports whether entities of this kind have a matching Unique row
+func (k TokenKind) hasUniqueConstraint() bool {
+	return k == AccessTokenKind || k == RefreshTokenKind
+}
+
+// JanitorOptions configures a Janitor
+type JanitorOptions struct {
+	// Lifespans is how long an entity of each kind is kept after it was requested. Kinds without a positive
+	// lifespan are never flushed, except for refresh token tombstones which default to the RefreshTokenReuseWindow
+	// of the store.
+	Lifespans map[TokenKind]time.Duration
+	// RefreshTokenLifespan is how long refresh tokens are kept after they were requested if Lifespans does not set
+	// one for RefreshTokenKind. Hydra does not expire refresh tokens, so they are never flushed unless it is positive;
+	// a flushed refresh token can no longer be used.
+	RefreshTokenLifespan time.Duration
+	// BatchSize is the number of entities removed per Datastore call, it is capped to dscon.MaxBatchSize
+	// mutations (entities with a Unique row count twice).
+	BatchSize int
+	// MaxBatches bounds the number of batches flushed per kind in a single run, 0 means no limit. A kind that
+	// was not fully flushed is resumed from its cursor on the next run.
+	MaxBatches int
+	// Concurrency is the number of batches deleted in parallel, defaults to 1.
+	Concurrency int
+	// DryRun will count what would be flushed without deleting anything.
+	DryRun bool
+}
+
+// FlushStats reports what was flushed for a single kind
+type FlushStats struct {
+	Kind    TokenKind
+	Deleted int
+	Unique  int
+	// Cursor is where the sweep stopped if it did not complete, empty otherwise
+	Cursor string
+}
+
+// JanitorReport is the result of a single Janitor run
+type JanitorReport struct {
+	DryRun bool
+	Stats  map[TokenKind]FlushStats
+}
+
+// Janitor removes expired OAuth2 sessions of every kind, along with their Unique rows, from Datastore
+type Janitor struct {
+	store *FositeDatastoreStore
+	opts  JanitorOptions
+
+	mu      sync.Mutex
+	cursors map[TokenKind]string
+}
+
+// NewJanitor initializes a new Janitor flushing entities from the given store
+func NewJanitor(store *FositeDatastoreStore, opts JanitorOptions) *Janitor {
+	return &Janitor{
+		store:   store,
+		opts:    opts,
+		cursors: make(map[TokenKind]string),
+	}
+}
+
+// Cursors returns where each kind's sweep stopped during the last incomplete run, so it may be persisted
+func (j *Janitor) Cursors() map[TokenKind]string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	cursors := make(map[TokenKind]string, len(j.cursors))
+	for kind, cursor := range j.cursors {
+		cursors[kind] = cursor
+	}
+	return cursors
+}
+
+// SetCursors will resume the sweep of each kind from the given cursors on the next run
+func (j *Janitor) SetCursors(cursors map[TokenKind]string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.cursors = make(map[TokenKind]string, len(cursors))
+	for kind, cursor := range cursors {
+		j.cursors[kind] = cursor
+	}
+}
+
+// Run flushes every kind with a configured lifespan once
+func (j *Janitor) Run(ctx context.Context) (*JanitorReport, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	report := &JanitorReport{DryRun: j.opts.DryRun, Stats: make(map[TokenKind]FlushStats)}
+	now := time.Now()
+
+	for _, kind := range TokenKinds {
+		lifespan := j.lifespan(kind)
+		if lifespan <= 0 {
+			continue
+		}
+
+		stats, err := j.store.sweepKind(ctx, kind, now.Add(-lifespan), sweepOptions{
+			cursor:      j.cursors[kind],
+			batchSize:   j.opts.BatchSize,
+			maxBatches:  j.opts.MaxBatches,
+			concurrency: j.opts.Concurrency,
+			dryRun:      j.opts.DryRun,
+		})
+		report.Stats[kind] = stats
+		if !j.opts.DryRun {
+			if stats.Cursor != "" {
+				j.cursors[kind] = stats.Cursor
+			} else {
+				delete(j.cursors, kind)
+			}
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// lifespan returns how long entities of kind are kept, they are never flushed if it is not positive
+func (j *Janitor) lifespan(kind TokenKind) time.Duration {
+	lifespan := j.opts.Lifespans[kind]
+	if lifespan > 0 {
+		return lifespan
+	}
+
+	switch kind {
+	case RefreshTokenKind:
+		return j.opts.RefreshTokenLifespan
+	case RefreshTokenTombstoneKind:
+		return j.store.RefreshTokenReuseWindow
+	}
+	return lifespan
+}
+
+// Start runs the Janitor every interval until ctx is done, errors are logged to the store's logger
+func (j *Janitor) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := j.Run(ctx)
+		if err != nil {
+			j.store.L.WithError(err).Errorf("Could not flush expired OAuth2 sessions")
+		} else {
+			for kind, stats := range report.Stats {
+				j.store.L.WithField("kind", kind).WithField("dry_run", report.DryRun).Debugf("Flushed %d sessions and %d unique rows", stats.Deleted, stats.Unique)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type sweepOptions struct {
+	cursor      string
+	batchSize   int
+	maxBatches  int
+	concurrency int
+	dryRun      bool
+}
+
+// flushEntity is the projection loaded when sweeping kinds with a Unique row
+type flushEntity struct {
+	Request string `datastore:"rid"`
+}
+
+// sweepKind deletes entities of kind requested before notAfter, paging through them with a cursor. Batches are read
+// one after the other but up to opts.concurrency batches are deleted in parallel. If a delete fails, the returned
+// cursor is where this sweep started from since entities already deleted will no longer match the query.
+func (f *FositeDatastoreStore) sweepKind(ctx context.Context, kind TokenKind, notAfter time.Time, opts sweepOptions) (FlushStats, error) {
+	stats := FlushStats{Kind: kind}
+
+	batchSize := opts.batchSize
+	if batchSize <= 0 || batchSize > dscon.MaxBatchSize {
+		batchSize = dscon.MaxBatchSize
+	}
+	if kind.hasUniqueConstraint() && batchSize*2 > dscon.MaxBatchSize {
+		batchSize = dscon.MaxBatchSize / 2
+	}
+
+	concurrency := opts.concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	query := f.newQueryForKind(string(kind)).Filter("rat<", notAfter).Limit(batchSize)
+	if kind.hasUniqueConstraint() {
+		query = query.Project("rid")
+	} else {
+		query = query.KeysOnly()
+	}
+
+	var cursor datastore.Cursor
+	if opts.cursor != "" {
+		var err error
+		if cursor, err = datastore.DecodeCursor(opts.cursor); err != nil {
+			return stats, errors.WithStack(err)
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, concurrency)
+	)
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	complete := false
+	for batches := 0; !failed() && (opts.maxBatches <= 0 || batches < opts.maxBatches); batches++ {
+		q := query
+		if opts.cursor != "" || batches > 0 {
+			q = q.Start(cursor)
+		}
+
+		keys, uniqueKeys, next, err := f.nextSweepBatch(ctx, kind, q)
+		if err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			mu.Unlock()
+			break
+		}
+
+		if len(keys) > 0 {
+			if opts.dryRun {
+				stats.Deleted += len(keys)
+				stats.Unique += len(uniqueKeys)
+			} else {
+				sem <- struct{}{}
+				wg.Add(1)
+				go func(keys, uniqueKeys []*datastore.Key) {
+					defer func() {
+						<-sem
+						wg.Done()
+					}()
+
+					err := f.client.DeleteMulti(ctx, append(keys, uniqueKeys...))
+
+					mu.Lock()
+					defer mu.Unlock()
+					if err != nil {
+						if firstErr == nil {
+							firstErr = dscon.HandleError(err)
+						}
+						return
+					}
+					stats.Deleted += len(keys)
+					stats.Unique += len(uniqueKeys)
+				}(keys, uniqueKeys)
+			}
+		}
+
+		cursor = next
+		if len(keys) < batchSize {
+			complete = true
+			break
+		}
+	}
+
+	wg.Wait()
+
+	switch {
+	case firstErr != nil:
+		stats.Cursor = opts.cursor
+	case complete:
+		stats.Cursor = ""
+	default:
+		stats.Cursor = cursor.String()
+	}
+
+	return stats, firstErr
+}
+
+// nextSweepBatch loads a single batch of the sweep query, returning the keys to delete and the cursor after the batch
+func (f *FositeDatastoreStore) nextSweepBatch(ctx context.Context, kind TokenKind, q *datastore.Query) ([]*datastore.Key, []*datastore.Key, datastore.Cursor, error) {
+	var keys, uniqueKeys []*datastore.Key
+
+	it := f.client.Run(ctx, q)
+	for {
+		var entity flushEntity
+		var dst interface{}
+		if kind.hasUniqueConstraint() {
+			dst = &entity
+		}
+
+		key, err := it.Next(dst)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, nil, datastore.Cursor{}, dscon.HandleError(err)
+		}
+
+		keys = append(keys, key)
+		if kind.hasUniqueConstraint() {
+			uniqueKeys = append(uniqueKeys, f.createUniqueKey(string(kind), entity.Request))
+		}
+	}
+
+	cursor, err := it.Cursor()
+	if err != nil {
+		return nil, nil, datastore.Cursor{}, dscon.HandleError(err)
+	}
+
+	return keys, uniqueKeys, cursor, nil
+}
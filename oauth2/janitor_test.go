@@ -0,0 +1,181 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth2
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/client"
+	"github.com/sirupsen/logrus"
+)
+
+func createJanitorTestSessions(t *testing.T, store *FositeDatastoreStore, prefix string, requestedAt time.Time, count int) {
+	t.Helper()
+	ctx := context.Background()
+	for i := 0; i < count; i++ {
+		r := &fosite.Request{
+			ID:          fmt.Sprintf("%s-%d", prefix, i),
+			RequestedAt: requestedAt,
+			Client:      &client.Client{ClientID: "foobar"},
+			Session:     &fosite.DefaultSession{Subject: "janitor"},
+		}
+		sig := fmt.Sprintf("%s-sig-%d", prefix, i)
+		if err := store.CreateAccessTokenSession(ctx, sig, r); err != nil {
+			t.Fatalf("could not create access token session: %v", err)
+		}
+		if err := store.CreateAuthorizeCodeSession(ctx, sig, r); err != nil {
+			t.Fatalf("could not create authorize code session: %v", err)
+		}
+		if err := store.CreateRefreshTokenSession(ctx, sig, r); err != nil {
+			t.Fatalf("could not create refresh token session: %v", err)
+		}
+	}
+}
+
+func countKind(t *testing.T, store *FositeDatastoreStore, kind string) int {
+	t.Helper()
+	keys, err := store.client.GetAll(context.Background(), store.newQueryForKind(kind).KeysOnly(), nil)
+	if err != nil {
+		t.Fatalf("could not count %s: %v", kind, err)
+	}
+	return len(keys)
+}
+
+func TestJanitor(t *testing.T) {
+	t.Parallel()
+	m, ok := fositeStores["datastore"].(*FositeDatastoreStore)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	store := NewFositeDatastoreStore(clientManager, m.client, "janitor-test", logrus.New(), time.Hour)
+	createJanitorTestSessions(t, store, "expired", time.Now().Add(-2*time.Hour), 5)
+	createJanitorTestSessions(t, store, "fresh", time.Now(), 2)
+
+	opts := JanitorOptions{
+		Lifespans: map[TokenKind]time.Duration{
+			AccessTokenKind:   time.Hour,
+			AuthorizeCodeKind: time.Hour,
+		},
+		RefreshTokenLifespan: time.Hour,
+		BatchSize:            2,
+		MaxBatches:           1,
+		DryRun:               true,
+	}
+
+	report, err := NewJanitor(store, opts).Run(context.Background())
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if got := report.Stats[AccessTokenKind].Deleted; got != 2 {
+		t.Errorf("dry run reported %d access tokens, want 2", got)
+	}
+	if got := countKind(t, store, hydraOauth2AccessKind); got != 7 {
+		t.Errorf("dry run deleted access tokens, %d left", got)
+	}
+
+	opts.DryRun = false
+	janitor := NewJanitor(store, opts)
+	for i := 0; i < 3; i++ {
+		if _, err := janitor.Run(context.Background()); err != nil {
+			t.Fatalf("run %d failed: %v", i, err)
+		}
+		if i < 2 && janitor.Cursors()[AccessTokenKind] == "" {
+			t.Errorf("expected run %d to leave a cursor behind", i)
+		}
+	}
+
+	if cursors := janitor.Cursors(); len(cursors) != 0 {
+		t.Errorf("expected no cursors after a complete sweep, got %v", cursors)
+	}
+	if got := countKind(t, store, hydraOauth2AccessKind); got != 2 {
+		t.Errorf("expected 2 access tokens left, got %d", got)
+	}
+	if got := countKind(t, store, hydraOauth2AuthCodeKind); got != 2 {
+		t.Errorf("expected 2 authorize codes left, got %d", got)
+	}
+	if got := countKind(t, store, hydraOauth2RefreshKind); got != 2 {
+		t.Errorf("expected 2 refresh tokens left, got %d", got)
+	}
+
+	var unique uniqueConstraint
+	if err := store.client.Get(context.Background(), store.createUniqueKey(hydraOauth2AccessKind, "expired-0"), &unique); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expected unique row to be deleted, got %v", err)
+	}
+	if err := store.client.Get(context.Background(), store.createUniqueKey(hydraOauth2AccessKind, "fresh-0"), &unique); err != nil {
+		t.Errorf("expected unique row to be kept, got %v", err)
+	}
+}
+
+func TestJanitorLifespan(t *testing.T) {
+	store := &FositeDatastoreStore{RefreshTokenReuseWindow: time.Minute}
+
+	// Refresh tokens are kept unless a lifespan is set for them
+	janitor := NewJanitor(store, JanitorOptions{Lifespans: map[TokenKind]time.Duration{AccessTokenKind: time.Hour}})
+	for kind, want := range map[TokenKind]time.Duration{
+		AccessTokenKind:           time.Hour,
+		AuthorizeCodeKind:         0,
+		RefreshTokenKind:          0,
+		RefreshTokenTombstoneKind: time.Minute,
+	} {
+		if got := janitor.lifespan(kind); got != want {
+			t.Errorf("expected the lifespan of %s to be %s, got %s", kind, want, got)
+		}
+	}
+
+	janitor = NewJanitor(store, JanitorOptions{RefreshTokenLifespan: 30 * 24 * time.Hour})
+	if got := janitor.lifespan(RefreshTokenKind); got != 30*24*time.Hour {
+		t.Errorf("expected the refresh token lifespan to be used, got %s", got)
+	}
+	janitor = NewJanitor(store, JanitorOptions{
+		Lifespans:            map[TokenKind]time.Duration{RefreshTokenKind: time.Hour},
+		RefreshTokenLifespan: 30 * 24 * time.Hour,
+	})
+	if got := janitor.lifespan(RefreshTokenKind); got != time.Hour {
+		t.Errorf("expected the lifespan set for refresh tokens to take precedence, got %s", got)
+	}
+}
+
+func TestFlushInactiveAccessTokensWithStats(t *testing.T) {
+	t.Parallel()
+	m, ok := fositeStores["datastore"].(*FositeDatastoreStore)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	store := NewFositeDatastoreStore(clientManager, m.client, "flush-test", logrus.New(), time.Hour)
+	store.FlushConcurrency = 4
+	createJanitorTestSessions(t, store, "expired", time.Now().Add(-2*time.Hour), 12)
+	createJanitorTestSessions(t, store, "fresh", time.Now(), 3)
+
+	stats, err := store.FlushInactiveAccessTokensWithStats(context.Background(), time.Now())
+	if err != nil {
+		t.Fatalf("could not flush access tokens: %v", err)
+	}
+	if stats.Deleted != 12 || stats.Unique != 12 {
+		t.Errorf("expected 12 access tokens and unique rows to be flushed, got %d and %d", stats.Deleted, stats.Unique)
+	}
+	if stats.Cursor != "" {
+		t.Errorf("expected the sweep to complete, got cursor %s", stats.Cursor)
+	}
+	if got := countKind(t, store, hydraOauth2AccessKind); got != 3 {
+		t.Errorf("expected 3 access tokens left, got %d", got)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth2
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// redactedHashPrefix prefixes the values replaced by their hash
+const redactedHashPrefix = "sha256:"
+
+// DefaultRedactedFormParameters are the request form parameters redacted by default. fosite only reads them from the
+// incoming request, never from a stored one.
+var DefaultRedactedFormParameters = []string{
+	"client_secret",
+	"client_assertion",
+	"code",
+	"code_verifier",
+	"refresh_token",
+	"password",
+}
+
+// FormRedactor strips or hashes sensitive parameters of the request forms before they are stored. fosite reads some
+// parameters of stored forms, e.g. redirect_uri, code_challenge and nonce, they must not be redacted.
+type FormRedactor struct {
+	// Allowed lists the only parameters stored as is, every other one is redacted. Denied is used if it is empty.
+	Allowed []string
+	// Denied lists the parameters redacted
+	Denied []string
+	// Hash replaces the values of the redacted parameters by their SHA-256 hash instead of removing them, e.g. to
+	// still compare them when investigating an incident
+	Hash bool
+}
+
+// NewFormRedactor returns a FormRedactor removing DefaultRedactedFormParameters
+func NewFormRedactor() *FormRedactor {
+	return &FormRedactor{Denied: DefaultRedactedFormParameters}
+}
+
+func (r *FormRedactor) redacted(param string) bool {
+	if len(r.Allowed) > 0 {
+		return !contains(r.Allowed, param)
+	}
+	return contains(r.Denied, param)
+}
+
+func contains(params []string, param string) bool {
+	for _, p := range params {
+		if p == param {
+			return true
+		}
+	}
+	return false
+}
+
+func hashFormValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return redactedHashPrefix + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Redact returns a copy of form with the redacted parameters removed or hashed, form is returned as is if r is nil
+func (r *FormRedactor) Redact(form url.Values) url.Values {
+	if r == nil {
+		return form
+	}
+
+	redacted := make(url.Values, len(form))
+	for param, values := range form {
+		if !r.redacted(param) {
+			redacted[param] = values
+		} else if r.Hash {
+			hashed := make([]string, len(values))
+			for i, value := range values {
+				hashed[i] = hashFormValue(value)
+			}
+			redacted[param] = hashed
+		}
+	}
+	return redacted
+}
+
+// redactEncoded redacts a form encoded with url.Values.Encode
+func (r *FormRedactor) redactEncoded(form string) (string, error) {
+	if r == nil {
+		return form, nil
+	}
+
+	values, err := url.ParseQuery(form)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return r.Redact(values).Encode(), nil
+}
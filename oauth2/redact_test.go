@@ -0,0 +1,116 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth2
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestFormRedactor(t *testing.T) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {"the-code"},
+		"client_secret": {"the-secret"},
+		"redirect_uri":  {"https://example.com/cb"},
+	}
+
+	tests := []struct {
+		name     string
+		redactor *FormRedactor
+		expected url.Values
+	}{
+		{"nil", nil, form},
+		{"empty", &FormRedactor{}, form},
+		{"default", NewFormRedactor(), url.Values{
+			"grant_type":   {"authorization_code"},
+			"redirect_uri": {"https://example.com/cb"},
+		}},
+		{"allowed", &FormRedactor{Allowed: []string{"redirect_uri"}, Denied: []string{"redirect_uri"}}, url.Values{
+			"redirect_uri": {"https://example.com/cb"},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.redactor.Redact(form); got.Encode() != test.expected.Encode() {
+				t.Errorf("expected %s, got %s", test.expected.Encode(), got.Encode())
+			}
+		})
+	}
+
+	if len(form) != 4 {
+		t.Errorf("expected the form not to be changed, got %v", form)
+	}
+}
+
+func TestFormRedactorHash(t *testing.T) {
+	redactor := &FormRedactor{Denied: []string{"code"}, Hash: true}
+	redacted := redactor.Redact(url.Values{"code": {"the-code"}})
+	hashed := redacted.Get("code")
+	if !strings.HasPrefix(hashed, redactedHashPrefix) || strings.Contains(hashed, "the-code") {
+		t.Fatalf("expected the code to be hashed, got %s", hashed)
+	}
+
+	// Values looking hashed are hashed all the same, stored forms are redacted only once based on their version
+	if spoofed := redactor.Redact(url.Values{"code": {hashed}}).Get("code"); spoofed == hashed {
+		t.Errorf("expected a value with the hash prefix to be hashed, got %s", spoofed)
+	}
+	encoded, err := redactor.redactEncoded("code=the-code")
+	if err != nil || encoded != (url.Values{"code": {hashed}}).Encode() {
+		t.Errorf("expected the encoded form to be hashed the same, got %s and %v", encoded, err)
+	}
+}
+
+func TestRedactUpgradedForm(t *testing.T) {
+	f := &FositeDatastoreStore{FormRedactor: &FormRedactor{Denied: []string{"password"}, Hash: true}}
+	key := datastore.NameKey(hydraOauth2AuthCodeKind, "signature", nil)
+	form := url.Values{"password": {"the-password"}, "scope": {"openid"}}.Encode()
+
+	for _, test := range []struct {
+		version  int
+		redacted bool
+	}{
+		{1, true},
+		{3, true},
+		{oauth2Version, false},
+	} {
+		var d hydraOauth2Data
+		if err := d.Load([]datastore.Property{{Name: "v", Value: int64(test.version)}, {Name: "fd", Value: form}}); err != nil {
+			t.Fatalf("could not load version %d: %v", test.version, err)
+		}
+
+		updated, err := f.prepareUpdate(context.Background(), key, &d)
+		if err != nil {
+			t.Fatalf("could not prepare the update of version %d: %v", test.version, err)
+		}
+		if redacted := updated.Form != form; redacted != test.redacted {
+			t.Errorf("expected the form of version %d to be redacted: %v, got %s", test.version, test.redacted, updated.Form)
+		}
+		if d.Form != updated.Form {
+			t.Errorf("expected the form to build the request with to be redacted the same, got %s", d.Form)
+		}
+
+		// Written back as the current version, so it is not hashed again
+		again, err := f.prepareUpdate(context.Background(), key, &d)
+		if err != nil || again.Form != updated.Form {
+			t.Errorf("expected the form of version %d to be redacted once, got %s and %v", test.version, again.Form, err)
+		}
+	}
+}
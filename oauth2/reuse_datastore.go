@@ -0,0 +1,179 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth2
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/someone1/hydra-gcp/dscon"
+)
+
+const (
+	hydraOauth2RefreshTombstoneKind = "HydraOauth2RefreshTombstone"
+
+	// DefaultRefreshTokenReuseWindow is how long rotated refresh tokens are kept to detect their reuse by default
+	DefaultRefreshTokenReuseWindow = 24 * time.Hour
+)
+
+// refreshTokenTombstone is kept in place of a rotated or revoked refresh token, under the same signature
+type refreshTokenTombstone struct {
+	Request string `datastore:"rid"`
+	Client  string `datastore:"cid"`
+	Subject string `datastore:"sub"`
+	// RevokedAt is stored as rat so the Janitor sweeps tombstones by when they were revoked
+	RevokedAt time.Time `datastore:"rat"`
+}
+
+// RefreshTokenReuse describes a refresh token presented again after it was rotated or revoked
+type RefreshTokenReuse struct {
+	// Signature of the reused refresh token
+	Signature string
+	// RequestID shared by the tokens that were revoked
+	RequestID string
+	ClientID  string
+	Subject   string
+	// RevokedAt is when the reused refresh token was rotated or revoked
+	RevokedAt time.Time
+	// AccessTokens and RefreshTokens are the numbers of active tokens that were revoked
+	AccessTokens  int
+	RefreshTokens int
+}
+
+// RefreshTokenReuseHook is notified of every reuse of a refresh token, once the tokens of its request were revoked
+type RefreshTokenReuseHook func(ctx context.Context, reuse RefreshTokenReuse)
+
+// OnRefreshTokenReuse adds hook to the hooks notified of reused refresh tokens. It must be called before the store is
+// used.
+func (f *FositeDatastoreStore) OnRefreshTokenReuse(hook RefreshTokenReuseHook) {
+	f.reuseHooks = append(f.reuseHooks, hook)
+}
+
+func (f *FositeDatastoreStore) createRefreshTombstoneKey(sig string) *datastore.Key {
+	return f.createKeyForKind(sig, hydraOauth2RefreshTombstoneKind)
+}
+
+// tombstoneRefreshTokens replaces the refresh tokens of request id, and their Unique row, with tombstones
+func (f *FositeDatastoreStore) tombstoneRefreshTokens(ctx context.Context, id string) error {
+	var tokens []hydraOauth2Data
+	keys, err := f.client.GetAll(ctx, f.newQueryForKind(hydraOauth2RefreshKind).Filter("rid=", id), &tokens)
+	if err != nil {
+		return dscon.HandleError(err)
+	}
+	if len(keys) == 0 {
+		return errors.Wrap(fosite.ErrNotFound, "")
+	}
+
+	now := time.Now().UTC()
+	mutations := make([]*datastore.Mutation, 0, len(keys)*2+1)
+	for i, key := range keys {
+		tombstone := &refreshTokenTombstone{
+			Request:   id,
+			Client:    tokens[i].Client,
+			Subject:   tokens[i].Subject,
+			RevokedAt: now,
+		}
+		mutations = append(mutations, datastore.NewDelete(key), datastore.NewUpsert(f.createRefreshTombstoneKey(key.Name), tombstone))
+	}
+	mutations = append(mutations, datastore.NewDelete(f.createUniqueKey(hydraOauth2RefreshKind, id)))
+
+	_, err = dscon.RunInTransaction(ctx, f.client, func(t *datastore.Transaction) error {
+		_, terr := t.Mutate(mutations...)
+		return terr
+	})
+	if err != nil {
+		return dscon.HandleError(err)
+	}
+	return nil
+}
+
+// detectRefreshTokenReuse reports whether signature is the one of a refresh token rotated or revoked within the reuse
+// window, in which case every active token of its request is revoked and the reuse reported.
+func (f *FositeDatastoreStore) detectRefreshTokenReuse(ctx context.Context, signature string) (bool, error) {
+	var t refreshTokenTombstone
+	if err := f.client.Get(ctx, f.createRefreshTombstoneKey(signature), &t); err == datastore.ErrNoSuchEntity {
+		return false, nil
+	} else if err != nil {
+		return false, dscon.HandleError(err)
+	}
+	// Tombstones are only flushed by the Janitor
+	if time.Since(t.RevokedAt) > f.RefreshTokenReuseWindow {
+		return false, nil
+	}
+
+	reuse := RefreshTokenReuse{
+		Signature: signature,
+		RequestID: t.Request,
+		ClientID:  t.Client,
+		Subject:   t.Subject,
+		RevokedAt: t.RevokedAt,
+	}
+	var err error
+	if reuse.AccessTokens, reuse.RefreshTokens, err = f.revokeTokenFamily(ctx, t.Request); err != nil {
+		return true, err
+	}
+
+	f.L.WithFields(logrus.Fields{
+		"request_id":     reuse.RequestID,
+		"client_id":      reuse.ClientID,
+		"subject":        reuse.Subject,
+		"revoked_at":     reuse.RevokedAt,
+		"access_tokens":  reuse.AccessTokens,
+		"refresh_tokens": reuse.RefreshTokens,
+	}).Warnf("A revoked refresh token was reused, every token of its request was revoked")
+	for _, hook := range f.reuseHooks {
+		hook(ctx, reuse)
+	}
+	return true, nil
+}
+
+// revokeTokenFamily deletes every access and refresh token of request id, along with their Unique rows, in a single
+// transaction. Tombstones are kept so further reuses are detected as well.
+func (f *FositeDatastoreStore) revokeTokenFamily(ctx context.Context, id string) (int, int, error) {
+	var counts [2]int
+	var mutations []*datastore.Mutation
+	for i, kind := range []string{hydraOauth2AccessKind, hydraOauth2RefreshKind} {
+		keys, err := f.client.GetAll(ctx, f.newQueryForKind(kind).Filter("rid=", id).KeysOnly(), nil)
+		if err != nil {
+			return 0, 0, dscon.HandleError(err)
+		}
+		if len(keys) == 0 {
+			continue
+		}
+
+		counts[i] = len(keys)
+		for _, key := range keys {
+			mutations = append(mutations, datastore.NewDelete(key))
+		}
+		mutations = append(mutations, datastore.NewDelete(f.createUniqueKey(kind, id)))
+	}
+	if len(mutations) == 0 {
+		return 0, 0, nil
+	}
+
+	_, err := dscon.RunInTransaction(ctx, f.client, func(t *datastore.Transaction) error {
+		_, terr := t.Mutate(mutations...)
+		return terr
+	})
+	if err != nil {
+		return 0, 0, dscon.HandleError(err)
+	}
+	return counts[0], counts[1], nil
+}
@@ -0,0 +1,132 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRefreshTokenReuse(t *testing.T) {
+	t.Parallel()
+	m, ok := fositeStores["datastore"].(*FositeDatastoreStore)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	ctx := context.Background()
+	store := NewFositeDatastoreStore(clientManager, m.client, "reuse-test", logrus.New(), time.Hour)
+	var reuses []RefreshTokenReuse
+	store.OnRefreshTokenReuse(func(_ context.Context, reuse RefreshTokenReuse) {
+		reuses = append(reuses, reuse)
+	})
+
+	r := &fosite.Request{
+		ID:          "reuse-request",
+		RequestedAt: time.Now(),
+		Client:      &client.Client{ClientID: "foobar"},
+		Session:     &fosite.DefaultSession{Subject: "reuse"},
+	}
+	if err := store.CreateAccessTokenSession(ctx, "access-1", r); err != nil {
+		t.Fatalf("could not create access token session: %v", err)
+	}
+	if err := store.CreateRefreshTokenSession(ctx, "refresh-1", r); err != nil {
+		t.Fatalf("could not create refresh token session: %v", err)
+	}
+
+	// Rotate the tokens the way fosite does
+	if err := store.RevokeAccessToken(ctx, r.ID); err != nil {
+		t.Fatalf("could not revoke access token: %v", err)
+	}
+	if err := store.RevokeRefreshToken(ctx, r.ID); err != nil {
+		t.Fatalf("could not revoke refresh token: %v", err)
+	}
+	if err := store.CreateAccessTokenSession(ctx, "access-2", r); err != nil {
+		t.Fatalf("could not create access token session: %v", err)
+	}
+	if err := store.CreateRefreshTokenSession(ctx, "refresh-2", r); err != nil {
+		t.Fatalf("could not create refresh token session: %v", err)
+	}
+	if _, err := store.GetRefreshTokenSession(ctx, "refresh-2", &fosite.DefaultSession{}); err != nil {
+		t.Fatalf("expected the rotated refresh token to be valid: %v", err)
+	}
+	if len(reuses) != 0 {
+		t.Fatalf("expected rotating tokens not to be reported, got %+v", reuses)
+	}
+
+	// Presenting the rotated token again revokes the whole family
+	if _, err := store.GetRefreshTokenSession(ctx, "refresh-1", &fosite.DefaultSession{}); errors.Cause(err) != fosite.ErrNotFound {
+		t.Fatalf("expected the reused refresh token to be rejected, got %v", err)
+	}
+	if len(reuses) != 1 {
+		t.Fatalf("expected the reuse to be reported once, got %+v", reuses)
+	}
+	if reuse := reuses[0]; reuse.RequestID != r.ID || reuse.ClientID != "foobar" || reuse.Subject != "reuse" ||
+		reuse.AccessTokens != 1 || reuse.RefreshTokens != 1 {
+		t.Errorf("unexpected reuse %+v", reuse)
+	}
+	if _, err := store.GetRefreshTokenSession(ctx, "refresh-2", &fosite.DefaultSession{}); errors.Cause(err) != fosite.ErrNotFound {
+		t.Errorf("expected the current refresh token to be revoked, got %v", err)
+	}
+	if _, err := store.GetAccessTokenSession(ctx, "access-2", &fosite.DefaultSession{}); errors.Cause(err) != fosite.ErrNotFound {
+		t.Errorf("expected the current access token to be revoked, got %v", err)
+	}
+
+	// Tombstones are only considered within the reuse window, and swept by the Janitor afterwards
+	store.RefreshTokenReuseWindow = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, err := store.GetRefreshTokenSession(ctx, "refresh-1", &fosite.DefaultSession{}); errors.Cause(err) != fosite.ErrNotFound {
+		t.Errorf("expected the refresh token not to be found, got %v", err)
+	}
+	if len(reuses) != 1 {
+		t.Errorf("expected a reuse outside of the window not to be reported, got %+v", reuses)
+	}
+
+	if _, err := NewJanitor(store, JanitorOptions{}).Run(ctx); err != nil {
+		t.Fatalf("could not run janitor: %v", err)
+	}
+	if got := countKind(t, store, hydraOauth2RefreshTombstoneKind); got != 0 {
+		t.Errorf("expected the tombstones to be flushed, %d left", got)
+	}
+}
+
+func TestRevokeRefreshTokenWithoutReuseWindow(t *testing.T) {
+	t.Parallel()
+	m, ok := fositeStores["datastore"].(*FositeDatastoreStore)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	ctx := context.Background()
+	store := NewFositeDatastoreStore(clientManager, m.client, "reuse-disabled-test", logrus.New(), time.Hour)
+	store.RefreshTokenReuseWindow = 0
+
+	r := &fosite.Request{ID: "request", RequestedAt: time.Now(), Client: &client.Client{ClientID: "foobar"}, Session: &fosite.DefaultSession{}}
+	if err := store.CreateRefreshTokenSession(ctx, "refresh", r); err != nil {
+		t.Fatalf("could not create refresh token session: %v", err)
+	}
+	if err := store.RevokeRefreshToken(ctx, r.ID); err != nil {
+		t.Fatalf("could not revoke refresh token: %v", err)
+	}
+	if got := countKind(t, store, hydraOauth2RefreshTombstoneKind); got != 0 {
+		t.Errorf("expected no tombstone to be kept, got %d", got)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth2
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/herodot"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+
+	dclient "github.com/someone1/hydra-gcp/client"
+	"github.com/someone1/hydra-gcp/dscon"
+)
+
+// ErrTokenFilterRequired is returned by RevokeTokens when no filter is set, so every token is not revoked by mistake
+var ErrTokenFilterRequired = &herodot.DefaultError{
+	StatusField: http.StatusText(http.StatusBadRequest),
+	ErrorField:  "At least one of subject, client_id or issued_before must be given",
+	CodeField:   http.StatusBadRequest,
+}
+
+// TokenFilter selects the tokens matching every field set
+type TokenFilter struct {
+	// Limit is the maximum number of tokens to return
+	Limit int
+	// Cursor is the opaque cursor returned with the previous page, the first page is returned if empty. Limit and
+	// Cursor are ignored when revoking tokens.
+	Cursor string
+
+	// Subject matches the tokens issued to this subject
+	Subject string
+	// ClientID matches the tokens issued to this client
+	ClientID string
+	// IssuedBefore matches the tokens requested before this time
+	IssuedBefore time.Time
+}
+
+func (t TokenFilter) empty() bool {
+	return t.Subject == "" && t.ClientID == "" && t.IssuedBefore.IsZero()
+}
+
+// TokenInfo describes an access or refresh token, neither the token nor its signature are exposed
+type TokenInfo struct {
+	RequestID     string    `json:"request_id"`
+	ClientID      string    `json:"client_id"`
+	Subject       string    `json:"subject"`
+	GrantedScopes []string  `json:"granted_scopes"`
+	RequestedAt   time.Time `json:"requested_at"`
+}
+
+// RevokeStats reports how many tokens RevokeTokens revoked
+type RevokeStats struct {
+	AccessTokens  int `json:"access_tokens"`
+	RefreshTokens int `json:"refresh_tokens"`
+}
+
+// tokenQuery returns the query of the tokens of kind matching filter, newest first
+func (f *FositeDatastoreStore) tokenQuery(kind TokenKind, filter TokenFilter) *datastore.Query {
+	query := f.newQueryForKind(string(kind))
+	if filter.Subject != "" {
+		query = query.Filter("sub =", filter.Subject)
+	}
+	if filter.ClientID != "" {
+		query = query.Filter("cid =", filter.ClientID)
+	}
+	if !filter.IssuedBefore.IsZero() {
+		query = query.Filter("rat <", filter.IssuedBefore)
+	}
+	return query.Order("-rat")
+}
+
+// ListTokens returns a page of the active tokens of kind, AccessTokenKind or RefreshTokenKind, matching filter along
+// with the cursor of the next page. Tokens are ordered from the newest to the oldest, access tokens older than the
+// access token lifespan are left out. The returned cursor is empty on the last page.
+func (f *FositeDatastoreStore) ListTokens(ctx context.Context, kind TokenKind, filter TokenFilter) ([]TokenInfo, string, error) {
+	ctx, span := f.tracer.StartSpan(ctx, "ListTokens", string(kind))
+	defer span.End()
+
+	if kind != AccessTokenKind && kind != RefreshTokenKind {
+		return nil, "", errors.Errorf("expected the access or refresh token kind, got %s", kind)
+	}
+	if filter.Limit <= 0 {
+		return nil, "", errors.Errorf("expected a positive limit, got %d", filter.Limit)
+	}
+
+	query := f.tokenQuery(kind, filter)
+	if kind == AccessTokenKind && f.AccessTokenLifespan > 0 {
+		query = query.Filter("rat >", time.Now().Add(-f.AccessTokenLifespan))
+	}
+	if filter.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", errors.WithStack(dclient.ErrInvalidCursor)
+		}
+		query = query.Start(cursor)
+	}
+	// Fetch one more token to know if there is a next page
+	query = query.Limit(filter.Limit + 1)
+
+	tokens := make([]TokenInfo, 0, filter.Limit)
+	var next string
+	var more bool
+
+	it := f.client.Run(ctx, query)
+	for {
+		var d hydraOauth2Data
+		_, err := it.Next(&d)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, "", dscon.HandleError(err)
+		}
+
+		if len(tokens) == filter.Limit {
+			// The cursor was taken after the last token of the page
+			more = true
+			break
+		}
+
+		tokens = append(tokens, TokenInfo{
+			RequestID:     d.Request,
+			ClientID:      d.Client,
+			Subject:       d.Subject,
+			GrantedScopes: strings.Split(d.GrantedScopes, "|"),
+			RequestedAt:   d.RequestedAt,
+		})
+
+		if len(tokens) == filter.Limit {
+			cursor, err := it.Cursor()
+			if err != nil {
+				return nil, "", errors.WithStack(err)
+			}
+			next = cursor.String()
+		}
+	}
+
+	if !more {
+		next = ""
+	}
+	dscon.SetEntityCount(span, len(tokens))
+	return tokens, next, nil
+}
+
+// RevokeTokens deletes every access and refresh token matching filter, along with their Unique rows, whether they
+// expired or not. At least one of the fields of filter must be set. Tokens are deleted in batches, the ones deleted
+// before an error occurred stay revoked.
+func (f *FositeDatastoreStore) RevokeTokens(ctx context.Context, filter TokenFilter) (RevokeStats, error) {
+	ctx, span := f.tracer.StartSpan(ctx, "RevokeTokens", "")
+	defer span.End()
+
+	var stats RevokeStats
+	if filter.empty() {
+		return stats, errors.WithStack(ErrTokenFilterRequired)
+	}
+
+	var err error
+	if stats.AccessTokens, err = f.revokeTokens(ctx, AccessTokenKind, filter); err != nil {
+		return stats, err
+	}
+	stats.RefreshTokens, err = f.revokeTokens(ctx, RefreshTokenKind, filter)
+	dscon.SetEntityCount(span, stats.AccessTokens+stats.RefreshTokens)
+	return stats, err
+}
+
+func (f *FositeDatastoreStore) revokeTokens(ctx context.Context, kind TokenKind, filter TokenFilter) (int, error) {
+	// Every token counts twice with its Unique row
+	batchSize := dscon.MaxBatchSize / 2
+	query := f.tokenQuery(kind, filter).KeysOnly().Limit(batchSize)
+
+	var revoked int
+	var cursor *datastore.Cursor
+	for {
+		q := query
+		if cursor != nil {
+			q = q.Start(*cursor)
+		}
+
+		var keys []*datastore.Key
+		it := f.client.Run(ctx, q)
+		for {
+			key, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			} else if err != nil {
+				return revoked, dscon.HandleError(err)
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			return revoked, nil
+		}
+
+		n, err := f.deleteTokens(ctx, kind, keys)
+		revoked += n
+		if err != nil {
+			return revoked, err
+		}
+		if len(keys) < batchSize {
+			return revoked, nil
+		}
+
+		next, err := it.Cursor()
+		if err != nil {
+			return revoked, errors.WithStack(err)
+		}
+		cursor = &next
+	}
+}
+
+// deleteTokens deletes the tokens of kind at keys along with their Unique rows, tokens deleted concurrently are skipped
+func (f *FositeDatastoreStore) deleteTokens(ctx context.Context, kind TokenKind, keys []*datastore.Key) (int, error) {
+	tokens := make([]hydraOauth2Data, len(keys))
+	err := f.client.GetMulti(ctx, keys, tokens)
+	merr, _ := err.(datastore.MultiError)
+	if err != nil && merr == nil {
+		return 0, dscon.HandleError(err)
+	}
+
+	var deletes []*datastore.Key
+	requests := make(map[string]bool)
+	for i, key := range keys {
+		if merr != nil && merr[i] == datastore.ErrNoSuchEntity {
+			continue
+		} else if merr != nil && merr[i] != nil {
+			return 0, dscon.HandleError(merr[i])
+		}
+
+		deletes = append(deletes, key)
+		if !requests[tokens[i].Request] {
+			requests[tokens[i].Request] = true
+			deletes = append(deletes, f.createUniqueKey(string(kind), tokens[i].Request))
+		}
+	}
+	if len(deletes) == 0 {
+		return 0, nil
+	}
+
+	if err := f.client.DeleteMulti(ctx, deletes); err != nil {
+		return 0, dscon.HandleError(err)
+	}
+	return len(deletes) - len(requests), nil
+}
@@ -0,0 +1,179 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/herodot"
+	"github.com/ory/hydra/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func createTokenTestSessions(t *testing.T, store *FositeDatastoreStore, clientID, subject string, requestedAt time.Time, count int) {
+	t.Helper()
+	ctx := context.Background()
+	for i := 0; i < count; i++ {
+		r := &fosite.Request{
+			ID:            fmt.Sprintf("%s-%s-%d", clientID, subject, i),
+			RequestedAt:   requestedAt.Add(time.Duration(i) * time.Second),
+			Client:        &client.Client{ClientID: clientID},
+			Session:       &fosite.DefaultSession{Subject: subject},
+			GrantedScopes: fosite.Arguments{"offline", "openid"},
+		}
+		if err := store.CreateAccessTokenSession(ctx, "access-"+r.ID, r); err != nil {
+			t.Fatalf("could not create access token session: %v", err)
+		}
+		if err := store.CreateRefreshTokenSession(ctx, "refresh-"+r.ID, r); err != nil {
+			t.Fatalf("could not create refresh token session: %v", err)
+		}
+	}
+}
+
+func TestListAndRevokeTokens(t *testing.T) {
+	t.Parallel()
+	m, ok := fositeStores["datastore"].(*FositeDatastoreStore)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	ctx := context.Background()
+	store := NewFositeDatastoreStore(clientManager, m.client, "tokens-test", logrus.New(), time.Hour)
+	createTokenTestSessions(t, store, "foobar", "alice", time.Now().Add(-time.Minute), 3)
+	createTokenTestSessions(t, store, "foobar", "bob", time.Now().Add(-time.Minute), 1)
+	createTokenTestSessions(t, store, "barfoo", "alice", time.Now().Add(-2*time.Hour), 2)
+
+	tokens, next, err := store.ListTokens(ctx, AccessTokenKind, TokenFilter{Limit: 10, Subject: "alice"})
+	if err != nil {
+		t.Fatalf("could not list tokens: %v", err)
+	}
+	if len(tokens) != 3 || next != "" {
+		t.Errorf("expected the 3 active access tokens of alice, got %d and cursor %q", len(tokens), next)
+	}
+	if len(tokens) > 0 && (tokens[0].RequestID != "foobar-alice-2" || len(tokens[0].GrantedScopes) != 2) {
+		t.Errorf("expected the newest token first with its scopes, got %+v", tokens[0])
+	}
+
+	tokens, next, err = store.ListTokens(ctx, RefreshTokenKind, TokenFilter{Limit: 4, Subject: "alice"})
+	if err != nil {
+		t.Fatalf("could not list tokens: %v", err)
+	}
+	if len(tokens) != 4 || next == "" {
+		t.Fatalf("expected 4 refresh tokens and a next page, got %d and cursor %q", len(tokens), next)
+	}
+	if tokens, next, err = store.ListTokens(ctx, RefreshTokenKind, TokenFilter{Limit: 4, Subject: "alice", Cursor: next}); err != nil {
+		t.Fatalf("could not list tokens: %v", err)
+	} else if len(tokens) != 1 || next != "" {
+		t.Errorf("expected the last refresh token on the next page, got %d and cursor %q", len(tokens), next)
+	}
+
+	if _, err := store.RevokeTokens(ctx, TokenFilter{}); errors.Cause(err) != ErrTokenFilterRequired {
+		t.Errorf("expected an empty filter to be rejected, got %v", err)
+	}
+
+	stats, err := store.RevokeTokens(ctx, TokenFilter{Subject: "alice", ClientID: "foobar"})
+	if err != nil {
+		t.Fatalf("could not revoke tokens: %v", err)
+	}
+	if stats.AccessTokens != 3 || stats.RefreshTokens != 3 {
+		t.Errorf("expected 3 access and refresh tokens to be revoked, got %+v", stats)
+	}
+	if _, err := store.GetRefreshTokenSession(ctx, "refresh-foobar-alice-0", &fosite.DefaultSession{}); errors.Cause(err) != fosite.ErrNotFound {
+		t.Errorf("expected the refresh token to be revoked, got %v", err)
+	}
+	if _, err := store.GetAccessTokenSession(ctx, "access-foobar-bob-0", &fosite.DefaultSession{}); err != nil {
+		t.Errorf("expected the access token of bob to be kept: %v", err)
+	}
+
+	stats, err = store.RevokeTokens(ctx, TokenFilter{IssuedBefore: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatalf("could not revoke tokens: %v", err)
+	}
+	if stats.AccessTokens != 2 || stats.RefreshTokens != 2 {
+		t.Errorf("expected the 2 old access and refresh tokens to be revoked, got %+v", stats)
+	}
+}
+
+func TestTokenHandler(t *testing.T) {
+	t.Parallel()
+	m, ok := fositeStores["datastore"].(*FositeDatastoreStore)
+	if !ok {
+		t.Fatal("could not get datastore connection")
+	}
+
+	store := NewFositeDatastoreStore(clientManager, m.client, "tokens-handler-test", logrus.New(), time.Hour)
+	createTokenTestSessions(t, store, "foobar", "alice", time.Now().Add(-time.Minute), 3)
+
+	handler := NewTokenHandler(store, herodot.NewJSONWriter(logrus.New()))
+	get := func(target string) ([]TokenInfo, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		handler.List(w, httptest.NewRequest(http.MethodGet, target, nil), nil)
+		var tokens []TokenInfo
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil {
+				t.Fatalf("could not decode tokens: %v", err)
+			}
+		}
+		return tokens, w
+	}
+	revoke := func(target string) (RevokeStats, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		handler.Revoke(w, httptest.NewRequest(http.MethodDelete, target, nil), nil)
+		var stats RevokeStats
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+				t.Fatalf("could not decode stats: %v", err)
+			}
+		}
+		return stats, w
+	}
+
+	tokens, w := get(TokensPath + "?token_type=refresh_token&subject=alice&limit=2")
+	link := w.Header().Get("Link")
+	if len(tokens) != 2 || !strings.HasPrefix(link, "<"+TokensPath+"?") || !strings.Contains(link, "token_type=refresh_token") {
+		t.Fatalf("expected 2 refresh tokens and a next page, got %d and %q", len(tokens), link)
+	}
+	tokens, w = get(strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`))
+	if len(tokens) != 1 || w.Header().Get("Link") != "" {
+		t.Errorf("expected the last refresh token on the next page, got %d and %q", len(tokens), w.Header().Get("Link"))
+	}
+
+	if _, w = get(TokensPath + "?token_type=id_token"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown token type, got %d", w.Code)
+	}
+	if _, w = get(TokensPath + "?issued_before=yesterday"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid date, got %d", w.Code)
+	}
+	if _, w = revoke(TokensPath); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 when revoking without a filter, got %d", w.Code)
+	}
+
+	stats, w := revoke(TokensPath + "?client_id=foobar")
+	if w.Code != http.StatusOK || stats.AccessTokens != 3 || stats.RefreshTokens != 3 {
+		t.Errorf("expected every token of the client to be revoked, got %d and %+v", w.Code, stats)
+	}
+	if tokens, _ = get(TokensPath + "?client_id=foobar"); len(tokens) != 0 {
+		t.Errorf("expected no token to be left, got %d", len(tokens))
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright © 2018 Prateek Malhotra <someone1@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth2
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ory/fosite"
+	"github.com/ory/herodot"
+	"github.com/ory/x/pagination"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TokensPath is where the admin API listing and revoking tokens is served
+	TokensPath = "/oauth2/tokens"
+
+	defaultTokenListLimit = 100
+	maxTokenListLimit     = 500
+)
+
+// tokenFilterParams are the query parameters filtering the tokens, see TokenFilter
+var tokenFilterParams = []string{"token_type", "subject", "client_id", "issued_before"}
+
+// TokenHandler serves the admin API listing and revoking tokens by subject, client or issuance
+type TokenHandler struct {
+	Store *FositeDatastoreStore
+	H     herodot.Writer
+}
+
+// NewTokenHandler returns a TokenHandler listing and revoking the tokens of store
+func NewTokenHandler(store *FositeDatastoreStore, h herodot.Writer) *TokenHandler {
+	return &TokenHandler{Store: store, H: h}
+}
+
+// SetRoutes registers the token routes on r
+func (h *TokenHandler) SetRoutes(r *httprouter.Router) {
+	r.GET(TokensPath, h.List)
+	r.DELETE(TokensPath, h.Revoke)
+}
+
+func badTokenRequest(reason string) error {
+	return errors.WithStack(&herodot.DefaultError{
+		StatusField: http.StatusText(http.StatusBadRequest),
+		ErrorField:  "The token filter is invalid",
+		ReasonField: reason,
+		CodeField:   http.StatusBadRequest,
+	})
+}
+
+// decodeFilter reads the `subject`, `client_id` and `issued_before` (RFC 3339) query parameters
+func decodeFilter(query url.Values) (TokenFilter, error) {
+	filter := TokenFilter{
+		Cursor:   query.Get("cursor"),
+		Subject:  query.Get("subject"),
+		ClientID: query.Get("client_id"),
+	}
+
+	if issuedBefore := query.Get("issued_before"); issuedBefore != "" {
+		t, err := time.Parse(time.RFC3339, issuedBefore)
+		if err != nil {
+			return filter, badTokenRequest("issued_before must be an RFC 3339 date")
+		}
+		filter.IssuedBefore = t
+	}
+	return filter, nil
+}
+
+// List serves a page of the active tokens of the `token_type` query parameter, `access_token` (the default) or
+// `refresh_token`. The page is selected with the `limit` and `cursor` query parameters, the tokens may be filtered with
+// the `subject`, `client_id` and `issued_before` query parameters. The next page is linked in the Link header.
+func (h *TokenHandler) List(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	filter, err := decodeFilter(query)
+	if err != nil {
+		h.H.WriteError(w, r, err)
+		return
+	}
+
+	kind := AccessTokenKind
+	switch fosite.TokenType(query.Get("token_type")) {
+	case "", fosite.AccessToken:
+	case fosite.RefreshToken:
+		kind = RefreshTokenKind
+	default:
+		h.H.WriteError(w, r, badTokenRequest("token_type must be access_token or refresh_token"))
+		return
+	}
+
+	filter.Limit, _ = pagination.Parse(r, defaultTokenListLimit, 0, maxTokenListLimit)
+	if filter.Limit == 0 {
+		filter.Limit = defaultTokenListLimit
+	}
+
+	tokens, next, err := h.Store.ListTokens(r.Context(), kind, filter)
+	if err != nil {
+		h.H.WriteError(w, r, err)
+		return
+	}
+
+	if next != "" {
+		nextQuery := url.Values{}
+		for _, param := range tokenFilterParams {
+			if value := query.Get(param); value != "" {
+				nextQuery.Set(param, value)
+			}
+		}
+		nextQuery.Set("limit", fmt.Sprintf("%d", filter.Limit))
+		nextQuery.Set("cursor", next)
+		w.Header().Add("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, TokensPath, nextQuery.Encode()))
+	}
+
+	h.H.Write(w, r, tokens)
+}
+
+// Revoke revokes every access and refresh token matching the `subject`, `client_id` and `issued_before` query
+// parameters, at least one of them must be given. It responds with how many tokens were revoked.
+func (h *TokenHandler) Revoke(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	filter, err := decodeFilter(r.URL.Query())
+	if err != nil {
+		h.H.WriteError(w, r, err)
+		return
+	}
+
+	stats, err := h.Store.RevokeTokens(r.Context(), filter)
+	if err != nil {
+		h.H.WriteError(w, r, err)
+		return
+	}
+
+	h.H.Write(w, r, &stats)
+}
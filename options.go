@@ -0,0 +1,462 @@
+package hydragcp
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+
+	gcontext "github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"github.com/ory/fosite"
+	"github.com/ory/go-convenience/stringslice"
+	"github.com/ory/go-convenience/stringsx"
+	"github.com/ory/herodot"
+	"github.com/ory/hydra/cmd/server"
+	"github.com/ory/hydra/config"
+	"github.com/ory/hydra/jwk"
+	hoauth2 "github.com/ory/hydra/oauth2"
+	"github.com/pkg/errors"
+	"github.com/rs/cors"
+	"github.com/sirupsen/logrus"
+	"github.com/someone1/gcp-jwt-go"
+	"github.com/urfave/negroni"
+
+	"github.com/someone1/fosite-gcp-oauth2"
+	dclient "github.com/someone1/hydra-gcp/client"
+	dconfig "github.com/someone1/hydra-gcp/config"
+	"github.com/someone1/hydra-gcp/envelope"
+	"github.com/someone1/hydra-gcp/invalidation"
+	djwk "github.com/someone1/hydra-gcp/jwk"
+	doauth2 "github.com/someone1/hydra-gcp/oauth2"
+)
+
+// Option configures the handlers returned by New
+type Option func(*options)
+
+// signerFunc creates the strategy used to sign JWTs along with the source of the public keys to verify them with
+type signerFunc func(ctx context.Context) (jwk.JWTStrategy, KeySetSource, error)
+
+type options struct {
+	signer      signerFunc
+	cors        *cors.Options
+	frontCORS   *cors.Options
+	middlewares []negroni.Handler
+	jwksOptions JWKSOptions
+	jwksHandler http.Handler
+	idTokenKeys bool
+	hasher      fosite.Hasher
+	logger      logrus.FieldLogger
+	writer      herodot.Writer
+	tracer      negroni.Handler
+	connection  config.BackendConnector
+	dsTracing   bool
+	clientCache *dclient.CacheOptions
+	bus         *invalidation.Bus
+	encrypter   *envelope.Encrypter
+	redactor    *doauth2.FormRedactor
+	kmsCipher   *djwk.KMSCipher
+}
+
+// WithIAMSigner signs JWTs with the service account configured in iamconfig using the IAM API. The frontend serves the
+// public keys Google publishes for the service account.
+func WithIAMSigner(iamconfig *gcpjwt.IAMConfig) Option {
+	return func(o *options) {
+		o.signer = func(ctx context.Context) (jwk.JWTStrategy, KeySetSource, error) {
+			strategy := oauth2.NewIAMStrategy(ctx, gcpjwt.SigningMethodIAMJWT, iamconfig)
+			return strategy, &RemoteKeySetSource{URL: serviceAccountJWKSURL(iamconfig.ServiceAccount), Client: iamconfig.Client}, nil
+		}
+	}
+}
+
+// WithKMSSigner signs JWTs with the Cloud KMS asymmetric signing key version configured in kmsconfig. signingMethod
+// must match the algorithm of the key version, e.g. gcpjwt.SigningMethodKMSRS256. The frontend serves the public keys
+// of every enabled version of the crypto key so tokens signed by previous versions can still be verified.
+func WithKMSSigner(kmsconfig *gcpjwt.KMSConfig, signingMethod *gcpjwt.SigningMethodKMS) Option {
+	return func(o *options) {
+		o.signer = func(ctx context.Context) (jwk.JWTStrategy, KeySetSource, error) {
+			strategy, err := newKMSStrategy(ctx, kmsconfig, signingMethod)
+			if err != nil {
+				return nil, nil, err
+			}
+			return strategy, strategy.keys, nil
+		}
+	}
+}
+
+// WithSigner signs JWTs with strategy, keys is the source of the public keys served by the frontend to verify them.
+func WithSigner(strategy jwk.JWTStrategy, keys KeySetSource) Option {
+	return func(o *options) {
+		o.signer = func(ctx context.Context) (jwk.JWTStrategy, KeySetSource, error) {
+			return strategy, keys, nil
+		}
+	}
+}
+
+// WithCORS enables CORS on the backend, as Hydra does when CORS_ENABLED is set. The frontend is left alone, see
+// WithFrontendCORS.
+func WithCORS(corsOptions cors.Options) Option {
+	return func(o *options) {
+		o.cors = &corsOptions
+	}
+}
+
+// WithFrontendCORS enables CORS on the frontend. Unless corsOptions sets its own AllowOriginRequestFunc, requests are
+// also allowed from the AllowedCORSOrigins of the client authenticating the request.
+func WithFrontendCORS(corsOptions cors.Options) Option {
+	return func(o *options) {
+		o.frontCORS = &corsOptions
+	}
+}
+
+// WithMiddleware adds negroni middlewares to both handlers, they are run in the order they are given.
+func WithMiddleware(middlewares ...negroni.Handler) Option {
+	return func(o *options) {
+		o.middlewares = append(o.middlewares, middlewares...)
+	}
+}
+
+// WithJWKSOptions configures the handler serving the public keys of the signer on the frontend
+func WithJWKSOptions(jwksOptions JWKSOptions) Option {
+	return func(o *options) {
+		o.jwksOptions = jwksOptions
+	}
+}
+
+// WithIDTokenKeys merges the public keys of Hydra's own ID Token key set into the JWKS served by the frontend
+func WithIDTokenKeys() Option {
+	return func(o *options) {
+		o.idTokenKeys = true
+	}
+}
+
+// WithJWKSHandler replaces the handler serving the JWKS on the frontend, options given with WithJWKSOptions and
+// WithIDTokenKeys are ignored.
+func WithJWKSHandler(handler http.Handler) Option {
+	return func(o *options) {
+		o.jwksHandler = handler
+	}
+}
+
+// WithHasher sets the fosite.Hasher used for client secrets, the PHCHasher returned by NewPHCHasher is used by
+// default. A *PHCHasher is validated, New fails if its algorithm or parameters are invalid, and traced.
+func WithHasher(hasher fosite.Hasher) Option {
+	return func(o *options) {
+		o.hasher = hasher
+	}
+}
+
+// WithLogger sets the logger used by the handlers and by the default herodot.Writer. Hydra's own components keep
+// logging to the logger of the config.
+func WithLogger(logger logrus.FieldLogger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithWriter sets the herodot.Writer used to write responses, a JSON writer using the logger is used by default.
+func WithWriter(writer herodot.Writer) Option {
+	return func(o *options) {
+		o.writer = writer
+	}
+}
+
+// WithTracer adds tracer as the first middleware of both handlers, e.g. the *tracing.Tracer of Hydra's config.
+func WithTracer(tracer negroni.Handler) Option {
+	return func(o *options) {
+		o.tracer = tracer
+	}
+}
+
+// WithConnection uses connection to create the managers instead of connecting the backend registered for the scheme
+// of the config's DatabaseURL, which is shared by every config in the process. New fails if the context of the config
+// was already initialised, as its connection can no longer be replaced.
+func WithConnection(connection config.BackendConnector) Option {
+	return func(o *options) {
+		o.connection = connection
+	}
+}
+
+// WithDatastoreTracing starts a span for every operation of the Datastore managers, the same as setting tracing=true in
+// the DSN. It has no effect on other backends.
+func WithDatastoreTracing() Option {
+	return func(o *options) {
+		o.dsTracing = true
+	}
+}
+
+// WithClientCache caches the client lookups of the Datastore client manager, see client.CachingManager. It has no
+// effect on other backends.
+func WithClientCache(opts dclient.CacheOptions) Option {
+	return func(o *options) {
+		o.clientCache = &opts
+	}
+}
+
+// WithInvalidationBus publishes the changes made by the Datastore managers to bus and invalidates the client cache
+// with the changes made by other replicas. bus must be started by the caller. It has no effect on other backends.
+func WithInvalidationBus(bus *invalidation.Bus) Option {
+	return func(o *options) {
+		o.bus = bus
+	}
+}
+
+// WithSessionEncryption seals the sessions and request forms of the OAuth2 sessions stored in Datastore with data keys
+// handed out by encrypter, see envelope.NewEncrypter. Sessions stored in plaintext are sealed when they are next read.
+// It has no effect on other backends.
+func WithSessionEncryption(encrypter *envelope.Encrypter) Option {
+	return func(o *options) {
+		o.encrypter = encrypter
+	}
+}
+
+// WithFormRedactor redacts the request forms of the OAuth2 sessions stored in Datastore with redactor instead of
+// oauth2.NewFormRedactor, an empty oauth2.FormRedactor stores them as is. It has no effect on other backends.
+func WithFormRedactor(redactor *doauth2.FormRedactor) Option {
+	return func(o *options) {
+		o.redactor = redactor
+	}
+}
+
+// WithKMSKeyEncryption encrypts the JSON Web Keys Hydra stores in Datastore, e.g. its ID Token keys, with data keys
+// wrapped by a Cloud KMS crypto key instead of the system secret, see jwk.NewKMSCipher. Keys stored before are still
+// read with the system secret. It has no effect on other backends.
+func WithKMSKeyEncryption(cipher *djwk.KMSCipher) Option {
+	return func(o *options) {
+		o.kmsCipher = cipher
+	}
+}
+
+// New will bootstrap Hydra using the configured signer to sign JWT Access Tokens and ID Tokens and return the frontend
+// and backend http.Handlers for you to use. Unlike Hydra's own commands it does not read or change any global viper
+// state, so multiple instances may be created in one process.
+func New(ctx context.Context, c *config.Config, opts ...Option) (http.Handler, http.Handler, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.signer == nil {
+		return nil, nil, errors.New("a signer must be configured, e.g. with WithIAMSigner or WithKMSSigner")
+	}
+
+	jwtStrat, keys, err := o.signer(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if o.logger == nil {
+		o.logger = c.GetLogger()
+	}
+	if o.writer == nil {
+		o.writer = herodot.NewJSONWriter(o.logger)
+	}
+	if h, ok := o.hasher.(*PHCHasher); ok {
+		if o.hasher, err = newTracedPHCHasher(h); err != nil {
+			return nil, nil, err
+		}
+	} else if o.hasher == nil {
+		if o.hasher, err = NewPHCHasher(c); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := o.configureConnection(c); err != nil {
+		return nil, nil, err
+	}
+
+	// The client manager is created with the hasher of the context when registering the routes
+	c.Context().Hasher = o.hasher
+
+	c.BuildVersion = "hydra-gcp"
+	handler := server.NewHandler(c, o.writer)
+
+	frontend := httprouter.New()
+	backend := httprouter.New()
+
+	handler.RegisterRoutes(frontend, backend)
+	injectGCPOauth2(ctx, handler, c, jwtStrat)
+
+	// Serve the client listing with cursors and the secret rotation API if the clients are stored in Datastore, Hydra
+	// serves every other route
+	if manager, ok := dclient.AsDatastoreManager(handler.Clients.Manager); ok {
+		clients := httprouter.New()
+		clients.HandleMethodNotAllowed = false
+		clients.NotFound = backend
+		dclient.NewListHandler(manager, o.writer).SetRoutes(clients)
+		dclient.NewSecretHandler(manager, o.writer).SetRoutes(clients)
+		backend = clients
+	}
+
+	// Serve the token listing and bulk revocation if the tokens are stored in Datastore
+	if store, ok := c.Context().FositeStore.(*doauth2.FositeDatastoreStore); ok {
+		tokens := httprouter.New()
+		tokens.HandleMethodNotAllowed = false
+		tokens.NotFound = backend
+		doauth2.NewTokenHandler(store, o.writer).SetRoutes(tokens)
+		backend = tokens
+	}
+
+	var middlewares []negroni.Handler
+	if o.tracer != nil {
+		middlewares = append(middlewares, o.tracer)
+	}
+	middlewares = append(middlewares, o.middlewares...)
+
+	enhancedFrontend := server.EnhanceRouter(c, nil, handler, frontend, middlewares, false)
+	enhancedBackend := server.EnhanceRouter(c, nil, handler, backend, middlewares, false)
+
+	jwksHandler := o.jwksHandler
+	if jwksHandler == nil {
+		jwksOptions := o.jwksOptions
+		if o.idTokenKeys && jwksOptions.KeyManager == nil {
+			jwksOptions.KeyManager = c.Context().KeyManager
+		}
+		jwksHandler = NewJWKSHandler(keys, jwksOptions)
+	}
+
+	serveMux := http.NewServeMux()
+	serveMux.Handle(jwk.WellKnownKeysPath, jwksHandler)
+	serveMux.Handle("/", enhancedFrontend)
+
+	frontendHandler, backendHandler := o.withCORS(handler, serveMux, enhancedBackend)
+	return frontendHandler, backendHandler, nil
+}
+
+// configureConnection sets up the connection of the context of c the managers are created with. The options are
+// applied to the connection given to WithConnection, or to a copy of the registered Datastore backend which is shared
+// by every config in the process.
+func (o *options) configureConnection(c *config.Config) error {
+	if o.connection != nil {
+		if err := useConnection(c, o.connection); err != nil {
+			return err
+		}
+	} else if connection, ok := c.Context().Connection.(*dconfig.DatastoreConnection); ok {
+		instance := *connection
+		c.Context().Connection = &instance
+	}
+
+	connection, ok := c.Context().Connection.(*dconfig.DatastoreConnection)
+	if !ok {
+		return nil
+	}
+	if o.dsTracing {
+		connection.EnableTracing()
+	}
+	if o.clientCache != nil {
+		connection.EnableClientCache(*o.clientCache)
+	}
+	if o.bus != nil {
+		connection.EnableInvalidation(o.bus)
+	}
+	if o.encrypter != nil {
+		connection.EnableEncryption(o.encrypter)
+	}
+	if o.redactor != nil {
+		connection.SetFormRedactor(o.redactor)
+	}
+	if o.kmsCipher != nil {
+		connection.EnableKMSKeyEncryption(o.kmsCipher)
+	}
+	return nil
+}
+
+// withCORS wraps the frontend and backend with the CORS handlers enabled by WithFrontendCORS and WithCORS
+func (o *options) withCORS(handler *server.Handler, frontend, backend http.Handler) (http.Handler, http.Handler) {
+	if o.cors != nil {
+		o.logger.Info("Enabled CORS on the backend")
+		backend = gcontext.ClearHandler(cors.New(*o.cors).Handler(backend))
+	}
+	if o.frontCORS != nil {
+		o.logger.Info("Enabled CORS on the frontend")
+		frontendCORS := *o.frontCORS
+		if frontendCORS.AllowOriginRequestFunc == nil {
+			frontendCORS.AllowOriginRequestFunc = clientOriginAllowed(handler, frontendCORS.AllowedOrigins)
+		}
+		frontend = gcontext.ClearHandler(cors.New(frontendCORS).Handler(frontend))
+	}
+	return frontend, backend
+}
+
+// clientOriginAllowed returns a function allowing the given origins as well as the AllowedCORSOrigins of the client
+// authenticating the request, either with basic auth or with an access token.
+func clientOriginAllowed(handler *server.Handler, allowedOrigins []string) func(r *http.Request, origin string) bool {
+	return func(r *http.Request, origin string) bool {
+		if stringslice.Has(allowedOrigins, origin) {
+			return true
+		}
+
+		username, _, ok := r.BasicAuth()
+		if !ok || username == "" {
+			token := fosite.AccessTokenFromRequest(r)
+			if token == "" {
+				return false
+			}
+
+			_, ar, err := handler.OAuth2.OAuth2.IntrospectToken(r.Context(), token, fosite.AccessToken, hoauth2.NewSession(""))
+			if err != nil {
+				return false
+			}
+
+			username = ar.GetClient().GetID()
+		}
+
+		cl, err := handler.Clients.Manager.GetConcreteClient(r.Context(), username)
+		if err != nil {
+			return false
+		}
+
+		return stringslice.Has(cl.AllowedCORSOrigins, origin)
+	}
+}
+
+// corsOptionsFromEnv reads the CORS options from the same CORS_* environment variables Hydra uses
+func corsOptionsFromEnv() cors.Options {
+	allowCredentials, _ := strconv.ParseBool(os.Getenv("CORS_ALLOWED_CREDENTIALS"))
+	debug, _ := strconv.ParseBool(os.Getenv("CORS_DEBUG"))
+	maxAge, _ := strconv.Atoi(os.Getenv("CORS_MAX_AGE"))
+	passthrough, _ := strconv.ParseBool(os.Getenv("CORS_OPTIONS_PASSTHROUGH"))
+
+	return cors.Options{
+		AllowedOrigins:     stringsx.Splitx(os.Getenv("CORS_ALLOWED_ORIGINS"), ","),
+		AllowedMethods:     stringsx.Splitx(os.Getenv("CORS_ALLOWED_METHODS"), ","),
+		AllowedHeaders:     stringsx.Splitx(os.Getenv("CORS_ALLOWED_HEADERS"), ","),
+		ExposedHeaders:     stringsx.Splitx(os.Getenv("CORS_EXPOSED_HEADERS"), ","),
+		AllowCredentials:   allowCredentials,
+		MaxAge:             maxAge,
+		OptionsPassthrough: passthrough,
+		Debug:              debug,
+	}
+}
+
+// placeholderScheme is the DSN scheme of placeholderConnection
+const placeholderScheme = "hydra-gcp-placeholder"
+
+// placeholderConnection is registered so useConnection can tell whether it initialised the context of a config. It is
+// replaced by the connection given to WithConnection right away, so none of its managers are ever created.
+type placeholderConnection struct {
+	config.BackendConnector
+}
+
+func (placeholderConnection) Init(string, logrus.FieldLogger, ...config.ConnectorOptions) error {
+	return nil
+}
+
+func (placeholderConnection) Prefixes() []string { return []string{placeholderScheme} }
+
+var placeholder = &placeholderConnection{}
+
+// useConnection initialises the context of c with connection. It returns an error if the context was already
+// initialised.
+func useConnection(c *config.Config, connection config.BackendConnector) error {
+	dsn := c.DatabaseURL
+	c.DatabaseURL = placeholderScheme + "://"
+	ctx := c.Context()
+	c.DatabaseURL = dsn
+
+	if ctx.Connection != placeholder {
+		return errors.New("WithConnection requires a config whose context was not initialised yet")
+	}
+	ctx.Connection = connection
+	return nil
+}
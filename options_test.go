@@ -0,0 +1,234 @@
+// Copyright © 2018 Prateek Malhotra (someone1@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hydragcp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ory/fosite"
+	"github.com/ory/herodot"
+	"github.com/ory/hydra/config"
+	"github.com/rs/cors"
+	"github.com/sirupsen/logrus"
+	"github.com/someone1/gcp-jwt-go"
+	"github.com/urfave/negroni"
+
+	dconfig "github.com/someone1/hydra-gcp/config"
+	"github.com/someone1/hydra-gcp/envelope"
+	"github.com/someone1/hydra-gcp/invalidation"
+)
+
+func TestCorsOptionsFromEnv(t *testing.T) {
+	env := map[string]string{
+		"CORS_ALLOWED_ORIGINS":     "https://a.example.com,https://b.example.com",
+		"CORS_ALLOWED_METHODS":     "GET,POST",
+		"CORS_ALLOWED_HEADERS":     "Authorization",
+		"CORS_EXPOSED_HEADERS":     "",
+		"CORS_ALLOWED_CREDENTIALS": "true",
+		"CORS_MAX_AGE":             "10",
+		"CORS_DEBUG":               "invalid",
+		"CORS_OPTIONS_PASSTHROUGH": "true",
+	}
+	for k, v := range env {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		if ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+	}
+
+	want := cors.Options{
+		AllowedOrigins:     []string{"https://a.example.com", "https://b.example.com"},
+		AllowedMethods:     []string{"GET", "POST"},
+		AllowedHeaders:     []string{"Authorization"},
+		ExposedHeaders:     []string{},
+		AllowCredentials:   true,
+		MaxAge:             10,
+		OptionsPassthrough: true,
+	}
+	if got := corsOptionsFromEnv(); !reflect.DeepEqual(got, want) {
+		t.Errorf("corsOptionsFromEnv() = %+v, want %+v", got, want)
+	}
+}
+
+func TestHandlerOptions(t *testing.T) {
+	for _, enableCors := range []bool{false, true} {
+		o := &options{}
+		for _, opt := range handlerOptions(herodot.NewJSONWriter(nil), enableCors) {
+			opt(o)
+		}
+		if o.writer == nil {
+			t.Errorf("expected the writer to be set")
+		}
+		if (o.cors != nil) != enableCors || (o.frontCORS != nil) != enableCors {
+			t.Errorf("expected CORS on the frontend and backend to be %v, got %v and %v", enableCors, o.frontCORS != nil, o.cors != nil)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	hasher := &fosite.BCrypt{WorkFactor: 4}
+	tracer := negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) { next(w, r) })
+	middleware := negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) { next(w, r) })
+	jwks := http.NotFoundHandler()
+
+	o := &options{}
+	for _, opt := range []Option{
+		WithIAMSigner(&gcpjwt.IAMConfig{ServiceAccount: "test@example.com"}),
+		WithCORS(cors.Options{AllowedOrigins: []string{"*"}}),
+		WithFrontendCORS(cors.Options{AllowedOrigins: []string{"https://example.com", "https://other.example.com"}}),
+		WithMiddleware(middleware),
+		WithMiddleware(middleware),
+		WithIDTokenKeys(),
+		WithJWKSHandler(jwks),
+		WithHasher(hasher),
+		WithTracer(tracer),
+	} {
+		opt(o)
+	}
+
+	if o.signer == nil {
+		t.Errorf("expected a signer to be set")
+	}
+	if o.cors == nil || len(o.cors.AllowedOrigins) != 1 {
+		t.Errorf("expected the CORS options to be set, got %+v", o.cors)
+	}
+	if o.frontCORS == nil || len(o.frontCORS.AllowedOrigins) != 2 {
+		t.Errorf("expected the frontend CORS options to be set apart, got %+v", o.frontCORS)
+	}
+	if len(o.middlewares) != 2 {
+		t.Errorf("expected middlewares to be appended, got %d", len(o.middlewares))
+	}
+	if !o.idTokenKeys || o.jwksHandler == nil || o.hasher != hasher || o.tracer == nil {
+		t.Errorf("unexpected options %+v", o)
+	}
+
+	_, keys, err := o.signer(context.Background())
+	if err != nil {
+		t.Fatalf("could not create signer: %v", err)
+	}
+	if source, ok := keys.(*RemoteKeySetSource); !ok || source.URL != serviceAccountJWKSURL("test@example.com") {
+		t.Errorf("expected the service account key set to be served, got %+v", keys)
+	}
+}
+
+func TestNewRequiresSigner(t *testing.T) {
+	if _, _, err := New(context.Background(), &config.Config{}); err == nil {
+		t.Errorf("expected an error without a signer")
+	}
+}
+
+func TestUseConnection(t *testing.T) {
+	secret := "a-system-secret-of-at-least-32-chars"
+	connection := &config.MemoryBackend{}
+
+	c := &config.Config{DatabaseURL: "memory", SystemSecret: secret}
+	if err := useConnection(c, connection); err != nil {
+		t.Fatalf("could not use the connection: %v", err)
+	}
+	if c.Context().Connection != connection {
+		t.Errorf("expected the context to use the given connection, got %T", c.Context().Connection)
+	}
+	if c.DatabaseURL != "memory" {
+		t.Errorf("expected the DatabaseURL to be restored, got %q", c.DatabaseURL)
+	}
+
+	c = &config.Config{DatabaseURL: "memory", SystemSecret: secret}
+	initialised := c.Context().Connection
+	if err := useConnection(c, connection); err == nil {
+		t.Errorf("expected an error when the context was already initialised")
+	}
+	if c.Context().Connection != initialised {
+		t.Errorf("expected the connection of an initialised context to be left alone")
+	}
+}
+
+func TestConfigureConnection(t *testing.T) {
+	secret := "a-system-secret-of-at-least-32-chars"
+	shared, err := dconfig.NewDatastoreConnection(nil, "datastore://?namespace=shared", logrus.New())
+	if err != nil {
+		t.Fatalf("could not create connection: %v", err)
+	}
+	before := *shared
+
+	// Stands in for a config whose context uses the backend registered for every config in the process
+	c := &config.Config{DatabaseURL: "memory", SystemSecret: secret}
+	if err := useConnection(c, shared); err != nil {
+		t.Fatalf("could not use the connection: %v", err)
+	}
+
+	o := &options{dsTracing: true, bus: invalidation.NewBus(nil, logrus.New()), encrypter: &envelope.Encrypter{}}
+	if err := o.configureConnection(c); err != nil {
+		t.Fatalf("could not configure the connection: %v", err)
+	}
+	if c.Context().Connection == shared {
+		t.Errorf("expected the options to be applied to a copy of the shared connection")
+	}
+	if !reflect.DeepEqual(*shared, before) {
+		t.Errorf("expected the shared connection to be left alone")
+	}
+
+	// A connection given to WithConnection is used as is
+	connection, err := dconfig.NewDatastoreConnection(nil, "datastore://?namespace=tenant", logrus.New())
+	if err != nil {
+		t.Fatalf("could not create connection: %v", err)
+	}
+	o = &options{connection: connection, dsTracing: true}
+	c = &config.Config{DatabaseURL: "memory", SystemSecret: secret}
+	if err := o.configureConnection(c); err != nil {
+		t.Fatalf("could not configure the connection: %v", err)
+	}
+	if c.Context().Connection != connection {
+		t.Errorf("expected the connection given to WithConnection to be used")
+	}
+}
+
+func TestOptionsCORS(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	allowed := func(h http.Handler, origin string) bool {
+		r := httptest.NewRequest(http.MethodGet, "/clients", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Header().Get("Access-Control-Allow-Origin") == origin
+	}
+
+	// CORS is enabled on the backend only unless asked for on the frontend
+	o := &options{logger: logrus.New()}
+	WithCORS(cors.Options{AllowedOrigins: []string{"https://admin.example.com"}})(o)
+	frontend, backend := o.withCORS(nil, ok, ok)
+	if allowed(frontend, "https://admin.example.com") {
+		t.Errorf("expected CORS to be disabled on the frontend")
+	}
+	if !allowed(backend, "https://admin.example.com") {
+		t.Errorf("expected CORS to be enabled on the backend")
+	}
+
+	WithFrontendCORS(cors.Options{AllowedOrigins: []string{"https://example.com"}})(o)
+	frontend, backend = o.withCORS(nil, ok, ok)
+	if !allowed(frontend, "https://example.com") || allowed(frontend, "https://admin.example.com") {
+		t.Errorf("expected the frontend to allow its own origins only")
+	}
+	if allowed(backend, "https://example.com") {
+		t.Errorf("expected the backend to keep its own origins")
+	}
+}
@@ -0,0 +1,394 @@
+package hydragcp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/config"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.opencensus.io/trace"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Algorithms supported by the PHCHasher
+const (
+	BCryptAlgorithm   = "bcrypt"
+	Argon2idAlgorithm = "argon2id"
+	ScryptAlgorithm   = "scrypt"
+)
+
+var (
+	// ErrUnknownHash is returned when comparing against a hash of an unsupported algorithm
+	ErrUnknownHash = errors.New("the hash is not of a supported algorithm")
+	// ErrHashMismatch is returned when the data compared does not match the hash
+	ErrHashMismatch = errors.New("the data does not match the hash")
+)
+
+// Argon2Params are the parameters used to hash with argon2id
+type Argon2Params struct {
+	// Memory is the memory used in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// ScryptParams are the parameters used to hash with scrypt
+type ScryptParams struct {
+	// LogN is the base 2 logarithm of the CPU/memory cost N
+	LogN       uint8
+	R          int
+	P          int
+	SaltLength int
+	KeyLength  int
+}
+
+const (
+	minSaltLength = 8
+	minKeyLength  = 16
+)
+
+// validate makes sure the cost parameters are usable, argon2.IDKey panics otherwise
+func (p Argon2Params) validate() error {
+	if p.Iterations < 1 || p.Parallelism < 1 || p.Memory < 8*uint32(p.Parallelism) {
+		return errors.Errorf("invalid argon2id parameters m=%d,t=%d,p=%d: t and p must be at least 1 and m at least 8*p",
+			p.Memory, p.Iterations, p.Parallelism)
+	}
+	return nil
+}
+
+// validate makes sure the cost parameters are usable
+func (p ScryptParams) validate() error {
+	if p.LogN < 1 || p.LogN > 30 || p.R < 1 || p.P < 1 || p.R*p.P >= 1<<30 {
+		return errors.Errorf("invalid scrypt parameters ln=%d,r=%d,p=%d: ln must be within [1, 30], r and p at least 1 and r*p below 2^30",
+			p.LogN, p.R, p.P)
+	}
+	return nil
+}
+
+// DefaultArgon2Params are the argon2id parameters recommended by RFC 9106 for memory constrained environments
+var DefaultArgon2Params = Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 4, SaltLength: 16, KeyLength: 32}
+
+// DefaultScryptParams are the scrypt parameters recommended for interactive logins
+var DefaultScryptParams = ScryptParams{LogN: 15, R: 8, P: 1, SaltLength: 16, KeyLength: 32}
+
+// PHCHasher hashes with the configured algorithm and compares against bcrypt hashes and argon2id or scrypt hashes in
+// the PHC string format, so the algorithm or its parameters may change without invalidating existing hashes.
+type PHCHasher struct {
+	// Algorithm is the algorithm new hashes are made with, bcrypt if empty
+	Algorithm string
+	// BCryptWorkFactor is the bcrypt cost, bcrypt.DefaultCost if zero
+	BCryptWorkFactor int
+	// Argon2 are the argon2id parameters, DefaultArgon2Params if zero
+	Argon2 Argon2Params
+	// Scrypt are the scrypt parameters, DefaultScryptParams if zero
+	Scrypt ScryptParams
+}
+
+// Validate returns an error if new hashes cannot be made with the configured algorithm and parameters
+func (h *PHCHasher) Validate() error {
+	switch h.algorithm() {
+	case BCryptAlgorithm:
+		if cost := h.bcryptCost(); cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return errors.Errorf("bcrypt work factor %d is out of range [%d, %d]", cost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return nil
+	case Argon2idAlgorithm:
+		p := h.argon2Params()
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if p.SaltLength < minSaltLength || p.KeyLength < minKeyLength {
+			return errors.Errorf("argon2id salt and key must be at least %d and %d bytes long, got %d and %d",
+				minSaltLength, minKeyLength, p.SaltLength, p.KeyLength)
+		}
+		return nil
+	case ScryptAlgorithm:
+		p := h.scryptParams()
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if p.SaltLength < minSaltLength || p.KeyLength < minKeyLength {
+			return errors.Errorf("scrypt salt and key must be at least %d and %d bytes long, got %d and %d",
+				minSaltLength, minKeyLength, p.SaltLength, p.KeyLength)
+		}
+		return nil
+	}
+	return errors.Errorf("unsupported hash algorithm %q, expected one of %s, %s or %s", h.Algorithm,
+		BCryptAlgorithm, Argon2idAlgorithm, ScryptAlgorithm)
+}
+
+// Hash is implemented for the fosite.Hasher interface
+func (h *PHCHasher) Hash(ctx context.Context, data []byte) ([]byte, error) {
+	switch h.algorithm() {
+	case BCryptAlgorithm:
+		return (&fosite.BCrypt{WorkFactor: h.bcryptCost()}).Hash(ctx, data)
+	case Argon2idAlgorithm:
+		p := h.argon2Params()
+		salt, err := newSalt(int(p.SaltLength))
+		if err != nil {
+			return nil, err
+		}
+		key := argon2.IDKey(data, salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+		return []byte(fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2idAlgorithm, argon2.Version, p.Memory,
+			p.Iterations, p.Parallelism, encodePHC(salt), encodePHC(key))), nil
+	case ScryptAlgorithm:
+		p := h.scryptParams()
+		salt, err := newSalt(p.SaltLength)
+		if err != nil {
+			return nil, err
+		}
+		key, err := scrypt.Key(data, salt, 1<<p.LogN, p.R, p.P, p.KeyLength)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return []byte(fmt.Sprintf("$%s$ln=%d,r=%d,p=%d$%s$%s", ScryptAlgorithm, p.LogN, p.R, p.P,
+			encodePHC(salt), encodePHC(key))), nil
+	}
+	return nil, h.Validate()
+}
+
+// Compare is implemented for the fosite.Hasher interface
+func (h *PHCHasher) Compare(ctx context.Context, hash, data []byte) error {
+	parsed, err := parsePHC(hash)
+	if err != nil {
+		return err
+	}
+
+	var key []byte
+	switch parsed.algorithm {
+	case BCryptAlgorithm:
+		return (&fosite.BCrypt{}).Compare(ctx, hash, data)
+	case Argon2idAlgorithm:
+		p := parsed.argon2
+		key = argon2.IDKey(data, parsed.salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(parsed.key)))
+	case ScryptAlgorithm:
+		p := parsed.scrypt
+		if key, err = scrypt.Key(data, parsed.salt, 1<<p.LogN, p.R, p.P, len(parsed.key)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if subtle.ConstantTimeCompare(key, parsed.key) != 1 {
+		return errors.WithStack(ErrHashMismatch)
+	}
+	return nil
+}
+
+// NeedsRehash is implemented for the client.RehashChecker interface, hashes of another algorithm or with other
+// parameters than the configured ones need a rehash.
+func (h *PHCHasher) NeedsRehash(hash []byte) bool {
+	parsed, err := parsePHC(hash)
+	if err != nil || parsed.algorithm != h.algorithm() {
+		return true
+	}
+
+	switch parsed.algorithm {
+	case BCryptAlgorithm:
+		return parsed.bcryptCost != h.bcryptCost()
+	case Argon2idAlgorithm:
+		p := h.argon2Params()
+		return parsed.argon2.Memory != p.Memory || parsed.argon2.Iterations != p.Iterations ||
+			parsed.argon2.Parallelism != p.Parallelism || len(parsed.key) != int(p.KeyLength)
+	case ScryptAlgorithm:
+		p := h.scryptParams()
+		return parsed.scrypt.LogN != p.LogN || parsed.scrypt.R != p.R || parsed.scrypt.P != p.P ||
+			len(parsed.key) != p.KeyLength
+	}
+	return true
+}
+
+// traceAttributes describes the algorithm and parameters new hashes are made with
+func (h *PHCHasher) traceAttributes() []trace.Attribute {
+	attrs := []trace.Attribute{trace.StringAttribute("hasher.algorithm", h.algorithm())}
+	switch h.algorithm() {
+	case BCryptAlgorithm:
+		attrs = append(attrs, trace.Int64Attribute("bcrypt.workfactor", int64(h.bcryptCost())))
+	case Argon2idAlgorithm:
+		p := h.argon2Params()
+		attrs = append(attrs,
+			trace.Int64Attribute("argon2.memory", int64(p.Memory)),
+			trace.Int64Attribute("argon2.iterations", int64(p.Iterations)),
+			trace.Int64Attribute("argon2.parallelism", int64(p.Parallelism)))
+	case ScryptAlgorithm:
+		p := h.scryptParams()
+		attrs = append(attrs,
+			trace.Int64Attribute("scrypt.ln", int64(p.LogN)),
+			trace.Int64Attribute("scrypt.r", int64(p.R)),
+			trace.Int64Attribute("scrypt.p", int64(p.P)))
+	}
+	return attrs
+}
+
+func (h *PHCHasher) bcryptCost() int {
+	if h.BCryptWorkFactor == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.BCryptWorkFactor
+}
+
+func (h *PHCHasher) argon2Params() Argon2Params {
+	if h.Argon2 == (Argon2Params{}) {
+		return DefaultArgon2Params
+	}
+	return h.Argon2
+}
+
+func (h *PHCHasher) scryptParams() ScryptParams {
+	if h.Scrypt == (ScryptParams{}) {
+		return DefaultScryptParams
+	}
+	return h.Scrypt
+}
+
+func (h *PHCHasher) algorithm() string {
+	if h.Algorithm == "" {
+		return BCryptAlgorithm
+	}
+	return h.Algorithm
+}
+
+// phcHash is a parsed hash
+type phcHash struct {
+	algorithm  string
+	bcryptCost int
+	argon2     Argon2Params
+	scrypt     ScryptParams
+	salt       []byte
+	key        []byte
+}
+
+// parsePHC parses bcrypt hashes, and argon2id and scrypt hashes in the PHC string format:
+// $<algorithm>[$v=<version>]$<param>=<value>(,<param>=<value>)*$<salt>$<hash>
+func parsePHC(hash []byte) (*phcHash, error) {
+	if cost, err := bcrypt.Cost(hash); err == nil {
+		return &phcHash{algorithm: BCryptAlgorithm, bcryptCost: cost}, nil
+	}
+
+	fields := strings.Split(string(hash), "$")
+	if len(fields) < 5 || fields[0] != "" {
+		return nil, errors.WithStack(ErrUnknownHash)
+	}
+
+	parsed := &phcHash{algorithm: fields[1]}
+	switch parsed.algorithm {
+	case Argon2idAlgorithm:
+		if len(fields) != 6 || fields[2] != fmt.Sprintf("v=%d", argon2.Version) {
+			return nil, errors.WithStack(ErrUnknownHash)
+		}
+		if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &parsed.argon2.Memory, &parsed.argon2.Iterations,
+			&parsed.argon2.Parallelism); err != nil {
+			return nil, errors.Wrap(ErrUnknownHash, err.Error())
+		}
+		if err := parsed.argon2.validate(); err != nil {
+			return nil, errors.Wrap(ErrUnknownHash, err.Error())
+		}
+	case ScryptAlgorithm:
+		if len(fields) != 5 {
+			return nil, errors.WithStack(ErrUnknownHash)
+		}
+		if _, err := fmt.Sscanf(fields[2], "ln=%d,r=%d,p=%d", &parsed.scrypt.LogN, &parsed.scrypt.R,
+			&parsed.scrypt.P); err != nil {
+			return nil, errors.Wrap(ErrUnknownHash, err.Error())
+		}
+		if err := parsed.scrypt.validate(); err != nil {
+			return nil, errors.Wrap(ErrUnknownHash, err.Error())
+		}
+	default:
+		return nil, errors.WithStack(ErrUnknownHash)
+	}
+
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(fields[len(fields)-2]); err != nil {
+		return nil, errors.Wrap(ErrUnknownHash, err.Error())
+	}
+	if parsed.key, err = base64.RawStdEncoding.DecodeString(fields[len(fields)-1]); err != nil {
+		return nil, errors.Wrap(ErrUnknownHash, err.Error())
+	}
+	if len(parsed.key) == 0 {
+		return nil, errors.WithStack(ErrUnknownHash)
+	}
+	return parsed, nil
+}
+
+func encodePHC(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func newSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return salt, nil
+}
+
+// NewPHCHasher returns a traced PHCHasher, it is the default hasher of New. New hashes are made with the algorithm read
+// from HASHER_ALGORITHM, with the argon2id parameters read from ARGON2_MEMORY, ARGON2_ITERATIONS, ARGON2_PARALLELISM,
+// ARGON2_SALT_LENGTH and ARGON2_KEY_LENGTH, the scrypt parameters read from SCRYPT_LN, SCRYPT_R, SCRYPT_P,
+// SCRYPT_SALT_LENGTH and SCRYPT_KEY_LENGTH, or the bcrypt work factor of c. The settings are read with viper like the
+// other Hydra settings, those not set take their default values.
+func NewPHCHasher(c *config.Config) (fosite.Hasher, error) {
+	h, err := phcHasherFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	return newTracedPHCHasher(h)
+}
+
+// phcHasherFromConfig reads the settings of the PHCHasher made by NewPHCHasher
+func phcHasherFromConfig(c *config.Config) (*PHCHasher, error) {
+	h := &PHCHasher{
+		Algorithm:        viper.GetString("HASHER_ALGORITHM"),
+		BCryptWorkFactor: c.BCryptWorkFactor,
+		Argon2:           DefaultArgon2Params,
+		Scrypt:           DefaultScryptParams,
+	}
+
+	settings := []struct {
+		key  string
+		bits int
+		set  func(v uint64)
+	}{
+		{"ARGON2_MEMORY", 32, func(v uint64) { h.Argon2.Memory = uint32(v) }},
+		{"ARGON2_ITERATIONS", 32, func(v uint64) { h.Argon2.Iterations = uint32(v) }},
+		{"ARGON2_PARALLELISM", 8, func(v uint64) { h.Argon2.Parallelism = uint8(v) }},
+		{"ARGON2_SALT_LENGTH", 32, func(v uint64) { h.Argon2.SaltLength = uint32(v) }},
+		{"ARGON2_KEY_LENGTH", 32, func(v uint64) { h.Argon2.KeyLength = uint32(v) }},
+		{"SCRYPT_LN", 8, func(v uint64) { h.Scrypt.LogN = uint8(v) }},
+		{"SCRYPT_R", 31, func(v uint64) { h.Scrypt.R = int(v) }},
+		{"SCRYPT_P", 31, func(v uint64) { h.Scrypt.P = int(v) }},
+		{"SCRYPT_SALT_LENGTH", 31, func(v uint64) { h.Scrypt.SaltLength = int(v) }},
+		{"SCRYPT_KEY_LENGTH", 31, func(v uint64) { h.Scrypt.KeyLength = int(v) }},
+	}
+	for _, setting := range settings {
+		value := viper.GetString(setting.key)
+		if value == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(value, 10, setting.bits)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", setting.key)
+		}
+		setting.set(v)
+	}
+	return h, nil
+}
+
+// newTracedPHCHasher validates h and traces it
+func newTracedPHCHasher(h *PHCHasher) (fosite.Hasher, error) {
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+	return NewTracedHasher(h, h.traceAttributes()), nil
+}
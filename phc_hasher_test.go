@@ -0,0 +1,180 @@
+// Copyright © 2018 Prateek Malhotra (someone1@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hydragcp
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ory/hydra/config"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	dclient "github.com/someone1/hydra-gcp/client"
+)
+
+func testPHCHasher(algorithm string) *PHCHasher {
+	return &PHCHasher{
+		Algorithm:        algorithm,
+		BCryptWorkFactor: 4,
+		Argon2:           Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		Scrypt:           ScryptParams{LogN: 4, R: 8, P: 1, SaltLength: 16, KeyLength: 32},
+	}
+}
+
+func TestPHCHasher(t *testing.T) {
+	ctx := context.Background()
+	hashes := make(map[string][]byte)
+
+	for _, algorithm := range []string{BCryptAlgorithm, Argon2idAlgorithm, ScryptAlgorithm} {
+		t.Run(algorithm, func(t *testing.T) {
+			h := testPHCHasher(algorithm)
+			hash, err := h.Hash(ctx, []byte("secret"))
+			if err != nil {
+				t.Fatalf("could not hash: %v", err)
+			}
+			if algorithm != BCryptAlgorithm && !strings.HasPrefix(string(hash), "$"+algorithm+"$") {
+				t.Errorf("expected a PHC string for %s, got %s", algorithm, hash)
+			}
+			if err := h.Compare(ctx, hash, []byte("secret")); err != nil {
+				t.Errorf("expected the secret to match, got %v", err)
+			}
+			if err := h.Compare(ctx, hash, []byte("wrong")); err == nil {
+				t.Errorf("expected a wrong secret not to match")
+			}
+			if h.NeedsRehash(hash) {
+				t.Errorf("expected a hash with the configured parameters not to need a rehash")
+			}
+			hashes[algorithm] = hash
+		})
+	}
+
+	// Any supported hash is verified regardless of the configured algorithm, but needs a rehash
+	h := testPHCHasher(Argon2idAlgorithm)
+	for algorithm, hash := range hashes {
+		if err := h.Compare(ctx, hash, []byte("secret")); err != nil {
+			t.Errorf("expected the %s hash to be verified, got %v", algorithm, err)
+		}
+		if want := algorithm != Argon2idAlgorithm; dclient.NeedsRehash(NewTracedHasher(h, nil), hash) != want {
+			t.Errorf("expected NeedsRehash of the %s hash to be %v", algorithm, want)
+		}
+	}
+
+	h.Argon2.Iterations = 2
+	if !h.NeedsRehash(hashes[Argon2idAlgorithm]) {
+		t.Errorf("expected a hash with other parameters to need a rehash")
+	}
+
+	for _, hash := range []string{"", "plain", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$", "$md5$rounds=1$c2FsdA$aGFzaA"} {
+		if err := h.Compare(ctx, []byte(hash), []byte("secret")); errors.Cause(err) != ErrUnknownHash {
+			t.Errorf("expected ErrUnknownHash for %q, got %v", hash, err)
+		}
+	}
+}
+
+func TestPHCHasherValidate(t *testing.T) {
+	if err := (&PHCHasher{}).Validate(); err != nil {
+		t.Errorf("expected the zero PHCHasher to be valid, got %v", err)
+	}
+	for _, algorithm := range []string{Argon2idAlgorithm, ScryptAlgorithm} {
+		if err := (&PHCHasher{Algorithm: algorithm}).Validate(); err != nil {
+			t.Errorf("expected the default %s parameters to be valid, got %v", algorithm, err)
+		}
+	}
+
+	for name, h := range map[string]*PHCHasher{
+		"algorithm":          {Algorithm: "md5"},
+		"bcrypt work factor": {BCryptWorkFactor: 99},
+		"argon2 iterations":  {Algorithm: Argon2idAlgorithm, Argon2: Argon2Params{Memory: 1024, Parallelism: 1, SaltLength: 16, KeyLength: 32}},
+		"argon2 salt":        {Algorithm: Argon2idAlgorithm, Argon2: Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, KeyLength: 32}},
+		"scrypt ln":          {Algorithm: ScryptAlgorithm, Scrypt: ScryptParams{LogN: 40, R: 8, P: 1, SaltLength: 16, KeyLength: 32}},
+		"scrypt p":           {Algorithm: ScryptAlgorithm, Scrypt: ScryptParams{LogN: 4, R: 8, SaltLength: 16, KeyLength: 32}},
+	} {
+		if err := h.Validate(); err == nil {
+			t.Errorf("expected an invalid %s to be rejected", name)
+		}
+	}
+
+	h, err := NewPHCHasher(&config.Config{BCryptWorkFactor: 6})
+	if err != nil {
+		t.Fatalf("could not create the default hasher: %v", err)
+	}
+	if phc := h.(*tracedHasher).Hasher.(*PHCHasher); phc.algorithm() != BCryptAlgorithm || phc.bcryptCost() != 6 {
+		t.Errorf("expected a bcrypt hasher with the configured work factor, got %+v", phc)
+	}
+	if _, err := NewPHCHasher(&config.Config{BCryptWorkFactor: 99}); err == nil {
+		t.Errorf("expected an invalid work factor to be rejected")
+	}
+}
+
+func TestNewPHCHasherFromConfig(t *testing.T) {
+	defer viper.Reset()
+
+	viper.Set("HASHER_ALGORITHM", Argon2idAlgorithm)
+	viper.Set("ARGON2_MEMORY", "1024")
+	viper.Set("ARGON2_ITERATIONS", "2")
+	viper.Set("SCRYPT_LN", "12")
+	h, err := NewPHCHasher(&config.Config{})
+	if err != nil {
+		t.Fatalf("could not create the hasher: %v", err)
+	}
+	phc := h.(*tracedHasher).Hasher.(*PHCHasher)
+	if phc.algorithm() != Argon2idAlgorithm {
+		t.Errorf("expected an argon2id hasher, got %s", phc.algorithm())
+	}
+	want := DefaultArgon2Params
+	want.Memory, want.Iterations = 1024, 2
+	if got := phc.argon2Params(); got != want {
+		t.Errorf("expected the argon2id parameters %+v, got %+v", want, got)
+	}
+	if got := phc.scryptParams(); got.LogN != 12 || got.R != DefaultScryptParams.R {
+		t.Errorf("expected the scrypt parameters to be read, got %+v", got)
+	}
+
+	for key, value := range map[string]string{
+		"ARGON2_PARALLELISM": "0",
+		"ARGON2_MEMORY":      "-1",
+		"SCRYPT_R":           "eight",
+		"HASHER_ALGORITHM":   "md5",
+	} {
+		viper.Set(key, value)
+		if _, err := NewPHCHasher(&config.Config{}); err == nil {
+			t.Errorf("expected %s=%s to be rejected", key, value)
+		}
+		viper.Reset()
+		viper.Set("HASHER_ALGORITHM", Argon2idAlgorithm)
+	}
+}
+
+func TestPHCHasherInvalidParameters(t *testing.T) {
+	ctx := context.Background()
+	h := testPHCHasher(Argon2idAlgorithm)
+
+	// Stored parameters argon2.IDKey or scrypt.Key cannot hash with are rejected instead of panicking
+	for _, hash := range []string{
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA",
+		"$scrypt$ln=0,r=8,p=1$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA",
+		"$scrypt$ln=4,r=8,p=0$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA",
+	} {
+		if err := h.Compare(ctx, []byte(hash), []byte("secret")); errors.Cause(err) != ErrUnknownHash {
+			t.Errorf("expected ErrUnknownHash for %q, got %v", hash, err)
+		}
+		if !h.NeedsRehash([]byte(hash)) {
+			t.Errorf("expected %q to need a rehash", hash)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package hydragcp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"github.com/ory/hydra/config"
+	"github.com/pkg/errors"
+
+	dconfig "github.com/someone1/hydra-gcp/config"
+)
+
+// ErrTenantExists is returned by TenantRouter.Add when a tenant is already served on the same host and path prefix
+var ErrTenantExists = errors.New("a tenant is already served on this host and path prefix")
+
+// Tenant is a Hydra instance served by a TenantRouter
+type Tenant struct {
+	// Host the tenant is served on, e.g. tenant.example.com. Any host matches if empty.
+	Host string
+	// PathPrefix the tenant is served under, e.g. /tenant. It is stripped from the request path before it is
+	// dispatched to the tenant. Any path matches if empty.
+	PathPrefix string
+	// Config of the tenant, its Issuer must match where the tenant is served. DatabaseURL must be a Datastore URL, its
+	// namespace and options are used with the client shared by all tenants. Its Context must not be initialised yet.
+	Config *config.Config
+	// Options passed to New, e.g. WithIAMSigner with the tenant's service account
+	Options []Option
+}
+
+type tenantHandler struct {
+	host     string
+	prefix   string
+	frontend http.Handler
+	backend  http.Handler
+}
+
+// TenantRouter dispatches requests to one of several Hydra instances by host and path prefix, all sharing a single
+// Datastore client.
+type TenantRouter struct {
+	client *datastore.Client
+
+	mu      sync.RWMutex
+	tenants []*tenantHandler
+}
+
+// NewTenantRouter returns a TenantRouter whose tenants will use client
+func NewTenantRouter(client *datastore.Client) *TenantRouter {
+	return &TenantRouter{client: client}
+}
+
+// Add bootstraps Hydra for tenant and starts dispatching requests to it
+func (t *TenantRouter) Add(ctx context.Context, tenant Tenant) error {
+	if tenant.Config == nil {
+		return errors.New("a config must be provided for the tenant")
+	}
+
+	connection, err := dconfig.NewDatastoreConnection(t.client, tenant.Config.DatabaseURL, tenant.Config.GetLogger())
+	if err != nil {
+		return err
+	}
+
+	opts := append([]Option{WithConnection(connection)}, tenant.Options...)
+	frontend, backend, err := New(ctx, tenant.Config, opts...)
+	if err != nil {
+		return err
+	}
+
+	return t.add(tenant.Host, tenant.PathPrefix, frontend, backend)
+}
+
+func (t *TenantRouter) add(host, prefix string, frontend, backend http.Handler) error {
+	th := &tenantHandler{
+		host:     strings.ToLower(host),
+		prefix:   "/" + strings.Trim(prefix, "/"),
+		frontend: frontend,
+		backend:  backend,
+	}
+	if th.prefix == "/" {
+		th.prefix = ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, existing := range t.tenants {
+		if existing.host == th.host && existing.prefix == th.prefix {
+			return errors.Wrapf(ErrTenantExists, "%s%s", host, prefix)
+		}
+	}
+
+	t.tenants = append(t.tenants, th)
+	// Tenants with a host take precedence over those matching any host, then the longest path prefix wins
+	sort.SliceStable(t.tenants, func(i, j int) bool {
+		if (t.tenants[i].host == "") != (t.tenants[j].host == "") {
+			return t.tenants[i].host != ""
+		}
+		return len(t.tenants[i].prefix) > len(t.tenants[j].prefix)
+	})
+
+	return nil
+}
+
+// match returns the tenant serving r along with the request path without the tenant's prefix
+func (t *TenantRouter) match(r *http.Request) (*tenantHandler, string, bool) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, th := range t.tenants {
+		if th.host != "" && th.host != host {
+			continue
+		}
+		if th.prefix == "" {
+			return th, r.URL.Path, true
+		}
+		if r.URL.Path == th.prefix || strings.HasPrefix(r.URL.Path, th.prefix+"/") {
+			return th, "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, th.prefix), "/"), true
+		}
+	}
+
+	return nil, "", false
+}
+
+func (t *TenantRouter) serve(w http.ResponseWriter, r *http.Request, handler func(*tenantHandler) http.Handler) {
+	th, path, ok := t.match(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if path != r.URL.Path {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = path
+		r2.URL.RawPath = ""
+		r = r2
+	}
+
+	handler(th).ServeHTTP(w, r)
+}
+
+// Frontend returns the http.Handler dispatching requests to the frontend of each tenant
+func (t *TenantRouter) Frontend() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.serve(w, r, func(th *tenantHandler) http.Handler { return th.frontend })
+	})
+}
+
+// Backend returns the http.Handler dispatching requests to the backend of each tenant
+func (t *TenantRouter) Backend() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.serve(w, r, func(th *tenantHandler) http.Handler { return th.backend })
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright © 2018 Prateek Malhotra (someone1@gmail.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hydragcp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func namedHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name + " " + r.URL.Path))
+	})
+}
+
+func TestTenantRouter(t *testing.T) {
+	router := NewTenantRouter(nil)
+	for _, tenant := range []struct{ name, host, prefix string }{
+		{"default", "", ""},
+		{"prefixed", "", "/tenant-a/"},
+		{"host", "b.example.com", ""},
+		{"hostPrefixed", "b.example.com", "/admin"},
+	} {
+		if err := router.add(tenant.host, tenant.prefix, namedHandler(tenant.name), namedHandler(tenant.name+"Backend")); err != nil {
+			t.Fatalf("could not add tenant %s: %v", tenant.name, err)
+		}
+	}
+
+	if err := router.add("", "tenant-a", nil, nil); errors.Cause(err) != ErrTenantExists {
+		t.Errorf("expected ErrTenantExists, got %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		target  string
+		want    string
+	}{
+		{"default", router.Frontend(), "http://a.example.com/oauth2/token", "default /oauth2/token"},
+		{"prefixed", router.Frontend(), "http://a.example.com/tenant-a/oauth2/token", "prefixed /oauth2/token"},
+		{"prefixedRoot", router.Frontend(), "http://a.example.com/tenant-a", "prefixed /"},
+		{"partialPrefix", router.Frontend(), "http://a.example.com/tenant-ab/oauth2/token", "default /tenant-ab/oauth2/token"},
+		{"host", router.Frontend(), "http://B.example.com:4444/oauth2/token", "host /oauth2/token"},
+		{"hostPrefixed", router.Frontend(), "http://b.example.com/admin/clients", "hostPrefixed /clients"},
+		{"hostOverPrefix", router.Frontend(), "http://b.example.com/tenant-a/oauth2/token", "host /tenant-a/oauth2/token"},
+		{"backend", router.Backend(), "http://a.example.com/tenant-a/clients", "prefixedBackend /clients"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if body, _ := ioutil.ReadAll(w.Body); string(body) != tt.want {
+				t.Errorf("got %q, want %q", body, tt.want)
+			}
+		})
+	}
+
+	t.Run("NotFound", func(t *testing.T) {
+		router := NewTenantRouter(nil)
+		if err := router.add("a.example.com", "", namedHandler("a"), namedHandler("a")); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		router.Frontend().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://c.example.com/", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}